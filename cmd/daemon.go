@@ -0,0 +1,40 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"thesgo/control"
+
+	"github.com/spf13/cobra"
+)
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Keeps the client syncing and listening for offline peers in the background.",
+	Long: `Runs the client until it is interrupted, syncing with the homeserver and keeping the offline host
+	listening. Every other command run while the daemon is up is forwarded to it through a local socket.`,
+	Example: "thesgo daemon",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := backend.Config().SocketPath
+		//there is no terminal to ask for SAS confirmations, they are resolved through "user verifications"
+		backend.Matrix().SetConfirmer(backend.Matrix().Verifications())
+		srv, err := control.Serve(path, api)
+		if err != nil {
+			fmt.Println("Could not open control socket: " + err.Error())
+			os.Exit(1)
+		}
+		backend.OnStop(func() {
+			if err := srv.Close(); err != nil {
+				fmt.Println("Could not close control socket: " + err.Error())
+			}
+		})
+
+		fmt.Println("Daemon listening for commands on " + path)
+		select {} //the process is stopped by the signal handler set up in Thesgo.Start
+	},
+}
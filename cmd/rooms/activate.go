@@ -5,11 +5,8 @@ package rooms
 
 import (
 	"fmt"
-	"strconv"
-	"thesgo/matrix/mxevents"
 
 	"github.com/spf13/cobra"
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -22,9 +19,7 @@ var activateCmd = &cobra.Command{
 	Short: "Activates encryption in the given room",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		evt := prepEvent()
-
-		_, err := Backend.Matrix().SendStateEvent(evt)
+		err := API.ActivateEncryption(id.RoomID(RoomName), rotationPeriod, rotationMessages)
 		if err == nil {
 			fmt.Println("Room with ID " + id.RoomID(RoomName) + " is now encrypted.")
 		} else {
@@ -33,23 +28,6 @@ var activateCmd = &cobra.Command{
 	},
 }
 
-func prepEvent() (evt *mxevents.Event) {
-	fmt.Print(strconv.FormatInt(rotationPeriod, 10) + " - " + strconv.Itoa(rotationMessages))
-	evt = &mxevents.Event{
-		Event: &event.Event{
-			Type:   event.StateEncryption,
-			RoomID: id.RoomID(RoomName),
-			Content: event.Content{Parsed: &event.EncryptionEventContent{
-				Algorithm:              id.AlgorithmMegolmV1,
-				RotationPeriodMillis:   rotationPeriod,
-				RotationPeriodMessages: rotationMessages,
-			}},
-		},
-	}
-
-	return
-}
-
 func init() {
 	RoomCmd.AddCommand(activateCmd)
 
@@ -17,7 +17,7 @@ var exitCmd = &cobra.Command{
 	Long: `Stops a user from participating in a given room, but it may still be able to retrieve its history
 	if it rejoins the same room.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		Backend.Matrix().ExitRoom(id.RoomID(RoomName), reason)
+		API.ExitRoom(id.RoomID(RoomName), reason)
 	},
 }
 
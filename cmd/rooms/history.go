@@ -7,22 +7,27 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
+var before, after string
+var historyLimit int
+
 // historyCmd represents the history command
 var historyCmd = &cobra.Command{
 	Use:   "history",
-	Short: "Lists the 50 most recent messages in a room.",
-	Long:  ``,
+	Short: "Lists the most recent messages in a room, or the ones around a message.",
+	Long: `Lists the most recent messages in a room, newest first. The event ID shown with each message can be
+	given to --before to page further back, or to --after to page forward from it.`,
+	Example: "thesgo room -n 'room-name' history [--before '$event-id' | --after '$event-id'] [--limit 50]",
 	Run: func(cmd *cobra.Command, args []string) {
-		room := Backend.Matrix().GetRoom(id.RoomID(RoomName))
-		hist, _, _ := Backend.Matrix().GetHistory(room, 50, 0)
-		for _, evt := range hist {
-			if evt.Type == event.EventMessage { //only show the user messages, not the internal matrix messages
-				fmt.Println(evt.Sender.String() + " -> " + evt.Content.AsMessage().Body)
-			}
+		hist, err := API.History(id.RoomID(RoomName), historyLimit, id.EventID(before), id.EventID(after))
+		if err != nil {
+			fmt.Println("Could not load room history: " + err.Error())
+			return
+		}
+		for _, msg := range hist {
+			fmt.Println(msg.Sender.String() + " (" + msg.ID.String() + ") -> " + msg.Body)
 		}
 	},
 }
@@ -39,4 +44,8 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// historyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	historyCmd.Flags().StringVar(&before, "before", "", "Only show the messages before this event")
+	historyCmd.Flags().StringVar(&after, "after", "", "Only show the messages after this event")
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 50, "Maximum number of events loaded")
+	historyCmd.MarkFlagsMutuallyExclusive("before", "after")
 }
@@ -18,7 +18,7 @@ var inviteCmd = &cobra.Command{
 	Short: "Invite a user to an existing room.",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		Backend.Matrix().InviteUser(id.RoomID(RoomName), reason, user)
+		API.InviteUser(id.RoomID(RoomName), reason, user)
 	},
 }
 
@@ -4,6 +4,8 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package rooms
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
 	"maunium.net/go/mautrix/id"
 )
@@ -14,7 +16,12 @@ var joinCmd = &cobra.Command{
 	Short: "Joins an existing room.",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		Backend.Matrix().JoinRoom(id.RoomID(RoomName), Server)
+		account, err := API.Account()
+		if err != nil {
+			fmt.Println("Could not get the account info: " + err.Error())
+			return
+		}
+		API.JoinRoom(id.RoomID(RoomName), account.ServerName)
 	},
 }
 
@@ -4,6 +4,8 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package rooms
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
 	"maunium.net/go/mautrix/id"
 )
@@ -14,8 +16,15 @@ var membersCmd = &cobra.Command{
 	Short: "Fetches member list for the given room.",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		Backend.Matrix().JoinedMembers(id.RoomID(RoomName))
 		// for now, go with JoinedMembers //TODO: look into FetchMembers
+		members, err := API.Members(id.RoomID(RoomName))
+		if err != nil {
+			fmt.Println("Could not fetch room members: " + err.Error())
+			return
+		}
+		for _, member := range members {
+			fmt.Println(member)
+		}
 	},
 }
 
@@ -5,10 +5,8 @@ package rooms
 
 import (
 	"fmt"
-	"thesgo/matrix/mxevents"
 
 	"github.com/spf13/cobra"
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -21,31 +19,12 @@ var messageCmd = &cobra.Command{
 	Long: `Sends a message to the specified room, encrypted by default. 
 	To see every message sent by every user in a room, use command "history".`,
 	Run: func(cmd *cobra.Command, args []string) {
-		evt := prepareEvent()
-		Backend.Matrix().SendEvent(evt)
+		if _, err := API.SendMessage(id.RoomID(RoomName), message); err != nil {
+			fmt.Println("Could not send message: " + err.Error())
+		}
 	},
 }
 
-// Builds the event to send to the server for processing
-func prepareEvent() *mxevents.Event {
-	content := &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    message,
-	}
-
-	//Maybe use user credentials stored in config file, rather than dynamically getting them from the matrix container
-	evt := mxevents.Wrap(&event.Event{
-		ID:       id.EventID(Backend.Matrix().Client().TxnID()),
-		Sender:   Backend.Matrix().Client().UserID,
-		Type:     event.EventMessage,
-		RoomID:   id.RoomID(RoomName),
-		Content:  event.Content{Parsed: content},
-		Unsigned: event.Unsigned{TransactionID: Backend.Matrix().Client().TxnID()},
-	})
-
-	return evt
-}
-
 func init() {
 	RoomCmd.AddCommand(messageCmd)
 
@@ -20,17 +20,25 @@ var newRoomCmd = &cobra.Command{
 	Long: `Creates a new room with the user as its owner, using
 	the specified name and topic, and inviting every user specified in the invite list.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		account, err := API.Account()
+		if err != nil {
+			fmt.Println("Could not get the account info: " + err.Error())
+			return
+		}
 		var invited []id.UserID
 		for _, name := range inviteList {
-			user := id.NewUserID(name, "https://lpgains.duckdns.org")
+			user := id.UserID(name)
+			if _, _, err := user.Parse(); err != nil { //plain usernames belong to our own server
+				user = id.NewUserID(name, account.ServerName)
+			}
 			invited = append(invited, user)
 		}
 		fmt.Println(invited)
-		room, err := Backend.Matrix().NewRoom(RoomName, topic, invited)
+		roomID, err := API.NewRoom(RoomName, topic, invited)
 		if err != nil {
 			fmt.Println("Could not create new room")
 		} else {
-			fmt.Println("Room " + room.GetTitle() + " is now created and encrypted.")
+			fmt.Println("Room " + roomID.String() + " is now created and encrypted.")
 		}
 
 	},
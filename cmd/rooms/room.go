@@ -6,14 +6,15 @@ package rooms
 import (
 	"fmt"
 
+	"thesgo/control"
 	ifc "thesgo/interfaces"
 
 	"github.com/spf13/cobra"
 )
 
-var Backend ifc.Thesgo                             //variable to handle client operations
-var RoomName string                                //variable to hold roomID in all commands pertaining to rooms
-const Server string = "https:/lpgains.duckdns.org" //const to avoid hardcoding server name
+var Backend ifc.Thesgo //variable to handle client operations
+var API control.API    //runs the commands, either on the local client or on the daemon
+var RoomName string    //variable to hold roomID in all commands pertaining to rooms
 
 // roomCmd represents the room command
 var RoomCmd = &cobra.Command{
@@ -33,6 +34,11 @@ func SetLinkToBackend(thesgo ifc.Thesgo) {
 	Backend = thesgo
 }
 
+// Set the API that runs the room commands
+func SetLinkToAPI(api control.API) {
+	API = api
+}
+
 func init() {
 
 	// Here you will define your flags and configuration settings.
@@ -0,0 +1,79 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package rooms
+
+import (
+	"fmt"
+	"time"
+
+	"thesgo/matrix"
+
+	"github.com/spf13/cobra"
+	"maunium.net/go/mautrix/id"
+)
+
+const dateLayout = "2006-01-02"
+
+// every joined room is searched when this is given as the room name
+const allRooms = "*"
+
+var query, sender, since, until string
+var searchLimit int
+
+// searchCmd represents the search command
+var searchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Searches the messages stored locally in a room.",
+	Long: `Searches the local message history for the messages containing every word of the query, so it also
+	works offline. Use '*' as the room name to search every room. The matches can be filtered by sender and by date.`,
+	Example: "thesgo room -n '*' search --query 'words' [--sender '@user:server'] [--since 2023-01-02] [--until 2023-02-03]",
+	Run: func(cmd *cobra.Command, args []string) {
+		search := matrix.SearchQuery{Text: query, Sender: id.UserID(sender), Limit: searchLimit}
+		if RoomName != allRooms {
+			search.RoomID = id.RoomID(RoomName)
+		}
+		if len(since) > 0 {
+			date, err := time.ParseInLocation(dateLayout, since, time.Local)
+			if err != nil {
+				fmt.Println("Invalid date, use the format " + dateLayout)
+				return
+			}
+			search.Since = date
+		}
+		if len(until) > 0 {
+			date, err := time.ParseInLocation(dateLayout, until, time.Local)
+			if err != nil {
+				fmt.Println("Invalid date, use the format " + dateLayout)
+				return
+			}
+			search.Until = date.AddDate(0, 0, 1) //the whole day is included
+		}
+
+		results, err := API.Search(search)
+		if err != nil {
+			fmt.Println("Could not search the room history: " + err.Error())
+			return
+		} else if len(results) == 0 {
+			fmt.Println("No messages found")
+			return
+		}
+		for _, result := range results {
+			sent := time.UnixMilli(result.Timestamp).Format("2006-01-02 15:04")
+			fmt.Printf("[%s] %s %s (%s) -> %s\n", result.RoomID, sent, result.Sender, result.EventID, result.Body)
+		}
+	},
+}
+
+func init() {
+	RoomCmd.AddCommand(searchCmd)
+
+	searchCmd.Flags().StringVarP(&query, "query", "q", "", "Words the messages must contain")
+	searchCmd.Flags().StringVar(&sender, "sender", "", "Only show the messages of this user")
+	searchCmd.Flags().StringVar(&since, "since", "", "Only show the messages sent on or after this date ("+dateLayout+")")
+	searchCmd.Flags().StringVar(&until, "until", "", "Only show the messages sent on or before this date ("+dateLayout+")")
+	searchCmd.Flags().IntVar(&searchLimit, "limit", 50, "Maximum number of messages shown")
+	if err := searchCmd.MarkFlagRequired("query"); err != nil {
+		fmt.Println(err)
+	}
+}
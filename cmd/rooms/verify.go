@@ -4,10 +4,7 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package rooms
 
 import (
-	//"fmt"
-
 	"fmt"
-	"time"
 
 	"thesgo/matrix"
 
@@ -16,25 +13,47 @@ import (
 )
 
 var userToVerify string
+var acceptRequest, declineRequest bool
 
 // verifyCmd represents the verify command
 var verifyCmd = &cobra.Command{
 	Use:   "verify",
 	Short: "Verify the device of another user in the room.",
 	Long: `Performs in-room verification with another user in a room where both of them are present, through the 
-	SAS verification method.`,
+	SAS verification method. With --accept or --decline, answers the pending request sent by that user instead.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		mach := Backend.Matrix().Crypto()
-		device := &id.Device{UserID: id.UserID(userToVerify)}
-		vc := matrix.NewVerificationContainer(device, mach.DefaultSASTimeout)
-		_, err := mach.NewInRoomSASVerificationWith(id.RoomID(RoomName), id.UserID(userToVerify), vc, 120*time.Second)
+		if acceptRequest || declineRequest {
+			answerRequest(id.RoomID(RoomName), id.UserID(userToVerify), acceptRequest)
+			return
+		}
+
+		v, err := API.Verify(id.RoomID(RoomName), id.UserID(userToVerify))
 		if err != nil {
 			fmt.Printf("Failed to start in-room verification: %v", err)
 			return
 		}
+		fmt.Printf("Started verification %s with %s, see \"thesgo user verifications\" to follow it\n", v.ID, v.UserID)
 	},
 }
 
+// Accepts or declines the pending in-room verification request from the given user
+func answerRequest(roomID id.RoomID, user id.UserID, accept bool) {
+	list, err := API.Verifications()
+	if err != nil {
+		fmt.Println("Could not list verifications: " + err.Error())
+		return
+	}
+	for _, v := range list {
+		if v.Incoming && v.State == matrix.VerificationRequested && v.RoomID == roomID && v.UserID == user {
+			if err = API.ConfirmVerification(v.ID, accept); err != nil {
+				fmt.Println("Could not answer verification request: " + err.Error())
+			}
+			return
+		}
+	}
+	fmt.Println("No pending verification request from " + user.String() + " in this room")
+}
+
 func init() {
 	RoomCmd.AddCommand(verifyCmd)
 
@@ -51,4 +70,7 @@ func init() {
 	if err := verifyCmd.MarkPersistentFlagRequired("user"); err != nil {
 		fmt.Println(err)
 	}
+	verifyCmd.Flags().BoolVar(&acceptRequest, "accept", false, "Accept the verification request sent by the user")
+	verifyCmd.Flags().BoolVar(&declineRequest, "decline", false, "Decline the verification request sent by the user")
+	verifyCmd.MarkFlagsMutuallyExclusive("accept", "decline")
 }
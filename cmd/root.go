@@ -4,6 +4,7 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
 	"os"
 
 	//"strings"
@@ -12,6 +13,7 @@ import (
 
 	"thesgo/cmd/rooms"
 	"thesgo/cmd/user"
+	"thesgo/control"
 	ifc "thesgo/interfaces"
 
 	"github.com/spf13/cobra"
@@ -38,6 +40,9 @@ prompt := promptui.Prompt{
 	Validate:  validate,
 }*/
 
+var backend ifc.Thesgo //main client object, only started when no daemon is running
+var api control.API    //set once the first command runs, then reused by the interactive shell
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "thesgo",
@@ -45,6 +50,7 @@ var rootCmd = &cobra.Command{
 	Long: `A Matrix client with the minimum functionalities provided by the Matrix API, with the automatic inclusion of 
 	E2E encryption, and additional offline communication between clients for a future context of an IoT system
 	with multiple devices.`,
+	PersistentPreRunE: connectBackend,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	/*Run: func(cmd *cobra.Command, args []string) {
@@ -75,15 +81,41 @@ func Execute() {
 func addSubcommandGroups() {
 	rootCmd.AddCommand(user.UserCmd)            //adds the user commands as a whole subgroup
 	rootCmd.AddCommand(rooms.RoomCmd)           //adds the room commands as a subgroup
+	rootCmd.AddCommand(daemonCmd)               //keeps the client running in the background
 	rootCmd.AddCommand(shell.New(rootCmd, nil)) //adds an interactive shell
 }
 
 // Set a variable in each command package (subgroup) pointing to the main client object (ifc.Thesgo)
 func SetLinkToBackend(thesgo ifc.Thesgo) {
+	backend = thesgo
 	user.SetLinkToBackend(thesgo)
 	rooms.SetLinkToBackend(thesgo)
 }
 
+// Decides where the commands run: on the daemon if one is listening on the control socket,
+// otherwise on a client started in this process, as the daemon holds the databases open
+func connectBackend(cmd *cobra.Command, args []string) error {
+	if api != nil {
+		return nil
+	}
+
+	client, err := control.Dial(backend.Config().SocketPath)
+	if err == nil {
+		if cmd == daemonCmd {
+			_ = client.Close()
+			return fmt.Errorf("a daemon is already listening on %s", backend.Config().SocketPath)
+		}
+		api = client
+	} else {
+		backend.Start()
+		api = control.NewLocal(backend)
+	}
+
+	user.SetLinkToAPI(api)
+	rooms.SetLinkToAPI(api)
+	return nil
+}
+
 func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
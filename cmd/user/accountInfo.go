@@ -16,18 +16,24 @@ var accountInfoCmd = &cobra.Command{
 	Long: `Returns relevant information about the account that is currently logged
 	in, including username, homeserver, device ID, and joined rooms.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		userID := Backend.Config().GetUserID().Localpart()
-		deviceID := Backend.Config().DeviceID.String()
-		accToken := Backend.Config().AccessToken
-
-		fmt.Println("Account username: " + userID)
-		fmt.Println("Account server: " + Server)
-		fmt.Println("Device ID: " + deviceID)
-		fmt.Println("Access Token: " + accToken)
-		var rooms, _ = Backend.Matrix().RoomsJoined()
+		account, err := API.Account()
+		if err != nil {
+			fmt.Println("Could not get the account info: " + err.Error())
+			return
+		}
+
+		fmt.Println("Account username: " + account.UserID.Localpart())
+		fmt.Println("Account server: " + account.Homeserver)
+		fmt.Println("Device ID: " + account.DeviceID.String())
+		fmt.Println("Access Token: " + account.AccessToken)
+		var rooms, _ = API.JoinedRooms()
 		fmt.Print("User rooms: ")
 		for _, room := range rooms {
-			fmt.Println(room.GetTitle() + " : " + room.ID.String())
+			if room.Redecrypted {
+				fmt.Println(room.Title + " : " + room.ID.String() + " (new decrypted messages)")
+				continue
+			}
+			fmt.Println(room.Title + " : " + room.ID.String())
 		}
 	},
 }
@@ -0,0 +1,52 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package user
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var bootstrapPassword, recoveryKey string
+
+// crossSigningCmd represents the crossSigning command
+var crossSigningCmd = &cobra.Command{
+	Use:   "crossSigning",
+	Short: "Sets up the cross-signing keys of the account on this device.",
+	Long: `Bootstraps new master, self-signing and user-signing keys for the account, uploading them to the
+	homeserver, or restores the existing ones with the recovery key given when they were bootstrapped.
+	Once this device holds the keys, every device of the account verified through SAS is signed, and so is every
+	user verified, making all of their cross-signed devices trusted.`,
+	Example: "thesgo user crossSigning [--bootstrap 'password' | --restore 'recovery key']",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(bootstrapPassword) > 0 {
+			key, err := API.BootstrapCrossSigning(bootstrapPassword)
+			if len(key) > 0 {
+				fmt.Println("Recovery key, store it somewhere safe: " + key)
+			}
+			if err != nil {
+				fmt.Println("Could not bootstrap cross-signing: " + err.Error())
+				return
+			}
+			fmt.Println("Cross-signing keys were uploaded and this device was signed")
+		} else if len(recoveryKey) > 0 {
+			if err := API.RestoreCrossSigning(recoveryKey); err != nil {
+				fmt.Println("Could not restore cross-signing keys: " + err.Error())
+				return
+			}
+			fmt.Println("Cross-signing keys were restored and this device was signed")
+		} else {
+			cmd.Help()
+		}
+	},
+}
+
+func init() {
+	UserCmd.AddCommand(crossSigningCmd)
+
+	crossSigningCmd.Flags().StringVar(&bootstrapPassword, "bootstrap", "", "Account password, needed to upload new keys")
+	crossSigningCmd.Flags().StringVar(&recoveryKey, "restore", "", "Recovery key of the keys in secret storage")
+	crossSigningCmd.MarkFlagsMutuallyExclusive("bootstrap", "restore")
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package user
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var backupRecoveryKey string
+
+// keyBackupCmd represents the key-backup command
+var keyBackupCmd = &cobra.Command{
+	Use:   "key-backup",
+	Short: "Backs up the room keys of this device on the homeserver.",
+	Long: `Command group to create a server-side backup of the keys used to decrypt the messages of encrypted rooms,
+	and to restore them, e.g. on a new device or after losing the crypto database. The keys are encrypted with a
+	recovery key that never leaves the client.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// keyBackupCreateCmd represents the key-backup create command
+var keyBackupCreateCmd = &cobra.Command{
+	Use:     "create",
+	Short:   "Creates a new key backup and uploads every room key to it.",
+	Long:    `Creates a new key backup version and uploads every room key to it, along with the ones received afterwards.`,
+	Example: "thesgo user key-backup create",
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := API.CreateKeyBackup()
+		if err != nil {
+			fmt.Println("Could not create key backup: " + err.Error())
+			return
+		}
+		fmt.Println("Key backup created. Recovery key, store it somewhere safe: " + key)
+	},
+}
+
+// keyBackupRestoreCmd represents the key-backup restore command
+var keyBackupRestoreCmd = &cobra.Command{
+	Use:     "restore",
+	Short:   "Restores the room keys stored in the key backup.",
+	Long:    `Downloads the room keys of the current key backup, decrypting them with the recovery key given when it was created.`,
+	Example: "thesgo user key-backup restore --recovery-key 'EsTc ...'",
+	Run: func(cmd *cobra.Command, args []string) {
+		count, err := API.RestoreKeyBackup(backupRecoveryKey)
+		if err != nil {
+			fmt.Println("Could not restore key backup: " + err.Error())
+			return
+		}
+		fmt.Printf("Restored %d room keys\n", count)
+	},
+}
+
+func init() {
+	UserCmd.AddCommand(keyBackupCmd)
+	keyBackupCmd.AddCommand(keyBackupCreateCmd)
+	keyBackupCmd.AddCommand(keyBackupRestoreCmd)
+
+	keyBackupRestoreCmd.Flags().StringVar(&backupRecoveryKey, "recovery-key", "", "Recovery key of the backup")
+	if err := keyBackupRestoreCmd.MarkFlagRequired("recovery-key"); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package user
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var passphrase string
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Exports and imports the room keys of this device.",
+	Long: `Command group to move the keys used to decrypt the messages of encrypted rooms between devices, through a
+	passphrase protected file in the same format used by other Matrix clients.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// keysExportCmd represents the keys export command
+var keysExportCmd = &cobra.Command{
+	Use:     "export",
+	Short:   "Exports every room key to an encrypted file.",
+	Long:    `Exports every room key known by this device to the given file, encrypted with the given passphrase.`,
+	Example: "thesgo user keys export 'keys.txt' -p 'passphrase'",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := API.ExportKeys(passphrase)
+		if err != nil {
+			fmt.Println("Could not export room keys: " + err.Error())
+			return
+		}
+		if err = os.WriteFile(args[0], data, 0600); err != nil {
+			fmt.Println("Could not write room keys: " + err.Error())
+			return
+		}
+		fmt.Println("Exported room keys to " + args[0])
+	},
+}
+
+// keysImportCmd represents the keys import command
+var keysImportCmd = &cobra.Command{
+	Use:     "import",
+	Short:   "Imports the room keys of an encrypted file.",
+	Long:    `Imports the room keys exported to the given file by this or another Matrix client.`,
+	Example: "thesgo user keys import 'keys.txt' -p 'passphrase'",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Println("Could not read room keys: " + err.Error())
+			return
+		}
+		imported, total, err := API.ImportKeys(data, passphrase)
+		if err != nil {
+			fmt.Println("Could not import room keys: " + err.Error())
+			return
+		}
+		fmt.Printf("Imported %d of %d room keys\n", imported, total)
+	},
+}
+
+func init() {
+	UserCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysExportCmd)
+	keysCmd.AddCommand(keysImportCmd)
+
+	keysCmd.PersistentFlags().StringVarP(&passphrase, "passphrase", "p", "", "Passphrase protecting the file")
+	if err := keysCmd.MarkPersistentFlagRequired("passphrase"); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -9,16 +9,18 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var userID, password string //variables to hold flag values
+var userID, password, homeserver string //variables to hold flag values
 
 // loginCmd represents the login command
 var loginCmd = &cobra.Command{
 	Use:     "login",
 	Short:   "Logs a user into his Matrix account.",
 	Long:    `Logs a user into his Matrix account, persisting his account and session information to a given file.`,
-	Example: "thesgo user login -u 'id' -p 'password'",
+	Example: "thesgo user login -u '@user:example.org' -p 'password' [-s 'https://matrix.example.org']",
 	Run: func(comd *cobra.Command, args []string) {
-		Backend.Matrix().Login(userID, password)
+		if err := API.Login(userID, password, homeserver); err != nil {
+			fmt.Println("Could not login: " + err.Error())
+		}
 
 	},
 }
@@ -26,6 +28,7 @@ var loginCmd = &cobra.Command{
 func init() {
 	loginCmd.Flags().StringVarP(&userID, "username", "u", "", "Account username to login")
 	loginCmd.Flags().StringVarP(&password, "password", "p", "", "Account password to login")
+	loginCmd.Flags().StringVarP(&homeserver, "homeserver", "s", "", "Homeserver URL, discovered from the user ID if omitted")
 
 	if err := loginCmd.MarkFlagRequired("username"); err != nil {
 		fmt.Println(err)
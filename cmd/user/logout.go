@@ -4,6 +4,8 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package user
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
 )
 
@@ -13,7 +15,9 @@ var logoutCmd = &cobra.Command{
 	Short: "Logs the user account out of the client.",
 	Long:  `Logs the user account out of the client, deleting their session by revoking the access token.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		Backend.Matrix().Logout()
+		if err := API.Logout(); err != nil {
+			fmt.Println("Could not logout: " + err.Error())
+		}
 	},
 }
 
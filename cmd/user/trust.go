@@ -0,0 +1,35 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package user
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"maunium.net/go/mautrix/id"
+)
+
+// trustCmd represents the trust command
+var trustCmd = &cobra.Command{
+	Use:   "trust",
+	Short: "Shows how much each device of a user is trusted.",
+	Long: `Lists the devices of a user with the trust resolved for each one. A device is trusted if it was
+	verified directly, or if it is cross-signed by a user that was verified.`,
+	Example: "thesgo user trust '@user:example.org'",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		devices, err := API.DeviceTrust(id.UserID(args[0]))
+		if err != nil {
+			fmt.Println("Could not resolve trust: " + err.Error())
+			return
+		}
+		for _, device := range devices {
+			fmt.Printf("%s (%s) %s - %s\n", device.DeviceID, device.Name, device.SigningKey, device.Trust)
+		}
+	},
+}
+
+func init() {
+	UserCmd.AddCommand(trustCmd)
+}
@@ -6,16 +6,16 @@ package user
 import (
 	"fmt"
 	"os"
+	"thesgo/control"
 	ifc "thesgo/interfaces"
 
 	"github.com/spf13/cobra"
 )
 
 var Backend ifc.Thesgo //variable to handle client operations
+var API control.API    //runs the commands, either on the local client or on the daemon
 var cleancache, cleandata bool
 
-const Server string = "https:/lpgains.duckdns.org"
-
 // userCmd represents the user command
 var UserCmd = &cobra.Command{
 	Use:   "user",
@@ -23,6 +23,10 @@ var UserCmd = &cobra.Command{
 	Long:  `Command group for user-related commands, such as login, logout or account-info`,
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
+		if (cleancache || cleandata) && isDaemon() {
+			fmt.Println("A daemon is using the client data, stop it before clearing the cache or data")
+			return
+		}
 		if cleancache {
 			Backend.Config().Clear()
 			fmt.Printf("Cleared cache at %s\n", Backend.Config().CacheDir)
@@ -37,11 +41,22 @@ var UserCmd = &cobra.Command{
 	},
 }
 
+// Tells if the commands run on a daemon, which keeps the databases and the control socket open
+func isDaemon() bool {
+	_, remote := API.(*control.Client)
+	return remote
+}
+
 // Set a variable pointing to the main client object (ifc.Thesgo)
 func SetLinkToBackend(thesgo ifc.Thesgo) {
 	Backend = thesgo
 }
 
+// Set the API that runs the user commands
+func SetLinkToAPI(api control.API) {
+	API = api
+}
+
 func init() {
 
 	// Here you will define your flags and configuration settings.
@@ -0,0 +1,84 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package user
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"thesgo/matrix"
+
+	"github.com/spf13/cobra"
+	"maunium.net/go/mautrix/event"
+)
+
+var confirmID, rejectID string
+
+// verificationsCmd represents the verifications command
+var verificationsCmd = &cobra.Command{
+	Use:   "verifications",
+	Short: "Lists the SAS verifications of this client, and confirms or rejects them.",
+	Long: `Lists every SAS verification since the client started, including the requests sent by other devices,
+	with the emojis or numbers that must match the ones shown on the other device. An incoming request is accepted
+	or declined by its ID, and so is a verification awaiting confirmation of its SAS, which allows verifying
+	devices without a terminal attached to the client.`,
+	Example: "thesgo user verifications [--confirm 'id' | --reject 'id']",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(confirmID) > 0 || len(rejectID) > 0 {
+			verificationID, accept := confirmID, true
+			if len(rejectID) > 0 {
+				verificationID, accept = rejectID, false
+			}
+			if err := API.ConfirmVerification(verificationID, accept); err != nil {
+				fmt.Println("Could not resolve verification: " + err.Error())
+			}
+			return
+		}
+
+		list, err := API.Verifications()
+		if err != nil {
+			fmt.Println("Could not list verifications: " + err.Error())
+			return
+		}
+		for _, v := range list {
+			printVerification(v)
+		}
+	},
+}
+
+func printVerification(v matrix.Verification) {
+	direction := "outgoing"
+	if v.Incoming {
+		direction = "incoming"
+	}
+	fmt.Printf("[%s] %s %s (%s) - %s", v.ID, direction, v.UserID, v.DeviceID, v.State)
+	if len(v.Reason) > 0 {
+		fmt.Print(": " + v.Reason)
+	}
+	fmt.Println()
+
+	switch v.SASType {
+	case event.SASEmoji:
+		emojis := make([]string, len(v.Emojis))
+		for i, emoji := range v.Emojis {
+			emojis[i] = emoji.Emoji + " " + emoji.Description
+		}
+		fmt.Println("\t" + strings.Join(emojis, ", "))
+	case event.SASDecimal:
+		numbers := make([]string, len(v.Decimals))
+		for i, number := range v.Decimals {
+			numbers[i] = strconv.FormatUint(uint64(number), 10)
+		}
+		fmt.Println("\t" + strings.Join(numbers, " "))
+	}
+}
+
+func init() {
+	UserCmd.AddCommand(verificationsCmd)
+
+	verificationsCmd.Flags().StringVar(&confirmID, "confirm", "", "ID of a verification whose SAS match")
+	verificationsCmd.Flags().StringVar(&rejectID, "reject", "", "ID of a verification whose SAS do not match")
+	verificationsCmd.MarkFlagsMutuallyExclusive("confirm", "reject")
+}
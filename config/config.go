@@ -65,10 +65,11 @@ func (up *UserPreferences) EnableInlineURLs() bool {
 
 // Config contains the main config of the client => the syncstore for the matrix client
 type Config struct {
-	UserID      id.UserID   `yaml:"mxid"`
-	DeviceID    id.DeviceID `yaml:"device_id"`
-	AccessToken string      `yaml:"access_token"`
-	Homeserver  string      `yaml:"homeserver"`
+	UserID         id.UserID   `yaml:"mxid"`
+	DeviceID       id.DeviceID `yaml:"device_id"`
+	AccessToken    string      `yaml:"access_token"`
+	Homeserver     string      `yaml:"homeserver"`
+	HomeserverName string      `yaml:"homeserver_name"` //server name the homeserver URL is used for, see resolveHomeserver
 
 	RoomCacheSize int   `yaml:"room_cache_size"`
 	RoomCacheAge  int64 `yaml:"room_cache_age"`
@@ -76,6 +77,8 @@ type Config struct {
 	NotifySound        bool `yaml:"notify_sound"`
 	SendToVerifiedOnly bool `yaml:"send_to_verified_only"`
 
+	AutoVerifyUsers []id.UserID `yaml:"auto_verify_users"` //SAS verifications with these users are accepted without asking
+
 	Backspace1RemovesWord bool `yaml:"backspace1_removes_word"`
 	Backspace2RemovesWord bool `yaml:"backspace2_removes_word"`
 
@@ -85,9 +88,15 @@ type Config struct {
 	DataDir      string `yaml:"data_dir"`
 	CacheDir     string `yaml:"cache_dir"`
 	HistoryPath  string `yaml:"history_path"`
+	DataPath     string `yaml:"data_path"` //peer bindings and unsent messages, kept when the cache is cleared
 	RoomListPath string `yaml:"room_list_path"`
 	MediaDir     string `yaml:"media_dir"` //will not be necessary
 	StateDir     string `yaml:"state_dir"`
+	PeerKeyPath  string `yaml:"peer_key_path"` //libp2p private key used for offline comms
+	SocketPath   string `yaml:"socket_path"`   //unix socket the daemon listens on for CLI commands
+
+	Offline   OfflineConfig   `yaml:"offline"`
+	Retention RetentionConfig `yaml:"retention"`
 
 	Preferences UserPreferences        `yaml:"-"`
 	AuthCache   AuthCache              `yaml:"-"`
@@ -108,6 +117,9 @@ func NewConfig(configDir, dataDir, cacheDir string) *Config {
 		RoomListPath: filepath.Join(cacheDir, "rooms.gob.gz"),
 		StateDir:     filepath.Join(cacheDir, "state"),
 		MediaDir:     filepath.Join(cacheDir, "media"),
+		DataPath:     filepath.Join(dataDir, "data.db"),
+		PeerKeyPath:  filepath.Join(dataDir, "peer.key"),
+		SocketPath:   filepath.Join(dataDir, "thesgo.sock"),
 
 		RoomCacheSize: 32,
 		RoomCacheAge:  1 * 60,
@@ -116,6 +128,9 @@ func NewConfig(configDir, dataDir, cacheDir string) *Config {
 		SendToVerifiedOnly:    false,
 		Backspace1RemovesWord: true,
 		AlwaysClearScreen:     true,
+
+		Offline:   defaultOfflineConfig(),
+		Retention: defaultRetentionConfig(),
 	}
 }
 
@@ -174,6 +189,8 @@ func (config *Config) Load() {
 	if err != nil {
 		panic(fmt.Errorf("failed to load config.yaml: %w", err))
 	}
+	config.Offline.validate()
+	config.Retention.validate()
 	config.CreateCacheDirs()
 }
 
@@ -290,6 +307,11 @@ func (config *Config) GetUserID() id.UserID {
 	return config.UserID
 }
 
+// ServerName returns the name of the server the logged in user belongs to
+func (config *Config) ServerName() string {
+	return config.UserID.Homeserver()
+}
+
 const FilterVersion = 1
 
 func (config *Config) SaveFilterID(_ id.UserID, filterID string) {
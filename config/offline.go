@@ -0,0 +1,92 @@
+package config
+
+import (
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+// Transports that can be enabled for offline comms
+const (
+	TransportTCP       = "tcp"
+	TransportQUIC      = "quic"
+	TransportWebSocket = "websocket"
+)
+
+// OfflineConfig holds the settings of the peer-to-peer subsystem used while the homeserver is unreachable
+type OfflineConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	ListenAddrs []string `yaml:"listen_addrs"` //multiaddrs the libp2p host listens on
+	Transports  []string `yaml:"transports"`   //any of tcp, quic and websocket
+	Rendezvous  string   `yaml:"rendezvous"`   //mDNS service name shared by every client
+
+	LowWater    int           `yaml:"low_water"` //connection manager limits, small groups are expected
+	HighWater   int           `yaml:"high_water"`
+	GracePeriod time.Duration `yaml:"grace_period"`
+
+	RetryInterval time.Duration `yaml:"retry_interval"` //how often the delivery queue is checked
+	RetryBase     time.Duration `yaml:"retry_base"`     //backoff between attempts of the same event
+	RetryMax      time.Duration `yaml:"retry_max"`
+
+	KeyRefresh time.Duration `yaml:"key_refresh"` //how often the keys of peer devices are fetched and claimed while online
+
+	RelayTTL  time.Duration `yaml:"relay_ttl"`  //how long other peers carry our events for the users who missed them
+	RelayHops int           `yaml:"relay_hops"` //how many relays an event may go through before reaching its target
+}
+
+func defaultOfflineConfig() OfflineConfig {
+	return OfflineConfig{
+		Enabled:     true,
+		ListenAddrs: []string{"/ip4/0.0.0.0/tcp/8080", "/ip4/0.0.0.0/udp/8080/quic-v1", "/ip4/0.0.0.0/tcp/8081/ws"},
+		Transports:  []string{TransportTCP, TransportQUIC, TransportWebSocket},
+		Rendezvous:  "matrix-offline",
+
+		LowWater:    10,
+		HighWater:   20,
+		GracePeriod: time.Minute,
+
+		RetryInterval: 30 * time.Second,
+		RetryBase:     30 * time.Second,
+		RetryMax:      30 * time.Minute,
+
+		KeyRefresh: time.Hour,
+
+		RelayTTL:  24 * time.Hour,
+		RelayHops: 3,
+	}
+}
+
+// Falls back to the default of every setting the offline routines cannot run with, like intervals that are not
+// positive, a negative relay hop limit or connection manager limits where the low water is above the high water
+func (oc *OfflineConfig) validate() {
+	defaults := defaultOfflineConfig()
+	intervals := []struct {
+		name     string
+		value    *time.Duration
+		fallback time.Duration
+	}{
+		{"grace_period", &oc.GracePeriod, defaults.GracePeriod},
+		{"retry_interval", &oc.RetryInterval, defaults.RetryInterval},
+		{"retry_base", &oc.RetryBase, defaults.RetryBase},
+		{"retry_max", &oc.RetryMax, defaults.RetryMax},
+		{"key_refresh", &oc.KeyRefresh, defaults.KeyRefresh},
+		{"relay_ttl", &oc.RelayTTL, defaults.RelayTTL},
+	}
+	for _, interval := range intervals {
+		if *interval.value <= 0 {
+			debug.Printf("Offline %s must be positive, using %s instead of %s", interval.name, interval.fallback, *interval.value)
+			*interval.value = interval.fallback
+		}
+	}
+
+	if oc.LowWater < 0 || oc.HighWater <= 0 || oc.LowWater > oc.HighWater {
+		debug.Printf("Offline low_water (%d) must not be above high_water (%d), using %d and %d instead",
+			oc.LowWater, oc.HighWater, defaults.LowWater, defaults.HighWater)
+		oc.LowWater, oc.HighWater = defaults.LowWater, defaults.HighWater
+	}
+	if oc.RelayHops < 0 { //zero is allowed, it only disables relaying
+		debug.Printf("Offline relay_hops must not be negative, using %d instead of %d", defaults.RelayHops, oc.RelayHops)
+		oc.RelayHops = defaults.RelayHops
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/id"
+)
+
+// RetentionPolicy limits how much of the history of a room is kept locally. Zero values keep everything.
+type RetentionPolicy struct {
+	MaxAge    time.Duration `yaml:"max_age"`    //events older than this are removed
+	MaxEvents int           `yaml:"max_events"` //only this many of the most recent events are kept
+}
+
+// RetentionConfig holds the settings of the history pruner
+type RetentionConfig struct {
+	RetentionPolicy `yaml:",inline"` //applies to every room without a policy of its own
+
+	Rooms        map[id.RoomID]RetentionPolicy `yaml:"rooms"`         //policies of single rooms, replacing the global one
+	HonourServer bool                          `yaml:"honour_server"` //also remove events after the max_lifetime of m.room.retention
+
+	PruneInterval time.Duration `yaml:"prune_interval"` //how often the history is pruned
+}
+
+// Policy returns the retention policy configured for a room
+func (rc *RetentionConfig) Policy(roomID id.RoomID) RetentionPolicy {
+	if policy, ok := rc.Rooms[roomID]; ok {
+		return policy
+	}
+	return rc.RetentionPolicy
+}
+
+func defaultRetentionConfig() RetentionConfig {
+	return RetentionConfig{
+		HonourServer:  true,
+		PruneInterval: time.Hour,
+	}
+}
+
+// Falls back to the default prune interval if it is not positive, as the pruner ticks on it
+func (rc *RetentionConfig) validate() {
+	if rc.PruneInterval <= 0 {
+		fallback := defaultRetentionConfig().PruneInterval
+		debug.Printf("Retention prune_interval must be positive, using %s instead of %s", fallback, rc.PruneInterval)
+		rc.PruneInterval = fallback
+	}
+}
@@ -0,0 +1,256 @@
+package control
+
+import (
+	"fmt"
+
+	ifc "thesgo/interfaces"
+	"thesgo/matrix"
+	"thesgo/matrix/mxevents"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// API is the set of operations exposed to the CLI, run either directly on the local client or on a daemon
+type API interface {
+	Login(user, password, homeserver string) error
+	Logout() error
+	Account() (AccountInfo, error)
+	JoinedRooms() ([]RoomInfo, error)
+
+	SendMessage(roomID id.RoomID, body string) (id.EventID, error)
+	History(roomID id.RoomID, limit int, before, after id.EventID) ([]Message, error)
+	Search(query matrix.SearchQuery) ([]matrix.SearchResult, error)
+	Members(roomID id.RoomID) ([]id.UserID, error)
+
+	NewRoom(name, topic string, invite []id.UserID) (id.RoomID, error)
+	JoinRoom(roomID id.RoomID, server string) error
+	ExitRoom(roomID id.RoomID, reason string) error
+	ForgetRoom(roomID id.RoomID) error
+	InviteUser(roomID id.RoomID, reason, user string) error
+	ActivateEncryption(roomID id.RoomID, rotationPeriod int64, rotationMessages int) error
+
+	Verify(roomID id.RoomID, user id.UserID) (matrix.Verification, error)
+	Verifications() ([]matrix.Verification, error)
+	ConfirmVerification(verificationID string, accept bool) error
+
+	BootstrapCrossSigning(password string) (string, error)
+	RestoreCrossSigning(recoveryKey string) error
+	DeviceTrust(user id.UserID) ([]matrix.DeviceTrust, error)
+
+	CreateKeyBackup() (string, error)
+	RestoreKeyBackup(recoveryKey string) (int, error)
+	ExportKeys(passphrase string) ([]byte, error)
+	ImportKeys(data []byte, passphrase string) (int, int, error)
+}
+
+// AccountInfo describes the account the client is logged in with
+type AccountInfo struct {
+	UserID      id.UserID   `json:"user_id"`
+	DeviceID    id.DeviceID `json:"device_id"`
+	Homeserver  string      `json:"homeserver"`
+	ServerName  string      `json:"server_name"`
+	AccessToken string      `json:"access_token"`
+}
+
+// RoomInfo is a short description of a joined room
+type RoomInfo struct {
+	ID    id.RoomID `json:"id"`
+	Title string    `json:"title"`
+	// Redecrypted tells that messages which could not be decrypted were decrypted since the history was read
+	Redecrypted bool `json:"redecrypted"`
+}
+
+// Message is a text message from the history of a room
+type Message struct {
+	ID        id.EventID `json:"id"`
+	Sender    id.UserID  `json:"sender"`
+	Body      string     `json:"body"`
+	Timestamp int64      `json:"timestamp"`
+}
+
+// Local runs the API operations on the client of this same process
+type Local struct {
+	Backend ifc.Thesgo
+}
+
+func NewLocal(backend ifc.Thesgo) *Local {
+	return &Local{Backend: backend}
+}
+
+func (l *Local) Login(user, password, homeserver string) error {
+	return l.Backend.Matrix().Login(user, password, homeserver)
+}
+
+func (l *Local) Logout() error {
+	l.Backend.Matrix().Logout()
+	return nil
+}
+
+func (l *Local) Account() (AccountInfo, error) {
+	cfg := l.Backend.Config()
+	return AccountInfo{
+		UserID:      cfg.GetUserID(),
+		DeviceID:    cfg.DeviceID,
+		Homeserver:  cfg.Homeserver,
+		ServerName:  cfg.ServerName(),
+		AccessToken: cfg.AccessToken,
+	}, nil
+}
+
+func (l *Local) JoinedRooms() ([]RoomInfo, error) {
+	joined, err := l.Backend.Matrix().RoomsJoined()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]RoomInfo, len(joined))
+	for i, room := range joined {
+		infos[i] = RoomInfo{ID: room.ID, Title: room.GetTitle(), Redecrypted: room.IsRedecrypted()}
+	}
+	return infos, nil
+}
+
+func (l *Local) SendMessage(roomID id.RoomID, body string) (id.EventID, error) {
+	client := l.Backend.Matrix().Client()
+	txnID := client.TxnID() //the same transaction ID is used if the message has to be uploaded later
+	evt := mxevents.Wrap(&event.Event{
+		ID:       id.EventID(txnID),
+		Sender:   client.UserID,
+		Type:     event.EventMessage,
+		RoomID:   roomID,
+		Content:  event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+		Unsigned: event.Unsigned{TransactionID: txnID},
+	})
+	return l.Backend.Matrix().SendEvent(evt)
+}
+
+// History returns the most recent messages of a room, or the ones before or after the given event
+func (l *Local) History(roomID id.RoomID, limit int, before, after id.EventID) ([]Message, error) {
+	room := l.Backend.Matrix().GetRoom(roomID)
+	if room == nil {
+		return nil, fmt.Errorf("unknown room %s", roomID)
+	}
+	var hist []*mxevents.Event
+	var err error
+	if len(before) > 0 {
+		hist, err = l.Backend.Matrix().HistoryFrom(room, before, limit, false)
+	} else if len(after) > 0 {
+		hist, err = l.Backend.Matrix().HistoryFrom(room, after, limit, true)
+	} else {
+		hist, _, err = l.Backend.Matrix().GetHistory(room, limit, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = room.SetRedecrypted(false); err != nil { //the decrypted messages are shown now
+		return nil, err
+	}
+	var msgs []Message
+	for _, evt := range hist {
+		if evt.Type != event.EventMessage { //only return the user messages, not the internal matrix messages
+			continue
+		}
+		msgs = append(msgs, Message{
+			ID:        evt.ID,
+			Sender:    evt.Sender,
+			Body:      evt.Content.AsMessage().Body,
+			Timestamp: evt.Timestamp,
+		})
+	}
+	return msgs, nil
+}
+
+func (l *Local) Search(query matrix.SearchQuery) ([]matrix.SearchResult, error) {
+	return l.Backend.Matrix().SearchHistory(query)
+}
+
+func (l *Local) Members(roomID id.RoomID) ([]id.UserID, error) {
+	return l.Backend.Matrix().JoinedMembers(roomID)
+}
+
+func (l *Local) NewRoom(name, topic string, invite []id.UserID) (id.RoomID, error) {
+	room, err := l.Backend.Matrix().NewRoom(name, topic, invite)
+	if err != nil {
+		return "", err
+	}
+	return room.ID, nil
+}
+
+func (l *Local) JoinRoom(roomID id.RoomID, server string) error {
+	_, err := l.Backend.Matrix().JoinRoom(roomID, server)
+	return err
+}
+
+func (l *Local) ExitRoom(roomID id.RoomID, reason string) error {
+	return l.Backend.Matrix().ExitRoom(roomID, reason)
+}
+
+func (l *Local) ForgetRoom(roomID id.RoomID) error {
+	return l.Backend.Matrix().ForgetRoom(roomID)
+}
+
+func (l *Local) InviteUser(roomID id.RoomID, reason, user string) error {
+	return l.Backend.Matrix().InviteUser(roomID, reason, user)
+}
+
+func (l *Local) ActivateEncryption(roomID id.RoomID, rotationPeriod int64, rotationMessages int) error {
+	stateKey := ""
+	evt := &mxevents.Event{
+		Event: &event.Event{
+			Type:     event.StateEncryption,
+			RoomID:   roomID,
+			StateKey: &stateKey,
+			Content: event.Content{Parsed: &event.EncryptionEventContent{
+				Algorithm:              id.AlgorithmMegolmV1,
+				RotationPeriodMillis:   rotationPeriod,
+				RotationPeriodMessages: rotationMessages,
+			}},
+		},
+	}
+	_, err := l.Backend.Matrix().SendStateEvent(evt)
+	return err
+}
+
+func (l *Local) Verify(roomID id.RoomID, user id.UserID) (matrix.Verification, error) {
+	v, err := l.Backend.Matrix().StartVerification(roomID, user)
+	if err != nil {
+		return matrix.Verification{}, err
+	}
+	return *v, nil
+}
+
+func (l *Local) Verifications() ([]matrix.Verification, error) {
+	return l.Backend.Matrix().Verifications().List(), nil
+}
+
+func (l *Local) ConfirmVerification(verificationID string, accept bool) error {
+	return l.Backend.Matrix().ConfirmVerification(verificationID, accept)
+}
+
+func (l *Local) BootstrapCrossSigning(password string) (string, error) {
+	return l.Backend.Matrix().BootstrapCrossSigning(password)
+}
+
+func (l *Local) RestoreCrossSigning(recoveryKey string) error {
+	return l.Backend.Matrix().RestoreCrossSigning(recoveryKey)
+}
+
+func (l *Local) DeviceTrust(user id.UserID) ([]matrix.DeviceTrust, error) {
+	return l.Backend.Matrix().DeviceTrust(user)
+}
+
+func (l *Local) CreateKeyBackup() (string, error) {
+	return l.Backend.Matrix().CreateKeyBackup()
+}
+
+func (l *Local) RestoreKeyBackup(recoveryKey string) (int, error) {
+	return l.Backend.Matrix().RestoreKeyBackup(recoveryKey)
+}
+
+func (l *Local) ExportKeys(passphrase string) ([]byte, error) {
+	return l.Backend.Matrix().ExportKeys(passphrase)
+}
+
+func (l *Local) ImportKeys(data []byte, passphrase string) (int, int, error) {
+	return l.Backend.Matrix().ImportKeys(data, passphrase)
+}
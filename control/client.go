@@ -0,0 +1,149 @@
+package control
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+
+	"thesgo/matrix"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// how long to wait for a daemon to answer on the socket
+const dialTimeout = time.Second
+
+// Client runs the API operations on a daemon through its control socket
+type Client struct {
+	rpc *rpc.Client
+}
+
+// Dial connects to the daemon listening on the socket at the given path
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rpc: jsonrpc.NewClient(conn)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+func (c *Client) call(method string, args, reply interface{}) error {
+	return c.rpc.Call(serviceName+"."+method, args, reply)
+}
+
+func (c *Client) Login(user, password, homeserver string) error {
+	return c.call("Login", &LoginArgs{User: user, Password: password, Homeserver: homeserver}, &Empty{})
+}
+
+func (c *Client) Logout() error {
+	return c.call("Logout", &Empty{}, &Empty{})
+}
+
+func (c *Client) Account() (info AccountInfo, err error) {
+	err = c.call("Account", &Empty{}, &info)
+	return
+}
+
+func (c *Client) JoinedRooms() (rooms []RoomInfo, err error) {
+	err = c.call("JoinedRooms", &Empty{}, &rooms)
+	return
+}
+
+func (c *Client) SendMessage(roomID id.RoomID, body string) (eventID id.EventID, err error) {
+	err = c.call("SendMessage", &MessageArgs{RoomID: roomID, Body: body}, &eventID)
+	return
+}
+
+func (c *Client) History(roomID id.RoomID, limit int, before, after id.EventID) (msgs []Message, err error) {
+	err = c.call("History", &HistoryArgs{RoomID: roomID, Limit: limit, Before: before, After: after}, &msgs)
+	return
+}
+
+func (c *Client) Search(query matrix.SearchQuery) (results []matrix.SearchResult, err error) {
+	err = c.call("Search", &query, &results)
+	return
+}
+
+func (c *Client) Members(roomID id.RoomID) (members []id.UserID, err error) {
+	err = c.call("Members", &RoomArgs{RoomID: roomID}, &members)
+	return
+}
+
+func (c *Client) NewRoom(name, topic string, invite []id.UserID) (roomID id.RoomID, err error) {
+	err = c.call("NewRoom", &NewRoomArgs{Name: name, Topic: topic, Invite: invite}, &roomID)
+	return
+}
+
+func (c *Client) JoinRoom(roomID id.RoomID, server string) error {
+	return c.call("JoinRoom", &JoinArgs{RoomID: roomID, Server: server}, &Empty{})
+}
+
+func (c *Client) ExitRoom(roomID id.RoomID, reason string) error {
+	return c.call("ExitRoom", &ReasonArgs{RoomID: roomID, Reason: reason}, &Empty{})
+}
+
+func (c *Client) ForgetRoom(roomID id.RoomID) error {
+	return c.call("ForgetRoom", &RoomArgs{RoomID: roomID}, &Empty{})
+}
+
+func (c *Client) InviteUser(roomID id.RoomID, reason, user string) error {
+	return c.call("InviteUser", &InviteArgs{RoomID: roomID, Reason: reason, User: user}, &Empty{})
+}
+
+func (c *Client) ActivateEncryption(roomID id.RoomID, rotationPeriod int64, rotationMessages int) error {
+	return c.call("ActivateEncryption", &EncryptionArgs{RoomID: roomID, RotationPeriod: rotationPeriod, RotationMessages: rotationMessages}, &Empty{})
+}
+
+func (c *Client) Verify(roomID id.RoomID, user id.UserID) (v matrix.Verification, err error) {
+	err = c.call("Verify", &VerifyArgs{RoomID: roomID, User: user}, &v)
+	return
+}
+
+func (c *Client) Verifications() (list []matrix.Verification, err error) {
+	err = c.call("Verifications", &Empty{}, &list)
+	return
+}
+
+func (c *Client) ConfirmVerification(verificationID string, accept bool) error {
+	return c.call("ConfirmVerification", &ConfirmArgs{VerificationID: verificationID, Accept: accept}, &Empty{})
+}
+
+func (c *Client) BootstrapCrossSigning(password string) (recoveryKey string, err error) {
+	err = c.call("BootstrapCrossSigning", &SecretArgs{Secret: password}, &recoveryKey)
+	return
+}
+
+func (c *Client) RestoreCrossSigning(recoveryKey string) error {
+	return c.call("RestoreCrossSigning", &SecretArgs{Secret: recoveryKey}, &Empty{})
+}
+
+func (c *Client) DeviceTrust(user id.UserID) (list []matrix.DeviceTrust, err error) {
+	err = c.call("DeviceTrust", &UserArgs{User: user}, &list)
+	return
+}
+
+func (c *Client) CreateKeyBackup() (recoveryKey string, err error) {
+	err = c.call("CreateKeyBackup", &Empty{}, &recoveryKey)
+	return
+}
+
+func (c *Client) RestoreKeyBackup(recoveryKey string) (count int, err error) {
+	err = c.call("RestoreKeyBackup", &SecretArgs{Secret: recoveryKey}, &count)
+	return
+}
+
+func (c *Client) ExportKeys(passphrase string) (data []byte, err error) {
+	err = c.call("ExportKeys", &SecretArgs{Secret: passphrase}, &data)
+	return
+}
+
+func (c *Client) ImportKeys(data []byte, passphrase string) (int, int, error) {
+	var reply ImportReply
+	err := c.call("ImportKeys", &ImportArgs{Data: data, Passphrase: passphrase}, &reply)
+	return reply.Imported, reply.Total, err
+}
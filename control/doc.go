@@ -0,0 +1,2 @@
+// Package with the API used by the CLI to control a running thesgo daemon over a local socket
+package control
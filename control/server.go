@@ -0,0 +1,283 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	dbg "runtime/debug"
+	"syscall"
+
+	"thesgo/matrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/id"
+)
+
+// name under which the service is registered, methods are called as "Thesgo.<Method>"
+const serviceName = "Thesgo"
+
+type Empty struct{}
+
+type LoginArgs struct {
+	User, Password, Homeserver string
+}
+
+type RoomArgs struct {
+	RoomID id.RoomID
+}
+
+type MessageArgs struct {
+	RoomID id.RoomID
+	Body   string
+}
+
+type HistoryArgs struct {
+	RoomID        id.RoomID
+	Limit         int
+	Before, After id.EventID
+}
+
+type NewRoomArgs struct {
+	Name, Topic string
+	Invite      []id.UserID
+}
+
+type JoinArgs struct {
+	RoomID id.RoomID
+	Server string
+}
+
+type ReasonArgs struct {
+	RoomID id.RoomID
+	Reason string
+}
+
+type InviteArgs struct {
+	RoomID id.RoomID
+	Reason string
+	User   string
+}
+
+type EncryptionArgs struct {
+	RoomID           id.RoomID
+	RotationPeriod   int64
+	RotationMessages int
+}
+
+type VerifyArgs struct {
+	RoomID id.RoomID
+	User   id.UserID
+}
+
+type ConfirmArgs struct {
+	VerificationID string
+	Accept         bool
+}
+
+type SecretArgs struct {
+	Secret string
+}
+
+type UserArgs struct {
+	User id.UserID
+}
+
+type ImportArgs struct {
+	Data       []byte
+	Passphrase string
+}
+
+type ImportReply struct {
+	Imported, Total int
+}
+
+// Service exposes an API through net/rpc
+type Service struct {
+	api API
+}
+
+// Turns a panic while answering a request into the error of that request, as net/rpc does not recover them
+// and a single bad request would otherwise bring the whole daemon down
+func recoverCall(err *error) {
+	if p := recover(); p != nil {
+		debug.Printf("Recovered from panic in control request: %v\n%s", p, dbg.Stack())
+		*err = fmt.Errorf("internal error: %v", p)
+	}
+}
+
+func (s *Service) Login(args *LoginArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.Login(args.User, args.Password, args.Homeserver)
+}
+
+func (s *Service) Logout(_ *Empty, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.Logout()
+}
+
+func (s *Service) Account(_ *Empty, reply *AccountInfo) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.Account()
+	return
+}
+
+func (s *Service) JoinedRooms(_ *Empty, reply *[]RoomInfo) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.JoinedRooms()
+	return
+}
+
+func (s *Service) SendMessage(args *MessageArgs, reply *id.EventID) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.SendMessage(args.RoomID, args.Body)
+	return
+}
+
+func (s *Service) History(args *HistoryArgs, reply *[]Message) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.History(args.RoomID, args.Limit, args.Before, args.After)
+	return
+}
+
+func (s *Service) Search(args *matrix.SearchQuery, reply *[]matrix.SearchResult) (err error) {
+	*reply, err = s.api.Search(*args)
+	return
+}
+
+func (s *Service) Members(args *RoomArgs, reply *[]id.UserID) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.Members(args.RoomID)
+	return
+}
+
+func (s *Service) NewRoom(args *NewRoomArgs, reply *id.RoomID) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.NewRoom(args.Name, args.Topic, args.Invite)
+	return
+}
+
+func (s *Service) JoinRoom(args *JoinArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.JoinRoom(args.RoomID, args.Server)
+}
+
+func (s *Service) ExitRoom(args *ReasonArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.ExitRoom(args.RoomID, args.Reason)
+}
+
+func (s *Service) ForgetRoom(args *RoomArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.ForgetRoom(args.RoomID)
+}
+
+func (s *Service) InviteUser(args *InviteArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.InviteUser(args.RoomID, args.Reason, args.User)
+}
+
+func (s *Service) ActivateEncryption(args *EncryptionArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.ActivateEncryption(args.RoomID, args.RotationPeriod, args.RotationMessages)
+}
+
+func (s *Service) Verify(args *VerifyArgs, reply *matrix.Verification) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.Verify(args.RoomID, args.User)
+	return
+}
+
+func (s *Service) Verifications(_ *Empty, reply *[]matrix.Verification) (err error) {
+	defer recoverCall(&err)
+	*reply, err = s.api.Verifications()
+	return
+}
+
+func (s *Service) ConfirmVerification(args *ConfirmArgs, _ *Empty) (err error) {
+	defer recoverCall(&err)
+	return s.api.ConfirmVerification(args.VerificationID, args.Accept)
+}
+
+func (s *Service) BootstrapCrossSigning(args *SecretArgs, reply *string) (err error) {
+	*reply, err = s.api.BootstrapCrossSigning(args.Secret)
+	return
+}
+
+func (s *Service) RestoreCrossSigning(args *SecretArgs, _ *Empty) error {
+	return s.api.RestoreCrossSigning(args.Secret)
+}
+
+func (s *Service) CreateKeyBackup(_ *Empty, reply *string) (err error) {
+	*reply, err = s.api.CreateKeyBackup()
+	return
+}
+
+func (s *Service) RestoreKeyBackup(args *SecretArgs, reply *int) (err error) {
+	*reply, err = s.api.RestoreKeyBackup(args.Secret)
+	return
+}
+
+func (s *Service) ExportKeys(args *SecretArgs, reply *[]byte) (err error) {
+	*reply, err = s.api.ExportKeys(args.Secret)
+	return
+}
+
+func (s *Service) ImportKeys(args *ImportArgs, reply *ImportReply) (err error) {
+	reply.Imported, reply.Total, err = s.api.ImportKeys(args.Data, args.Passphrase)
+	return
+}
+
+func (s *Service) DeviceTrust(args *UserArgs, reply *[]matrix.DeviceTrust) (err error) {
+	*reply, err = s.api.DeviceTrust(args.User)
+	return
+}
+
+// Server accepts JSON-RPC connections on a unix domain socket
+type Server struct {
+	listener net.Listener
+	path     string
+}
+
+// Serve starts answering the requests sent to the socket at the given path with the given API.
+// A socket left behind by a previous daemon is replaced.
+func Serve(path string, api API) (*Server, error) {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName(serviceName, &Service{api: api}); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	//the socket is created readable only by us, changing its mode after net.Listen would leave a window where
+	//any local user could connect and act on our account
+	oldMask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{listener: listener, path: path}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				debug.Print("Control socket closed: " + err.Error())
+				return
+			}
+			go rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+	return srv, nil
+}
+
+// Close stops accepting requests and removes the socket
+func (srv *Server) Close() error {
+	err := srv.listener.Close()
+	_ = os.Remove(srv.path)
+	return err
+}
@@ -1,6 +1,7 @@
 package ifc
 
 import (
+	"thesgo/matrix"
 	"thesgo/matrix/mxevents"
 	"thesgo/matrix/rooms"
 
@@ -19,7 +20,7 @@ type MatrixContainer interface {
 	Start()
 	Stop()
 
-	Login(user, password string) error
+	Login(user, password, homeserver string) error
 	Logout()
 	//UIAFallback(authType mautrix.AuthType, sessionID string) error
 
@@ -37,9 +38,25 @@ type MatrixContainer interface {
 	FetchMembers(room *rooms.Room) error
 	JoinedMembers(roomID id.RoomID) ([]id.UserID, error) //not sure if this is better than fetchMembers
 	GetHistory(room *rooms.Room, limit int, dbPointer uint64) ([]*mxevents.Event, uint64, error)
+	HistoryFrom(room *rooms.Room, eventID id.EventID, limit int, forward bool) ([]*mxevents.Event, error)
+	SearchHistory(query matrix.SearchQuery) ([]matrix.SearchResult, error)
 	GetEvent(room *rooms.Room, eventID id.EventID) (*mxevents.Event, error)
 	GetRoom(roomID id.RoomID) *rooms.Room
 	GetOrCreateRoom(roomID id.RoomID) *rooms.Room
 
+	StartVerification(roomID id.RoomID, user id.UserID) (*matrix.Verification, error)
+	Verifications() *matrix.VerificationRegistry
+	SetConfirmer(confirmer matrix.Confirmer)
+	ConfirmVerification(verificationID string, accept bool) error
+
+	BootstrapCrossSigning(password string) (string, error)
+	RestoreCrossSigning(recoveryKey string) error
+	DeviceTrust(user id.UserID) ([]matrix.DeviceTrust, error)
+
+	CreateKeyBackup() (string, error)
+	RestoreKeyBackup(recoveryKey string) (int, error)
+	ExportKeys(passphrase string) ([]byte, error)
+	ImportKeys(data []byte, passphrase string) (int, int, error)
+
 	//Crypto() Crypto Probaby will not need to define an interface for crypto ops, here just in case
 }
@@ -10,4 +10,5 @@ type Thesgo interface {
 
 	Start()
 	Stop(save bool)
+	OnStop(fn func()) //registers a function to run before the process exits through Stop
 }
@@ -54,8 +54,7 @@ func main() {
 	debug.Print("Cache directory:", cacheDir)
 
 	thesgo := NewThesgo(configDir, dataDir, cacheDir)
-	thesgo.Start()
-	cmd.SetLinkToBackend(thesgo) //link cli to rest of the client code
+	cmd.SetLinkToBackend(thesgo) //link cli to rest of the client code, which is only started if no daemon is running
 	defer cmd.Execute()          //run the interface after initial setup has finished
 
 }
@@ -0,0 +1,556 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// the only backup algorithm defined by the spec, megolm sessions encrypted to a curve25519 public key
+const backupAlgorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+
+var (
+	bucketKeyBackup       = []byte("key_backup")          //the backup version this device uploads to
+	bucketBackedUpSession = []byte("key_backup_sessions") //session ID -> backup version it was uploaded to
+	keyBackupInfo         = []byte("info")
+)
+
+type backupAuthData struct {
+	PublicKey  string                            `json:"public_key"`
+	Signatures map[id.UserID]map[id.KeyID]string `json:"signatures,omitempty"`
+}
+
+type backupVersion struct {
+	Algorithm string         `json:"algorithm"`
+	AuthData  backupAuthData `json:"auth_data"`
+	Version   string         `json:"version,omitempty"`
+}
+
+type encryptedSessionData struct {
+	Ephemeral  string `json:"ephemeral"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+type keyBackupData struct {
+	FirstMessageIndex uint32               `json:"first_message_index"`
+	ForwardedCount    int                  `json:"forwarded_count"`
+	IsVerified        bool                 `json:"is_verified"`
+	SessionData       encryptedSessionData `json:"session_data"`
+}
+
+type roomKeyBackup struct {
+	Sessions map[id.SessionID]keyBackupData `json:"sessions"`
+}
+
+type keysBackup struct {
+	Rooms map[id.RoomID]roomKeyBackup `json:"rooms"`
+}
+
+type sessionRef struct {
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+}
+
+// backupInfo is the backup version this device uploads its sessions to
+type backupInfo struct {
+	Version   string `json:"version"`
+	PublicKey string `json:"public_key"`
+}
+
+// KeyBackup keeps track of the inbound megolm sessions that still have to be uploaded to the server-side
+// key backup. It lives in the same bolt database as the event history.
+type KeyBackup struct {
+	db *bolt.DB
+
+	lock    sync.Mutex
+	info    *backupInfo
+	pending map[id.SessionID]sessionRef
+
+	wake chan struct{} //wakes up the upload routine whenever a new session is pending
+}
+
+func NewKeyBackup(hm *HistoryManager) (*KeyBackup, error) {
+	kb := &KeyBackup{db: hm.db, pending: make(map[id.SessionID]sessionRef), wake: make(chan struct{}, 1)}
+	err := hm.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketKeyBackup)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(bucketBackedUpSession); err != nil {
+			return err
+		}
+		if data := bucket.Get(keyBackupInfo); data != nil {
+			kb.info = &backupInfo{}
+			return json.Unmarshal(data, kb.info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kb, nil
+}
+
+func (kb *KeyBackup) setInfo(info *backupInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	err = kb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeyBackup).Put(keyBackupInfo, data)
+	})
+	if err != nil {
+		return err
+	}
+	kb.lock.Lock()
+	kb.info = info
+	kb.pending = make(map[id.SessionID]sessionRef)
+	kb.lock.Unlock()
+	return nil
+}
+
+// Add marks a session to be uploaded, unless it already is in the current backup version
+func (kb *KeyBackup) Add(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) {
+	kb.lock.Lock()
+	if kb.info == nil || kb.isBackedUp(sessionID, kb.info.Version) {
+		kb.lock.Unlock()
+		return
+	}
+	kb.pending[sessionID] = sessionRef{RoomID: roomID, SenderKey: senderKey}
+	kb.lock.Unlock()
+
+	select {
+	case kb.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (kb *KeyBackup) isBackedUp(sessionID id.SessionID, version string) (backedUp bool) {
+	_ = kb.db.View(func(tx *bolt.Tx) error {
+		backedUp = string(tx.Bucket(bucketBackedUpSession).Get([]byte(sessionID))) == version
+		return nil
+	})
+	return
+}
+
+func (kb *KeyBackup) markBackedUp(version string, sessions []id.SessionID) error {
+	return kb.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketBackedUpSession)
+		for _, sessionID := range sessions {
+			if err := bucket.Put([]byte(sessionID), []byte(version)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// takes the pending sessions out of the backup, they are put back if the upload fails
+func (kb *KeyBackup) takePending() (*backupInfo, map[id.SessionID]sessionRef) {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+	pending := kb.pending
+	kb.pending = make(map[id.SessionID]sessionRef)
+	return kb.info, pending
+}
+
+func (kb *KeyBackup) putBack(info *backupInfo, pending map[id.SessionID]sessionRef) {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+	if kb.info != info { //the backup version changed in the meantime
+		return
+	}
+	for sessionID, ref := range pending {
+		kb.pending[sessionID] = ref
+	}
+}
+
+// sessionStore is the crypto store of the olm machine. Every stored inbound session is reported to the key
+// backup, its pending key request is cancelled, and the stored events that were waiting for it are decrypted.
+type sessionStore struct {
+	*crypto.SQLCryptoStore
+	c *ClientWrapper
+}
+
+func (ss *sessionStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *crypto.InboundGroupSession) error {
+	err := ss.SQLCryptoStore.PutGroupSession(roomID, senderKey, sessionID, session)
+	if err != nil {
+		return err
+	}
+	if ss.c.keyBackup != nil {
+		ss.c.keyBackup.Add(roomID, senderKey, sessionID)
+	}
+	go ss.c.cancelKeyRequest(sessionID)
+	go ss.c.retryDecryption(sessionID)
+	return nil
+}
+
+// Queues every stored session that is not in the current backup version yet
+func (c *ClientWrapper) queueMissingSessions(kb *KeyBackup) {
+	sessions, err := c.crypto.CryptoStore.GetAllGroupSessions()
+	if err != nil {
+		c.logger.Err(err).Msg("Could not load the sessions to back up")
+		return
+	}
+	for _, igs := range sessions {
+		kb.Add(igs.RoomID, igs.SenderKey, igs.ID())
+	}
+}
+
+// Uploads the pending sessions whenever new ones arrive, retrying periodically after a failure
+func (c *ClientWrapper) runKeyBackup(kb *KeyBackup) {
+	defer debug.Recover()
+	c.queueMissingSessions(kb)
+
+	retry := time.NewTicker(time.Minute)
+	defer retry.Stop()
+	for {
+		select {
+		case <-kb.wake:
+		case <-retry.C:
+		}
+		if c.crypto == nil || c.keyBackup != kb { //the client was stopped or logged out
+			return
+		} else if c.IsOffline() {
+			continue
+		}
+		if err := c.uploadPendingSessions(kb); err != nil {
+			c.logger.Err(err).Msg("Could not upload room keys to the key backup")
+		}
+	}
+}
+
+func (c *ClientWrapper) uploadPendingSessions(kb *KeyBackup) error {
+	info, pending := kb.takePending()
+	if info == nil || len(pending) == 0 {
+		return nil
+	}
+	pubKey, err := decodeBackupPublicKey(info.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	req := keysBackup{Rooms: make(map[id.RoomID]roomKeyBackup)}
+	var uploaded []id.SessionID
+	for sessionID, ref := range pending {
+		igs, err := c.crypto.CryptoStore.GetGroupSession(ref.RoomID, ref.SenderKey, sessionID)
+		if err != nil || igs == nil {
+			c.logger.Error().Msg("Could not load session " + sessionID.String() + " to back up")
+			continue
+		}
+		data, err := encryptBackupSession(pubKey, igs)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not encrypt session " + sessionID.String() + " for the key backup")
+			continue
+		}
+		room, ok := req.Rooms[ref.RoomID]
+		if !ok {
+			room = roomKeyBackup{Sessions: make(map[id.SessionID]keyBackupData)}
+			req.Rooms[ref.RoomID] = room
+		}
+		room.Sessions[sessionID] = *data
+		uploaded = append(uploaded, sessionID)
+	}
+	if len(uploaded) == 0 {
+		return nil
+	}
+
+	url := c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{"version": info.Version})
+	if _, err = c.client.MakeRequest("PUT", url, &req, nil); err != nil {
+		kb.putBack(info, pending)
+		return err
+	}
+	debug.Printf("Backed up %d room keys to version %s", len(uploaded), info.Version)
+	return kb.markBackedUp(info.Version, uploaded)
+}
+
+// CreateKeyBackup creates a new key backup version on the server and starts uploading every session to it.
+// The returned recovery key is the only way of reading the backup, e.g. after losing the crypto database.
+func (c *ClientWrapper) CreateKeyBackup() (string, error) {
+	if c.crypto == nil || c.keyBackup == nil {
+		return "", fmt.Errorf("encryption is not enabled")
+	}
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	authData := backupAuthData{PublicKey: base64.RawStdEncoding.EncodeToString(privKey.PublicKey().Bytes())}
+	signature, err := c.crypto.GetAccount().Internal.SignJSON(authData)
+	if err != nil {
+		return "", err
+	}
+	signatures := map[id.KeyID]string{id.NewKeyID(id.KeyAlgorithmEd25519, c.client.DeviceID.String()): signature}
+	//lets other devices of the account trust the backup through cross-signing. The private master key is not
+	//stored, so this is only possible in the session that bootstrapped cross-signing.
+	if c.CrossSigningReady() && len(c.crypto.CrossSigningKeys.MasterKey.Seed) > 0 {
+		masterKey := c.crypto.CrossSigningKeys.MasterKey
+		if signature, err = masterKey.SignJSON(authData); err == nil {
+			signatures[id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.PublicKey.String())] = signature
+		}
+	}
+	authData.Signatures = map[id.UserID]map[id.KeyID]string{c.client.UserID: signatures}
+
+	var resp struct {
+		Version string `json:"version"`
+	}
+	url := c.client.BuildClientURL("v3", "room_keys", "version")
+	if _, err = c.client.MakeRequest("POST", url, &backupVersion{Algorithm: backupAlgorithm, AuthData: authData}, &resp); err != nil {
+		return "", err
+	}
+	if err = c.keyBackup.setInfo(&backupInfo{Version: resp.Version, PublicKey: authData.PublicKey}); err != nil {
+		return "", err
+	}
+	debug.Print("Created key backup version " + resp.Version)
+
+	go c.queueMissingSessions(c.keyBackup)
+	return utils.EncodeBase58RecoveryKey(privKey.Bytes()), nil
+}
+
+// RestoreKeyBackup downloads the sessions of the current key backup version and imports them with the
+// recovery key. This device then keeps uploading its new sessions to that version. Returns the number of
+// imported sessions.
+func (c *ClientWrapper) RestoreKeyBackup(recoveryKey string) (int, error) {
+	if c.crypto == nil || c.keyBackup == nil {
+		return 0, fmt.Errorf("encryption is not enabled")
+	}
+	keyBytes := utils.DecodeBase58RecoveryKey(recoveryKey)
+	if keyBytes == nil {
+		return 0, fmt.Errorf("invalid recovery key")
+	}
+	privKey, err := ecdh.X25519().NewPrivateKey(keyBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	var version backupVersion
+	if _, err = c.client.MakeRequest("GET", c.client.BuildClientURL("v3", "room_keys", "version"), nil, &version); err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return 0, fmt.Errorf("the account has no key backup")
+		}
+		return 0, err
+	} else if version.Algorithm != backupAlgorithm {
+		return 0, fmt.Errorf("unsupported key backup algorithm %s", version.Algorithm)
+	}
+	if base64.RawStdEncoding.EncodeToString(privKey.PublicKey().Bytes()) != version.AuthData.PublicKey {
+		return 0, fmt.Errorf("recovery key does not match key backup version %s", version.Version)
+	}
+
+	var keys keysBackup
+	url := c.client.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{"version": version.Version})
+	if _, err = c.client.MakeRequest("GET", url, nil, &keys); err != nil {
+		return 0, err
+	}
+	if err = c.keyBackup.setInfo(&backupInfo{Version: version.Version, PublicKey: version.AuthData.PublicKey}); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for roomID, room := range keys.Rooms {
+		for sessionID, data := range room.Sessions {
+			session, err := decryptBackupSession(privKey, &data.SessionData)
+			if err != nil {
+				c.logger.Err(err).Msg("Could not decrypt backed up session " + sessionID.String())
+				continue
+			}
+			session.RoomID, session.SessionID = roomID, sessionID
+			//the session is already in the backup, it must not be uploaded again when stored
+			if err = c.keyBackup.markBackedUp(version.Version, []id.SessionID{sessionID}); err != nil {
+				return count, err
+			}
+			if imported, err := c.importBackedUpSession(session); err != nil {
+				c.logger.Err(err).Msg("Could not import backed up session " + sessionID.String())
+			} else if imported {
+				count++
+			}
+		}
+	}
+	debug.Printf("Restored %d room keys from backup version %s", count, version.Version)
+
+	go c.queueMissingSessions(c.keyBackup)
+	return count, nil
+}
+
+// Stores a session read from the key backup, unless a better copy of it is already known
+func (c *ClientWrapper) importBackedUpSession(session *crypto.ExportedSession) (bool, error) {
+	if session.Algorithm != id.AlgorithmMegolmV1 {
+		return false, crypto.ErrInvalidExportedAlgorithm
+	}
+	igsInternal, err := olm.InboundGroupSessionImport([]byte(session.SessionKey))
+	if err != nil {
+		return false, err
+	} else if igsInternal.ID() != session.SessionID {
+		return false, crypto.ErrMismatchingExportedSessionID
+	}
+	igs := &crypto.InboundGroupSession{
+		Internal:         *igsInternal,
+		SigningKey:       session.SenderClaimedKeys.Ed25519,
+		SenderKey:        session.SenderKey,
+		RoomID:           session.RoomID,
+		ForwardingChains: session.ForwardingChains,
+
+		ReceivedAt: time.Now().UTC(),
+	}
+	existing, _ := c.crypto.CryptoStore.GetGroupSession(igs.RoomID, igs.SenderKey, igs.ID())
+	if existing != nil && existing.Internal.FirstKnownIndex() <= igs.Internal.FirstKnownIndex() {
+		return false, nil
+	}
+	return true, c.crypto.CryptoStore.PutGroupSession(igs.RoomID, igs.SenderKey, igs.ID(), igs)
+}
+
+//*************************** BACKUP ENCRYPTION *******************************//
+//Sessions are encrypted as libolm's PkEncryption does: an ephemeral curve25519 key agreement, HKDF-SHA256 into
+//AES-256-CBC and HMAC-SHA256 keys and an IV, with the MAC computed over an empty message as libolm does.
+
+func decodeBackupPublicKey(key string) (*ecdh.PublicKey, error) {
+	data, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+func backupKeys(sharedSecret []byte) (aesKey, macKey, iv []byte, err error) {
+	keys := make([]byte, 80)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, nil), keys); err != nil {
+		return
+	}
+	return keys[:32], keys[32:64], keys[64:], nil
+}
+
+func backupMAC(macKey []byte) []byte {
+	return hmac.New(sha256.New, macKey).Sum(nil)[:8]
+}
+
+func encryptBackupSession(pubKey *ecdh.PublicKey, igs *crypto.InboundGroupSession) (*keyBackupData, error) {
+	firstIndex := igs.Internal.FirstKnownIndex()
+	sessionKey, err := igs.Internal.Export(firstIndex)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(&crypto.ExportedSession{
+		Algorithm:         id.AlgorithmMegolmV1,
+		ForwardingChains:  igs.ForwardingChains,
+		SenderKey:         igs.SenderKey,
+		SenderClaimedKeys: crypto.SenderClaimedKeys{Ed25519: igs.SigningKey},
+		SessionKey:        string(sessionKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealBackupData(pubKey, ephemeral, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &keyBackupData{
+		FirstMessageIndex: firstIndex,
+		ForwardedCount:    len(igs.ForwardingChains),
+		SessionData:       *sealed,
+	}, nil
+}
+
+func decryptBackupSession(privKey *ecdh.PrivateKey, data *encryptedSessionData) (*crypto.ExportedSession, error) {
+	plaintext, err := openBackupData(privKey, data)
+	if err != nil {
+		return nil, err
+	}
+	var session crypto.ExportedSession
+	if err = json.Unmarshal(plaintext, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Encrypts the plaintext for the backup key with the given ephemeral key
+func sealBackupData(pubKey *ecdh.PublicKey, ephemeral *ecdh.PrivateKey, plaintext []byte) (*encryptedSessionData, error) {
+	shared, err := ephemeral.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, macKey, iv, err := backupKeys(shared)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return &encryptedSessionData{
+		Ephemeral:  base64.RawStdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		Ciphertext: base64.RawStdEncoding.EncodeToString(ciphertext),
+		MAC:        base64.RawStdEncoding.EncodeToString(backupMAC(macKey)),
+	}, nil
+}
+
+// Checks the MAC of the encrypted data and decrypts it with the private backup key
+func openBackupData(privKey *ecdh.PrivateKey, data *encryptedSessionData) ([]byte, error) {
+	ephemeral, err := decodeBackupPublicKey(data.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := privKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, macKey, iv, err := backupKeys(shared)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := base64.RawStdEncoding.DecodeString(data.MAC)
+	if err != nil {
+		return nil, err
+	} else if !hmac.Equal(mac, backupMAC(macKey)) {
+		return nil, fmt.Errorf("mismatching MAC")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(data.Ciphertext)
+	if err != nil {
+		return nil, err
+	} else if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,136 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Known answer for m.megolm_backup.v1.curve25519-aes-sha2, with the RFC 7748 X25519 key pairs that libolm's own
+// PkEncryption tests use: Alice's key is the backup key and Bob's the ephemeral one. The ciphertext and MAC were
+// computed independently, with HKDF-SHA256, AES-256-CBC and an HMAC-SHA256 over the empty message truncated to
+// 8 bytes.
+const (
+	backupPrivateKey   = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	backupPublicKey    = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo"
+	backupEphemeralKey = "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"
+
+	backupPlaintext = `{"algorithm":"m.megolm.v1.aes-sha2","forwarding_curve25519_key_chain":[],"sender_key":"3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08","sender_claimed_keys":{"ed25519":"qmx+8D1EtxNo5dyPYJ8R6PMeIHqR0yPPuXSRDSd9gyA"},"session_key":"AgAAAAAQcQ6XrFJk6Prm8FikZDqfry/NbDz8Xw7T6e+/9Yf/q3YHIPEQlzv7IZMNcYb51ifkRzFejVvtphS7wwG2FaXIp4XS2obla14iKISR0X74ugB2vyb1AydIHE/zbBQ1ic5s3kgjMFlWpu/S3FQCnCrv+DPFGEt3ERGWxIl3Bl5X53IjPyVkz65oljz2TZESwz0GH/QFvyOOm8ci0q/gceaF3S7Dmafg3dwTKYwcA5xkcc+BLyrLRzB6Hn+oMAqSNSscnm4mTeT5zYibIhrzqyUTMWr32spFtI9dNR/RFSzfCw"}`
+)
+
+var backupVector = encryptedSessionData{
+	Ephemeral:  "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08",
+	Ciphertext: "9lq9DgATQh0Ey5ZaVGHfoeMtfpavaYtV17dAmUZKJ5KE2zq6WJ3ZNxzSc7vBLxZ92LDrQYg628RcotpdEqWh6K8IFGIxibaj6emMBbPWgEWCuN/en40zYYcjju9d/gK/Y13J7+jy4FIHtKhgYwpo//lIm6+3LdWN86QfunImZxf6RL08OIfJ/Z5LRxRX/e1gaJU5dFX3+tBVYwM2gZDSE1y1WW8RReVfp/krXifqY7ZZ8QBtVrUQJSMtV3rIspbAuEH+jXjXcqElOsyu/lpqhaPhCucbhldQNxkqLUPRi7tcWX14C2c2tR6IrIMqCi3P9N6QmQmK1rDLdyjis+3SL8ipRlMQ+B3TUM5Uq43Kenxnyuf5AxlXD0eA8k0oRGttBnEFpEJombmxPa+KiS6b4+Ml/OcuVMFp3UhRfGs+iFmPa/5JGzlZ+hUcYVUINhYwQlReFJUUXP023M7RyIdwtEtlhJwt/2NDXRjdvUcsGQsMaegO9YqEC1YHZD/M3iXhw8UoO9FN8OHD2RccXwGmsxm1xZwhZjPZ2VGBtHDvuL/kQQHsyXycRzucs6I/cxSTuSQtPuc8kDJ5iEBNqpj++JJ2Xnu4CQVKCr+DJf99Zk1RV8akTvienZI5DFA4MkBp1aE+E6qnFS3RPsYX4qP+bAvNxOz1iN1E/pRZC78u0F46MS4rAnxZy0OWpdAS+8m0cYwQUXU7SBIZOX5NzrBL7g",
+	MAC:        "zpzU6BkZcNI",
+}
+
+func privateKey(t *testing.T, hexKey string) *ecdh.PrivateKey {
+	data, err := hex.DecodeString(hexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestBackupKnownAnswer(t *testing.T) {
+	privKey := privateKey(t, backupPrivateKey)
+	pubKey, err := decodeBackupPublicKey(backupPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if !pubKey.Equal(privKey.PublicKey()) {
+		t.Fatal("public key does not match the private key")
+	}
+
+	sealed, err := sealBackupData(pubKey, privateKey(t, backupEphemeralKey), []byte(backupPlaintext))
+	if err != nil {
+		t.Fatal(err)
+	} else if *sealed != backupVector {
+		t.Errorf("encrypted to %+v, expected %+v", *sealed, backupVector)
+	}
+
+	session, err := decryptBackupSession(privKey, &backupVector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Algorithm != id.AlgorithmMegolmV1 {
+		t.Errorf("algorithm is %s", session.Algorithm)
+	}
+	if session.SenderKey != "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08" {
+		t.Errorf("sender key is %s", session.SenderKey)
+	}
+	if session.SenderClaimedKeys.Ed25519 != "qmx+8D1EtxNo5dyPYJ8R6PMeIHqR0yPPuXSRDSd9gyA" {
+		t.Errorf("claimed signing key is %s", session.SenderClaimedKeys.Ed25519)
+	}
+	if len(session.SessionKey) != 306 {
+		t.Errorf("session key has %d characters", len(session.SessionKey))
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every padding length, from a full block of it to a single byte
+	for size := 0; size <= 32; size++ {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := sealBackupData(privKey.PublicKey(), ephemeral, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := openBackupData(privKey, sealed)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		} else if !bytes.Equal(opened, plaintext) {
+			t.Errorf("%d bytes: decrypted to %q", size, opened)
+		}
+	}
+}
+
+func TestBackupRejects(t *testing.T) {
+	privKey := privateKey(t, backupPrivateKey)
+	otherKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badMAC := backupVector
+	badMAC.MAC = base64.RawStdEncoding.EncodeToString(make([]byte, 8))
+	truncated := backupVector
+	truncated.Ciphertext = truncated.Ciphertext[:len(truncated.Ciphertext)-4]
+	lastBlock := backupVector //CBC xors the previous block into the last padding byte
+	ciphertext, _ := base64.RawStdEncoding.DecodeString(backupVector.Ciphertext)
+	ciphertext[len(ciphertext)-17] ^= 0xff
+	lastBlock.Ciphertext = base64.RawStdEncoding.EncodeToString(ciphertext)
+
+	tests := []struct {
+		name string
+		key  *ecdh.PrivateKey
+		data encryptedSessionData
+	}{
+		{"wrong key", otherKey, backupVector},
+		{"bad mac", privKey, badMAC},
+		{"truncated ciphertext", privKey, truncated},
+		{"bad padding", privKey, lastBlock},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if plaintext, err := openBackupData(test.key, &test.data); err == nil {
+				t.Errorf("decrypted to %q", plaintext)
+			}
+		})
+	}
+}
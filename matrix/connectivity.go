@@ -0,0 +1,217 @@
+package matrix
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+)
+
+// ConnState is how well the homeserver can be reached
+type ConnState int
+
+const (
+	StateOnline   ConnState = iota
+	StateDegraded           //requests are failing, but not long enough to give up on the homeserver
+	StateOffline
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateOnline:
+		return "online"
+	case StateDegraded:
+		return "degraded"
+	default:
+		return "offline"
+	}
+}
+
+const (
+	offlineAfterFailures = 3 //consecutive failures before the homeserver is considered unreachable
+
+	connCheckInterval = 5 * time.Second //how often the network interfaces are checked for changes
+	probeOnline       = time.Minute     //how often the homeserver is probed while it is reachable
+	probeUnreachable  = 10 * time.Second
+
+	syncRetryOnline   = 2 * time.Second //wait before retrying a failed sync while the homeserver still looks reachable
+	syncRetryDegraded = 5 * time.Second
+)
+
+// Connectivity tracks the state of the connection to the homeserver. It is fed by the result of syncs and
+// other requests, by periodic /versions probes and by changes of the network interfaces, and notifies
+// every subscriber when the state changes.
+type Connectivity struct {
+	lock      sync.Mutex
+	state     ConnState
+	failures  int
+	lastProbe time.Time
+	subs      []chan ConnState
+}
+
+func NewConnectivity() *Connectivity {
+	return &Connectivity{state: StateOnline}
+}
+
+func (cn *Connectivity) State() ConnState {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	return cn.state
+}
+
+// Subscribe returns a channel receiving the new state on every change. A slow subscriber only misses
+// intermediate states, the latest one is always delivered.
+func (cn *Connectivity) Subscribe() <-chan ConnState {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	ch := make(chan ConnState, 1)
+	cn.subs = append(cn.subs, ch)
+	return ch
+}
+
+func (cn *Connectivity) Unsubscribe(sub <-chan ConnState) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	for i, ch := range cn.subs {
+		if ch == sub {
+			cn.subs = append(cn.subs[:i], cn.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// must be called with the lock held
+func (cn *Connectivity) setState(state ConnState) {
+	if cn.state == state {
+		return
+	}
+	debug.Printf("Homeserver connectivity changed from %s to %s", cn.state, state)
+	cn.state = state
+	for _, ch := range cn.subs {
+		select { //drop the state the subscriber did not read yet
+		case <-ch:
+		default:
+		}
+		ch <- state
+	}
+}
+
+// ReportSuccess records a request that reached the homeserver
+func (cn *Connectivity) ReportSuccess() {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	cn.failures = 0
+	cn.setState(StateOnline)
+}
+
+// MarkOffline sets the homeserver as unreachable right away, e.g. when it cannot be reached at startup
+func (cn *Connectivity) MarkOffline() {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	cn.failures = offlineAfterFailures
+	cn.setState(StateOffline)
+}
+
+// ReportFailure records a failed request. Only failures to reach the homeserver count, see isConnectivityError.
+// Any other error was returned by the homeserver itself, which means it is reachable.
+func (cn *Connectivity) ReportFailure(err error) {
+	if !isConnectivityError(err) {
+		cn.ReportSuccess()
+		return
+	}
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	cn.failures++
+	if cn.failures >= offlineAfterFailures {
+		cn.setState(StateOffline)
+	} else {
+		cn.setState(StateDegraded)
+	}
+}
+
+// Run probes the homeserver with the given function until done is closed. Probes are more frequent while
+// it is unreachable, and one is made right away whenever the addresses of the network interfaces change.
+func (cn *Connectivity) Run(probe func() error, done <-chan struct{}) {
+	defer debug.Recover()
+	ticker := time.NewTicker(connCheckInterval)
+	defer ticker.Stop()
+	addrs := interfaceAddrs()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		current := interfaceAddrs()
+		changed := current != addrs
+		addrs = current
+		cn.lock.Lock()
+		interval := probeOnline
+		if cn.state != StateOnline {
+			interval = probeUnreachable
+		}
+		due := changed || time.Since(cn.lastProbe) >= interval
+		if due {
+			cn.lastProbe = time.Now()
+		}
+		cn.lock.Unlock()
+
+		if changed {
+			debug.Print("Network interfaces changed, probing the homeserver")
+		}
+		if !due {
+			continue
+		}
+		if err := probe(); err != nil {
+			cn.ReportFailure(err)
+		} else {
+			cn.ReportSuccess()
+		}
+	}
+}
+
+// Syncer callback for a failed /sync. The error feeds the connectivity state, which sets how long to wait before
+// the next attempt. An unknown token stops syncing, so that Start logs out.
+func (c *ClientWrapper) syncFailed(err error) (time.Duration, error) {
+	if errors.Is(err, mautrix.MUnknownToken) {
+		return 0, err
+	}
+	c.connectivity.ReportFailure(err)
+	switch c.connectivity.State() {
+	case StateOnline:
+		return syncRetryOnline, nil
+	case StateDegraded:
+		return syncRetryDegraded, nil
+	default:
+		return probeUnreachable, nil
+	}
+}
+
+// Returns the addresses of the network interfaces that are up, as a comparable string
+func interfaceAddrs() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var list []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			list = append(list, iface.Name+"="+addr.String())
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
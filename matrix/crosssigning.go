@@ -0,0 +1,208 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+)
+
+// DeviceTrust is the trust resolved for a single device of a user
+type DeviceTrust struct {
+	UserID     id.UserID     `json:"user_id"`
+	DeviceID   id.DeviceID   `json:"device_id"`
+	Name       string        `json:"name"`
+	SigningKey id.Ed25519    `json:"signing_key"`
+	Trust      id.TrustState `json:"trust"`
+}
+
+// The self-signing and user-signing keys are kept next to the crypto database so that this device can keep signing
+// after a restart without asking for the recovery key again
+func (c *ClientWrapper) crossSigningPath() string {
+	return filepath.Join(c.config.DataDir, "cross_signing.json")
+}
+
+// The cross-signing keys written to disk. The master key only signs the other two, so its private half is left
+// in secret storage, to be restored with RestoreCrossSigning and the recovery key when it is needed again
+type storedCrossSigningKeys struct {
+	MasterKey      id.Ed25519 `json:"master_key"`
+	SelfSigningKey []byte     `json:"self_signing_key"`
+	UserSigningKey []byte     `json:"user_signing_key"`
+}
+
+func (c *ClientWrapper) loadCrossSigningKeys() error {
+	data, err := os.ReadFile(c.crossSigningPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var stored storedCrossSigningKeys
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	keys := &crypto.CrossSigningKeysCache{MasterKey: &olm.PkSigning{PublicKey: stored.MasterKey}}
+	if keys.SelfSigningKey, err = olm.NewPkSigningFromSeed(stored.SelfSigningKey); err != nil {
+		return err
+	}
+	if keys.UserSigningKey, err = olm.NewPkSigningFromSeed(stored.UserSigningKey); err != nil {
+		return err
+	}
+	c.crypto.CrossSigningKeys = keys
+	return nil
+}
+
+func (c *ClientWrapper) saveCrossSigningKeys() error {
+	keys := c.crypto.CrossSigningKeys
+	data, err := json.Marshal(storedCrossSigningKeys{
+		MasterKey:      keys.MasterKey.PublicKey,
+		SelfSigningKey: keys.SelfSigningKey.Seed,
+		UserSigningKey: keys.UserSigningKey.Seed,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.crossSigningPath(), data, 0600)
+}
+
+// BootstrapCrossSigning generates new master, self-signing and user-signing keys, stores them encrypted in
+// the secret storage of the account and publishes the public keys. This device is signed with the new keys.
+// The account password is needed to upload the keys, the returned recovery key unlocks them on other devices.
+func (c *ClientWrapper) BootstrapCrossSigning(password string) (string, error) {
+	if c.crypto == nil {
+		return "", fmt.Errorf("encryption is not enabled")
+	}
+	recoveryKey, err := c.crypto.GenerateAndUploadCrossSigningKeys(password, "")
+	if err != nil {
+		return recoveryKey, err
+	}
+	if err = c.signOwnIdentity(); err != nil {
+		return recoveryKey, err
+	}
+	debug.Print("Bootstrapped cross-signing for " + c.client.UserID.String())
+	return recoveryKey, nil
+}
+
+// RestoreCrossSigning fetches the private cross-signing keys from secret storage with the recovery key
+// given when they were bootstrapped, and signs this device with them
+func (c *ClientWrapper) RestoreCrossSigning(recoveryKey string) error {
+	if c.crypto == nil {
+		return fmt.Errorf("encryption is not enabled")
+	}
+	_, keyData, err := c.crypto.SSSS.GetDefaultKeyData()
+	if err != nil {
+		return fmt.Errorf("failed to get secret storage key: %w", err)
+	}
+	key, err := keyData.VerifyRecoveryKey(recoveryKey)
+	if err != nil {
+		return err
+	}
+	if err = c.crypto.FetchCrossSigningKeysFromSSSS(key); err != nil {
+		return err
+	}
+	return c.signOwnIdentity()
+}
+
+// Signs our master key with the device key and this device with the self-signing key, then keeps the keys
+func (c *ClientWrapper) signOwnIdentity() error {
+	if err := c.crypto.SignOwnMasterKey(); err != nil {
+		return fmt.Errorf("failed to sign own master key: %w", err)
+	}
+	if err := c.crypto.SignOwnDevice(c.crypto.OwnIdentity()); err != nil {
+		return fmt.Errorf("failed to sign own device: %w", err)
+	}
+	return c.saveCrossSigningKeys()
+}
+
+// CrossSigningReady tells if this device holds the private cross-signing keys. Only then are the devices
+// verified through SAS cross-signed (our own) or their users signed (everyone else's).
+func (c *ClientWrapper) CrossSigningReady() bool {
+	return c.crypto != nil && c.crypto.CrossSigningKeys != nil
+}
+
+// ResolveTrust returns how trusted a device is. A device that was not verified directly is trusted if it
+// is signed by the self-signing key of a user whose master key was signed by our user-signing key.
+// The resolution in mautrix is not used as it reports the devices of unverified users as verified.
+func (c *ClientWrapper) ResolveTrust(device *id.Device) id.TrustState {
+	if device.Trust == id.TrustStateVerified || device.Trust == id.TrustStateBlacklisted {
+		return device.Trust
+	}
+	return c.crossSigningTrust(device)
+}
+
+// Trust a device gets from cross-signing alone, whether or not it was marked verified locally
+func (c *ClientWrapper) crossSigningTrust(device *id.Device) id.TrustState {
+	unverified := *device
+	unverified.Trust = id.TrustStateUnset
+	//mautrix only returns a cross-signed state if the device is signed by a valid self-signing key
+	if c.crypto.ResolveTrust(&unverified) == id.TrustStateUnset {
+		return id.TrustStateUnset
+	}
+
+	if trusted, err := c.crypto.IsUserTrusted(context.TODO(), device.UserID); err != nil {
+		c.logger.Err(err).Msg("Could not resolve the trust of " + device.UserID.String())
+		return id.TrustStateUnset
+	} else if trusted {
+		return id.TrustStateCrossSignedVerified
+	}
+	//not verified, but still signed with the first master key we saw for that user
+	theirKeys, err := c.crypto.CryptoStore.GetCrossSigningKeys(device.UserID)
+	if err == nil && theirKeys[id.XSUsageMaster].Key == theirKeys[id.XSUsageMaster].First {
+		return id.TrustStateCrossSignedTOFU
+	}
+	return id.TrustStateCrossSignedUntrusted
+}
+
+// Minimum trust a device must have to receive our keys or to be accepted as an offline host
+func (c *ClientWrapper) minTrust() id.TrustState {
+	if c.config.SendToVerifiedOnly {
+		return id.TrustStateCrossSignedVerified
+	}
+	return id.TrustStateCrossSignedTOFU
+}
+
+func (c *ClientWrapper) isDeviceTrusted(device *id.Device) bool {
+	return c.ResolveTrust(device) >= c.minTrust()
+}
+
+// Applies the trust policy to the olm machine. It cannot be trusted to resolve cross-signing (see ResolveTrust),
+// so it only withholds our sessions from blacklisted devices, and send_to_verified_only is enforced by
+// shareGroupSession instead. Key requests are answered by HandleKeyRequest.
+func (c *ClientWrapper) applyTrustPolicy() {
+	c.crypto.SendKeysMinTrust = id.TrustStateUnset
+	c.crypto.ShareKeysMinTrust = id.TrustStateCrossSignedTOFU
+}
+
+// DeviceTrust fetches the devices of a user and resolves the trust of each one
+func (c *ClientWrapper) DeviceTrust(user id.UserID) ([]DeviceTrust, error) {
+	if c.crypto == nil {
+		return nil, fmt.Errorf("encryption is not enabled")
+	}
+	devices := c.crypto.LoadDevices(user)
+	if devices == nil {
+		return nil, fmt.Errorf("could not fetch the devices of %s", user)
+	}
+	list := make([]DeviceTrust, 0, len(devices))
+	for _, device := range devices {
+		list = append(list, DeviceTrust{
+			UserID:     device.UserID,
+			DeviceID:   device.DeviceID,
+			Name:       device.Name,
+			SigningKey: device.SigningKey,
+			Trust:      c.ResolveTrust(device),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	return list, nil
+}
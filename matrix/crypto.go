@@ -33,21 +33,30 @@ func (c *ClientWrapper) initCrypto() error {
 		return fmt.Errorf("failed to upgrade crypto state store: %w", err)
 	}
 
-	crypt := crypto.NewOlmMachine(c.client, &log, cryptoStore, c.config.Rooms)
+	//the store is wrapped so that every new inbound session is also uploaded to the key backup and used
+	//to decrypt the events that were waiting for it
+	crypt := crypto.NewOlmMachine(c.client, &log, &sessionStore{SQLCryptoStore: cryptoStore, c: c}, c.config.Rooms)
+	crypt.AcceptVerificationFrom = c.acceptVerificationFrom
+	crypt.AllowKeyShare = c.ignoreKeyRequest
 	c.crypto = crypt
 	err = c.crypto.Load()
 	if err != nil {
 		return fmt.Errorf("failed to create olm machine: %w", err)
 	}
+	if err = c.loadCrossSigningKeys(); err != nil {
+		return fmt.Errorf("failed to load cross-signing keys: %w", err)
+	}
+	c.applyTrustPolicy()
 	return nil
 
 }
 
 func (c *ClientWrapper) cryptoOnLogin() {
-	sqlStore, ok := c.crypto.CryptoStore.(*crypto.SQLCryptoStore)
+	store, ok := c.crypto.CryptoStore.(*sessionStore)
 	if !ok {
 		return
 	}
+	sqlStore := store.SQLCryptoStore
 	sqlStore.DeviceID = c.config.DeviceID
 	sqlStore.AccountID = fmt.Sprintf("%s/%s", c.config.UserID.String(), c.config.DeviceID)
 }
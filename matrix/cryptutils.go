@@ -5,10 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"thesgo/matrix/mxevents"
 	"time"
 
 	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/event"
@@ -129,45 +129,41 @@ func (c *ClientWrapper) tryDecryptOlmCiphertext(ctx context.Context, sender id.U
 		return plaintext, nil
 	}
 
-	/* won't need this
 	// Decryption failed with every known session or no known sessions, let's try to create a new session.
+	// This happens offline when the online host built a session from a one-time or fallback key it cached.
 	//
 	// New sessions can only be created if it's a prekey message, we can't decrypt the message
 	// if it isn't one at this point in time anymore, so return early.
 	if olmType != id.OlmMsgTypePreKey {
-		go mach.unwedgeDevice(log, sender, senderKey)
 		return nil, crypto.DecryptionFailedForNormalMessage
 	}
 
-	/*log.Trace().Msg("Trying to create inbound session")
-	endTimeTrace = mach.timeTrace(ctx, "creating inbound olm session", time.Second)
-	session, err := c.crypto.createInboundSession(ctx, senderKey, ciphertext)
-	endTimeTrace()
+	account := c.crypto.GetAccount()
+	session, err := account.NewInboundSessionFrom(senderKey, ciphertext)
 	if err != nil {
-		go mach.unwedgeDevice(log, sender, senderKey)
 		return nil, fmt.Errorf("failed to create new session from prekey message: %w", err)
 	}
-	log = log.With().Str("new_olm_session_id", session.ID().String()).Logger()
-	log.Debug().
-		Str("olm_session_description", session.Describe()).
+	//the one-time key used by the sender was removed from the account
+	if err = c.crypto.CryptoStore.PutAccount(account); err != nil {
+		c.logger.Err(err).Msg("Failed to save account after creating inbound olm session")
+	}
+	if err = c.crypto.CryptoStore.AddSession(senderKey, session); err != nil {
+		c.logger.Err(err).Msg("Failed to store created inbound olm session")
+	}
+	c.logger.Debug().
+		Str("new_olm_session_id", session.ID().String()).
+		Str("sender", sender.String()).
 		Msg("Created inbound olm session")
-	ctx = log.WithContext(ctx)
 
-	endTimeTrace = mach.timeTrace(ctx, "decrypting prekey olm message", time.Second)
 	plaintext, err = session.Decrypt(ciphertext, olmType)
-	endTimeTrace()
 	if err != nil {
-		go mach.unwedgeDevice(log, sender, senderKey)
 		return nil, fmt.Errorf("failed to decrypt olm event with session created from prekey message: %w", err)
 	}
-
 	err = c.crypto.CryptoStore.UpdateSession(senderKey, session)
-	endTimeTrace()
 	if err != nil {
-		log.Warn().Err(err).Msg("Failed to update new olm session in crypto store after decrypting")
+		c.logger.Warn().Err(err).Msg("Failed to update new olm session in crypto store after decrypting")
 	}
-	return plaintext, nil*/
-	return nil, nil
+	return plaintext, nil
 }
 
 func (c *ClientWrapper) tryDecryptOlmCiphertextWithExistingSession(ctx context.Context, senderKey id.SenderKey, olmType id.OlmMsgType, ciphertext string) ([]byte, error) {
@@ -286,29 +282,18 @@ func (c *ClientWrapper) createGroupSession(ctx context.Context, senderKey id.Sen
 		Msg("Received inbound group session")
 }
 
-func (c *ClientWrapper) buildKeyRequest(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, users map[id.UserID][]id.DeviceID) *mxevents.Event {
-	requestCont := &event.Content{
-		Parsed: &event.RoomKeyRequestEventContent{
-			Action: event.KeyRequestActionRequest,
-			Body: event.RequestedKeyInfo{
-				Algorithm: id.AlgorithmMegolmV1,
-				RoomID:    roomID,
-				SenderKey: senderKey,
-				SessionID: sessionID,
-			},
-			RequestID:          c.client.TxnID(),
-			RequestingDeviceID: c.client.DeviceID,
+func (c *ClientWrapper) buildKeyRequest(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) *event.RoomKeyRequestEventContent {
+	return &event.RoomKeyRequestEventContent{
+		Action: event.KeyRequestActionRequest,
+		Body: event.RequestedKeyInfo{
+			Algorithm: id.AlgorithmMegolmV1,
+			RoomID:    roomID,
+			SenderKey: senderKey,
+			SessionID: sessionID,
 		},
+		RequestID:          c.client.TxnID(),
+		RequestingDeviceID: c.client.DeviceID,
 	}
-
-	requestEvent := &mxevents.Event{
-		Event: &event.Event{
-			Type:    event.ToDeviceRoomKeyRequest,
-			Content: event.Content{Parsed: requestCont},
-		},
-	}
-
-	return requestEvent
 }
 
 func (c *ClientWrapper) parseKeyRequestEvent(content *event.RoomKeyRequestEventContent) (event.Content, error) {
@@ -404,6 +389,98 @@ func (c *ClientWrapper) importForwardedRoomKey(ctx context.Context, evt *crypto.
 	return true
 }
 
+// Fetches the device keys of all the given users with a single /keys/query and stores them in the crypto store,
+// mirroring OlmMachine.fetchKeys, which the SDK only exposes one user at a time through LoadDevices. The stored trust
+// of known devices is kept. Cross-signing keys are left to the device list tracking of the sync loop, which the
+// users are added to by PutDevices.
+func (c *ClientWrapper) fetchKeys(users []id.UserID) (map[id.UserID]map[id.DeviceID]*id.Device, error) {
+	req := &mautrix.ReqQueryKeys{DeviceKeys: mautrix.DeviceKeysRequest{}, Timeout: 10 * 1000}
+	for _, user := range users {
+		req.DeviceKeys[user] = mautrix.DeviceIDList{}
+	}
+	resp, err := c.client.QueryKeys(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query keys: %w", err)
+	}
+	for server, failure := range resp.Failures {
+		c.logger.Warn().Interface("query_error", failure).Str("server", server).Msg("Query keys failure for server")
+	}
+
+	data := make(map[id.UserID]map[id.DeviceID]*id.Device, len(resp.DeviceKeys))
+	for user, devices := range resp.DeviceKeys {
+		existing, err := c.crypto.CryptoStore.GetDevices(user)
+		if err != nil {
+			return nil, err
+		}
+		changed := len(devices) != len(existing)
+		newDevices := make(map[id.DeviceID]*id.Device, len(devices))
+		for deviceID, keys := range devices {
+			old := existing[deviceID]
+			if old == nil {
+				changed = true
+			}
+			device, err := validateDevice(user, deviceID, keys, old)
+			if err != nil {
+				c.logger.Err(err).Str("user_id", user.String()).Str("device_id", deviceID.String()).Msg("Failed to validate device")
+			}
+			if device != nil {
+				newDevices[deviceID] = device
+			}
+		}
+		if err = c.crypto.CryptoStore.PutDevices(user, newDevices); err != nil {
+			return nil, err
+		}
+		if changed || len(newDevices) != len(existing) {
+			c.crypto.OnDevicesChanged(user)
+		}
+		data[user] = newDevices
+	}
+	return data, nil
+}
+
+// Checks the keys of a device returned by /keys/query the same way OlmMachine.validateDevice does. The known
+// device is returned along with the error if the new keys cannot replace it.
+func validateDevice(user id.UserID, deviceID id.DeviceID, keys mautrix.DeviceKeys, existing *id.Device) (*id.Device, error) {
+	if deviceID != keys.DeviceID {
+		return nil, fmt.Errorf("%w (expected %s, got %s)", crypto.MismatchingDeviceID, deviceID, keys.DeviceID)
+	} else if user != keys.UserID {
+		return nil, fmt.Errorf("%w (expected %s, got %s)", crypto.MismatchingUserID, user, keys.UserID)
+	}
+
+	signingKey := keys.Keys.GetEd25519(deviceID)
+	identityKey := keys.Keys.GetCurve25519(deviceID)
+	if signingKey == "" {
+		return nil, crypto.NoSigningKeyFound
+	} else if identityKey == "" {
+		return nil, crypto.NoIdentityKeyFound
+	} else if existing != nil && existing.SigningKey != signingKey {
+		return existing, fmt.Errorf("%w (expected %s, got %s)", crypto.MismatchingSigningKey, existing.SigningKey, signingKey)
+	}
+
+	if ok, err := olm.VerifySignatureJSON(keys, user, deviceID.String(), signingKey); err != nil {
+		return existing, fmt.Errorf("failed to verify signature: %w", err)
+	} else if !ok {
+		return existing, crypto.InvalidKeySignature
+	}
+
+	name, ok := keys.Unsigned["device_display_name"].(string)
+	if !ok {
+		name = deviceID.String()
+	}
+	trust := id.TrustStateUnset
+	if existing != nil {
+		trust = existing.Trust
+	}
+	return &id.Device{
+		UserID:      user,
+		DeviceID:    deviceID,
+		IdentityKey: identityKey,
+		SigningKey:  signingKey,
+		Trust:       trust,
+		Name:        name,
+	}, nil
+}
+
 func stringifyArray[T ~string](arr []T) []string {
 	strs := make([]string, len(arr))
 	for i, v := range arr {
@@ -0,0 +1,27 @@
+package matrix
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// DataStore is the bolt database kept in the data directory, next to the crypto store and the libp2p key, for the
+// state that must survive clearing the cache: the pinned peer bindings and the outbox of messages not uploaded yet
+type DataStore struct {
+	db *bolt.DB
+}
+
+func NewDataStore(dbPath string) (*DataStore, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
+		Timeout:      1,
+		NoGrowSync:   false,
+		FreelistType: bolt.FreelistArrayType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DataStore{db: db}, nil
+}
+
+func (ds *DataStore) Close() error {
+	return ds.db.Close()
+}
@@ -0,0 +1,273 @@
+package matrix
+
+import (
+	"encoding/json"
+
+	"thesgo/matrix/mxevents"
+	"thesgo/matrix/rooms"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var bucketGaps = []byte("room_gaps") //room ID -> stream key of the first event after a gap -> gap
+
+const (
+	gapPageSize = 50      //events fetched per /messages request when filling a gap
+	maxGapPages = 20      //pages fetched per gap each time the gaps are filled, the rest is left for the next sync
+	gapReserve  = 1 << 20 //stream keys left free for the events of a gap
+)
+
+// Gap is a part of the timeline of a room left out by a limited sync. Stream keys are reserved for it below the
+// events that follow it, and its events are stored there newest first as they are fetched from the server.
+type Gap struct {
+	RoomID id.RoomID `json:"room_id"`
+	Key    uint64    `json:"key"`  //stream key of the first event after the gap
+	From   string    `json:"from"` //token to fetch the next older events of the gap with /messages
+	Next   uint64    `json:"next"` //stream key for the next older event of the gap
+	Low    uint64    `json:"low"`  //lowest stream key reserved for the gap
+}
+
+func putGap(tx *bolt.Tx, gap *Gap) error {
+	gaps, err := tx.Bucket(bucketGaps).CreateBucketIfNotExists([]byte(gap.RoomID))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(gap)
+	if err != nil {
+		return err
+	}
+	return gaps.Put(itob(gap.Key), data)
+}
+
+func deleteGap(tx *bolt.Tx, gap *Gap) error {
+	gaps := tx.Bucket(bucketGaps).Bucket([]byte(gap.RoomID))
+	if gaps == nil {
+		return nil
+	}
+	return gaps.Delete(itob(gap.Key))
+}
+
+// OpenGap marks a gap after the events stored for the room, to be filled going back from the given token.
+// Nothing is missing if no event of the room is stored yet, as older history is paginated on demand.
+func (hm *HistoryManager) OpenGap(room *rooms.Room, from string) (gap *Gap, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		stream := tx.Bucket(bucketRoomStreams).Bucket([]byte(room.ID))
+		if stream == nil {
+			return nil
+		} else if k, _ := stream.Cursor().First(); k == nil {
+			return nil
+		}
+		low := stream.Sequence() + 1
+		if low < halfUint64 {
+			low = halfUint64
+		}
+		gap = &Gap{RoomID: room.ID, Key: low + gapReserve, From: from, Next: low + gapReserve - 1, Low: low}
+		if err := stream.SetSequence(gap.Key - 1); err != nil { //the next appended event goes right after the gap
+			return err
+		}
+		return putGap(tx, gap)
+	})
+	return
+}
+
+// Gaps returns the gaps of every room that are not filled yet
+func (hm *HistoryManager) Gaps() (gaps []*Gap, err error) {
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketGaps).ForEach(func(roomID, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return tx.Bucket(bucketGaps).Bucket(roomID).ForEach(func(_, data []byte) error {
+				var gap Gap
+				if err := json.Unmarshal(data, &gap); err != nil {
+					return err
+				}
+				gaps = append(gaps, &gap)
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// FillGap stores older events of a gap, given newest first, and moves the gap to the given token. The gap is
+// removed once closed, or when no reserved key is left.
+func (hm *HistoryManager) FillGap(gap *Gap, events []*event.Event, from string, closed bool) (stored []*mxevents.Event, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		rid := []byte(gap.RoomID)
+		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
+		eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket(rid)
+		if stream == nil || eventIDs == nil {
+			return ErrRoomNotFound
+		}
+		for _, evt := range events {
+			if gap.Next < gap.Low {
+				debug.Printf("Gap in %s has more events than reserved keys, the oldest ones are left out", gap.RoomID)
+				closed = true
+				break
+			}
+			wrapped := mxevents.Wrap(evt)
+			if err := put(stream, eventIDs, wrapped, gap.Next); err != nil {
+				return err
+			} else if err := trackUndecrypted(tx, gap.RoomID, wrapped); err != nil {
+				return err
+			} else if err := indexEvent(tx, gap.RoomID, wrapped); err != nil {
+				return err
+			} else if err := uncacheEvent(tx, gap.RoomID, wrapped.ID); err != nil {
+				return err
+			}
+			stored = append(stored, wrapped)
+			gap.Next--
+		}
+		if closed {
+			return deleteGap(tx, gap)
+		}
+		gap.From = from
+		return putGap(tx, gap)
+	})
+	return
+}
+
+// Syncer callback for a limited timeline: marks the gap before the timeline is stored and starts filling it
+func (c *ClientWrapper) fillGap(room *rooms.Room, prevBatch string) {
+	if c.history == nil || len(prevBatch) == 0 {
+		return
+	}
+	gap, err := c.history.OpenGap(room, prevBatch)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not mark the gap in the history of " + room.ID.String())
+		return
+	} else if gap == nil {
+		return
+	}
+	debug.Printf("Sync skipped events of %s, filling the gap", room.ID)
+	go c.backfillGaps()
+}
+
+// Fills the open gaps with the events fetched from the server. Interrupted gaps are resumed after the next sync.
+func (c *ClientWrapper) backfillGaps() {
+	defer debug.Recover()
+	if c.history == nil || !c.backfill.TryLock() {
+		return
+	}
+	defer c.backfill.Unlock()
+
+	gaps, err := c.history.Gaps()
+	if err != nil {
+		c.logger.Err(err).Msg("Could not read the gaps in history")
+		return
+	}
+	for _, gap := range gaps {
+		if err = c.backfillGap(gap); err != nil {
+			c.logger.Err(err).Msg("Could not fill the gap in the history of " + gap.RoomID.String())
+			if isConnectivityError(err) {
+				c.connectivity.ReportFailure(err)
+				return
+			}
+		}
+	}
+}
+
+// Fetches the events of a gap backwards until reaching one stored before the gap
+func (c *ClientWrapper) backfillGap(gap *Gap) error {
+	room := c.GetOrCreateRoom(gap.RoomID)
+	for page := 0; page < maxGapPages; page++ {
+		resp, err := c.client.Messages(room.ID, gap.From, "", 'b', nil, gapPageSize)
+		if err != nil {
+			return err
+		}
+
+		var missing []*event.Event
+		closed := len(resp.Chunk) == 0 || len(resp.End) == 0 //reached the start of the room
+		for _, evt := range resp.Chunk {
+			if ptr, err := c.history.Pointer(room, evt.ID); err != nil {
+				missing = append(missing, evt)
+			} else if ptr < gap.Low {
+				closed = true
+				break
+			} //otherwise it arrived after the gap was opened, e.g. delivered offline
+		}
+
+		//our events are kept encrypted for offline delivery, so they are not fetched again one by one
+		ciphertexts := make(map[id.EventID]*event.Event)
+		for _, evt := range missing {
+			if evt.Sender != c.client.UserID || evt.Type != event.EventEncrypted {
+				continue
+			}
+			original := *evt
+			if err = original.Content.ParseRaw(original.Type); err == nil {
+				ciphertexts[evt.ID] = &original
+			}
+		}
+
+		c.prepareServerEvents(room, missing)
+		stored, err := c.history.FillGap(gap, missing, resp.End, closed)
+		if err != nil {
+			return err
+		}
+		c.queueHiddenEvents(room, stored, ciphertexts)
+		if closed {
+			debug.Printf("Gap in %s is filled", room.ID)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Our events hidden by a gap were not in history when parseReadReceipt saw their receipts, so they are queued
+// for offline delivery to the members whose latest read receipt is not at or after them.
+func (c *ClientWrapper) queueHiddenEvents(room *rooms.Room, events []*mxevents.Event, ciphertexts map[id.EventID]*event.Event) {
+	if c.crypto == nil || c.queue == nil {
+		return
+	}
+	var members []id.UserID
+	for _, evt := range events {
+		if evt.Sender != c.client.UserID {
+			continue
+		}
+		if members == nil {
+			joined, err := c.JoinedMembers(room.ID)
+			if err != nil {
+				c.logger.Err(err).Msg("Could not fetch the members of " + room.ID.String())
+				return
+			}
+			for _, user := range joined {
+				if user != c.client.UserID {
+					members = append(members, user)
+				}
+			}
+		}
+		unread := c.unreadBy(room, evt.ID, members)
+		if original := ciphertexts[evt.ID]; original != nil && len(unread) > 0 {
+			c.enqueueDelivery(room.ID, evt.ID, original, unread)
+		} else {
+			c.queueOfflineDelivery(room.ID, evt.ID, unread)
+		}
+	}
+}
+
+// Returns the users whose latest read receipt is not on the event or on a later one in history
+func (c *ClientWrapper) unreadBy(room *rooms.Room, eventID id.EventID, users []id.UserID) (unread []id.UserID) {
+	ptr, err := c.history.Pointer(room, eventID)
+	if err != nil {
+		return users
+	}
+	for _, user := range users {
+		receipt := room.Receipt(user)
+		if len(receipt) > 0 {
+			if read, err := c.history.Pointer(room, receipt); err == nil && read >= ptr {
+				continue
+			}
+		}
+		unread = append(unread, user)
+	}
+	return
+}
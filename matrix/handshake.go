@@ -0,0 +1,119 @@
+package matrix
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+
+	"thesgo/offline/wire"
+)
+
+const challengeNonceSize = 32
+
+// peerConn is a framed offline stream together with the libp2p identities of both of its ends,
+// which are bound into the handshake proofs
+type peerConn struct {
+	*wire.Conn
+	local  peer.ID
+	remote peer.ID
+}
+
+func newPeerConn(s network.Stream) *peerConn {
+	return &peerConn{
+		Conn:   wire.NewConn(s),
+		local:  s.Conn().LocalPeer(),
+		remote: s.Conn().RemotePeer(),
+	}
+}
+
+// Receives the credentials of the other host and checks them against the device stored in the crypto store.
+// Only the stored keys are used afterwards, the ones claimed by the peer are never trusted.
+func (c *ClientWrapper) receiveCredentials(conn *peerConn, peers *PeerStore) (*id.Device, error) {
+	frame, err := conn.Expect(wire.TypeCredentials)
+	if err != nil {
+		return nil, err
+	}
+	var claimed id.Device
+	if err = frame.Decode(&claimed); err != nil {
+		return nil, err
+	}
+
+	hostDevice, err := c.crypto.CryptoStore.GetDevice(claimed.UserID, claimed.DeviceID)
+	if err != nil {
+		return nil, err
+	} else if hostDevice == nil || (claimed.SigningKey != "" && claimed.SigningKey != hostDevice.SigningKey) {
+		c.logger.Info().Msg("Host device " + claimed.DeviceID.String() + " of " + claimed.UserID.String() + " is unknown")
+		_ = conn.Encode(wire.TypeError, &wire.Error{Code: wire.ErrCodeUnknownDevice, Message: "device is not known"})
+		return nil, fmt.Errorf("device %s of %s is not known", claimed.DeviceID, claimed.UserID)
+	}
+
+	//the peer ID must be the one published by that device
+	binding, err := peers.Get(conn.remote)
+	if err != nil {
+		return nil, err
+	} else if binding == nil || binding.UserID != hostDevice.UserID || binding.DeviceID != hostDevice.DeviceID {
+		c.logger.Info().Msg("Peer " + conn.remote.String() + " is not pinned to device " + hostDevice.DeviceID.String())
+		_ = conn.Encode(wire.TypeError, &wire.Error{Code: wire.ErrCodeUnknownPeer, Message: "peer is not bound to this device"})
+		return nil, fmt.Errorf("peer %s is not bound to device %s of %s", conn.remote, hostDevice.DeviceID, hostDevice.UserID)
+	}
+
+	//Should be safe to call both on and offline, cross-signatures are read from the crypto store
+	if trusted := c.isDeviceTrusted(hostDevice); !trusted {
+		c.logger.Info().Msg("Host device is not trusted")
+		_ = conn.Encode(wire.TypeError, &wire.Error{Code: wire.ErrCodeUntrustedDevice, Message: "device is not trusted"})
+		return nil, fmt.Errorf("device %s of %s is not trusted", hostDevice.DeviceID, hostDevice.UserID)
+	}
+	return hostDevice, nil
+}
+
+// Challenges the other host to prove that it holds the signing key of the device it presented
+func (c *ClientWrapper) challengeHost(conn *peerConn, hostDevice *id.Device) error {
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := conn.Encode(wire.TypeChallenge, &wire.Challenge{Nonce: nonce}); err != nil {
+		return err
+	}
+
+	frame, err := conn.Expect(wire.TypeProof)
+	if err != nil {
+		return err
+	}
+	var proof wire.Proof
+	if err = frame.Decode(&proof); err != nil {
+		return err
+	}
+
+	msg := wire.ProofMessage(nonce, conn.remote.String(), conn.local.String(), hostDevice.UserID, hostDevice.DeviceID)
+	ok, err := olm.NewUtility().VerifySignature(msg, hostDevice.SigningKey, proof.Signature)
+	if err != nil || !ok {
+		c.logger.Info().Msg("Host device " + hostDevice.DeviceID.String() + " failed to prove its identity")
+		_ = conn.Encode(wire.TypeError, &wire.Error{Code: wire.ErrCodeInvalidProof, Message: "signature does not match device key"})
+		return fmt.Errorf("device %s of %s sent an invalid proof", hostDevice.DeviceID, hostDevice.UserID)
+	}
+	return nil
+}
+
+// Answers the challenge of the other host by signing it with our own device key
+func (c *ClientWrapper) proveIdentity(conn *peerConn) error {
+	frame, err := conn.Expect(wire.TypeChallenge)
+	if err != nil {
+		return err
+	}
+	var challenge wire.Challenge
+	if err = frame.Decode(&challenge); err != nil {
+		return err
+	}
+	if len(challenge.Nonce) < challengeNonceSize {
+		return fmt.Errorf("challenge nonce is too short")
+	}
+
+	msg := wire.ProofMessage(challenge.Nonce, conn.local.String(), conn.remote.String(), c.client.UserID, c.client.DeviceID)
+	signature := c.crypto.GetAccount().Internal.Sign([]byte(msg))
+	return conn.Encode(wire.TypeProof, &wire.Proof{Signature: string(signature)})
+}
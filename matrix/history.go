@@ -4,9 +4,12 @@ package matrix
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"strings"
+	"time"
 
 	"thesgo/matrix/mxevents"
 	"thesgo/matrix/rooms"
@@ -18,24 +21,26 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// HistoryManager stores the events of each room in a stream, keyed by position. Events received through sync
+// are appended after halfUint64 and older events fetched from the server are prepended below it, so the keys
+// always follow the order of the timeline and are used as pointers to paginate through it.
 type HistoryManager struct {
 	sync.Mutex
 
 	db *bolt.DB
-
-	historyEndPtr map[*rooms.Room]uint64
 }
 
 var bucketRoomStreams = []byte("room_streams")
 var bucketRoomEventIDs = []byte("room_event_ids")
-var bucketStreamPointers = []byte("room_stream_pointers")
+var bucketStreamPointers = []byte("room_stream_pointers") //room ID -> key of the oldest event prepended to the stream
+var bucketUndecrypted = []byte("undecrypted_events")      //megolm session ID -> event ID -> room ID
+var bucketRelayed = []byte("relayed_events")              //event ID -> expiry of events carried for other users
+var bucketLocalEchoes = []byte("local_echoes")            //hash of megolm ciphertext -> room ID and temporary ID of an event sent offline
 
 const halfUint64 = ^uint64(0) >> 1
 
 func NewHistoryManager(dbPath string) (*HistoryManager, error) {
-	hm := &HistoryManager{
-		historyEndPtr: make(map[*rooms.Room]uint64),
-	}
+	hm := &HistoryManager{}
 	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
 		Timeout:      1,
 		NoGrowSync:   false,
@@ -45,6 +50,7 @@ func NewHistoryManager(dbPath string) (*HistoryManager, error) {
 		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
+		reindex := tx.Bucket(bucketSearchDocs) == nil
 		_, err = tx.CreateBucketIfNotExists(bucketRoomStreams)
 		if err != nil {
 			return err
@@ -57,6 +63,37 @@ func NewHistoryManager(dbPath string) (*HistoryManager, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(bucketUndecrypted)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketRelayed)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketLocalEchoes)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketSearchTerms)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketSearchDocs)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketCachedEvents)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketGaps)
+		if err != nil {
+			return err
+		}
+		if reindex {
+			return reindexHistory(tx)
+		}
 		return nil
 	})
 	if err != nil {
@@ -108,6 +145,8 @@ func (hm *HistoryManager) Get(room *rooms.Room, eventID id.EventID) (evt *mxeven
 	return
 }
 
+// Update changes a stored event in place. The update may also change the ID of the event, e.g. to replace the
+// temporary ID of an event sent offline with the one given by the server, and the event is indexed again.
 func (hm *HistoryManager) Update(room *rooms.Room, eventID id.EventID, update func(evt *mxevents.Event) error) error {
 	return hm.db.Update(func(tx *bolt.Tx) error {
 		if stream, index, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(eventID)); err != nil {
@@ -120,9 +159,118 @@ func (hm *HistoryManager) Update(room *rooms.Room, eventID id.EventID, update fu
 			return err
 		} else if err := stream.Put(index, eventData); err != nil {
 			return err
+		} else if err := trackUndecrypted(tx, room.ID, evt); err != nil {
+			return err
+		} else if err := unindexEvent(tx, room.ID, eventID); err != nil {
+			return err
+		} else if err := indexEvent(tx, room.ID, evt); err != nil {
+			return err
+		} else if evt.ID != eventID {
+			eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket([]byte(room.ID))
+			if err = eventIDs.Delete([]byte(eventID)); err != nil {
+				return err
+			}
+			return eventIDs.Put([]byte(evt.ID), index)
+		}
+		return nil
+	})
+}
+
+// Undecrypted returns the stored events that could not be decrypted for lack of the given megolm session,
+// mapped to their rooms
+func (hm *HistoryManager) Undecrypted(sessionID id.SessionID) (events map[id.EventID]id.RoomID, err error) {
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketUndecrypted).Bucket([]byte(sessionID))
+		if bucket == nil {
+			return nil
+		}
+		events = make(map[id.EventID]id.RoomID)
+		return bucket.ForEach(func(k, v []byte) error {
+			events[id.EventID(k)] = id.RoomID(v)
+			return nil
+		})
+	})
+	return
+}
+
+// ForgetUndecrypted removes an event from the ones waiting for a megolm session
+func (hm *HistoryManager) ForgetUndecrypted(sessionID id.SessionID, eventID id.EventID) error {
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		return forgetUndecrypted(tx, sessionID, eventID)
+	})
+}
+
+func forgetUndecrypted(tx *bolt.Tx, sessionID id.SessionID, eventID id.EventID) error {
+	sessions := tx.Bucket(bucketUndecrypted)
+	bucket := sessions.Bucket([]byte(sessionID))
+	if bucket == nil {
+		return nil
+	} else if err := bucket.Delete([]byte(eventID)); err != nil {
+		return err
+	}
+	if k, _ := bucket.Cursor().First(); k == nil {
+		return sessions.DeleteBucket([]byte(sessionID))
+	}
+	return nil
+}
+
+// MarkRelayed records that an event was accepted for relaying until it expires. It returns false if the event
+// was already seen, so the same event is never carried twice when it comes back through another path.
+// Expired entries are swept by DeliveryQueue.DropExpired.
+func (hm *HistoryManager) MarkRelayed(eventID id.EventID, expires time.Time) (fresh bool, err error) {
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRelayed)
+		if v := bucket.Get([]byte(eventID)); len(v) == 8 && time.Now().Before(time.UnixMilli(int64(btoi(v)))) {
+			return nil
+		}
+		fresh = true
+		return bucket.Put([]byte(eventID), itob(uint64(expires.UnixMilli())))
+	})
+	return
+}
+
+func localEchoKey(content *event.EncryptedEventContent) []byte {
+	hash := sha256.Sum256(content.MegolmCiphertext)
+	return hash[:]
+}
+
+// TrackLocalEcho remembers the megolm ciphertext of an event that was sent offline under a temporary ID,
+// so the copy uploaded to the server later can be recognised when it is synced
+func (hm *HistoryManager) TrackLocalEcho(roomID id.RoomID, eventID id.EventID, content *event.EncryptedEventContent) error {
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLocalEchoes).Put(localEchoKey(content), []byte(roomID.String()+"|"+eventID.String()))
+	})
+}
+
+// LocalEcho returns the event stored with the same megolm ciphertext, if it was sent offline
+func (hm *HistoryManager) LocalEcho(content *event.EncryptedEventContent) (roomID id.RoomID, eventID id.EventID, err error) {
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketLocalEchoes).Get(localEchoKey(content)); v != nil {
+			room, evt, _ := strings.Cut(string(v), "|")
+			roomID, eventID = id.RoomID(room), id.EventID(evt)
 		}
 		return nil
 	})
+	return
+}
+
+func (hm *HistoryManager) ForgetLocalEcho(content *event.EncryptedEventContent) error {
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLocalEchoes).Delete(localEchoKey(content))
+	})
+}
+
+// Indexes the events that could not be decrypted by the megolm session they need
+func trackUndecrypted(tx *bolt.Tx, roomID id.RoomID, evt *mxevents.Event) error {
+	content, ok := evt.Content.Parsed.(*mxevents.BadEncryptedContent)
+	if evt.Type != mxevents.EventBadEncrypted || !ok || content.Original == nil || content.Original.SessionID == "" {
+		return nil
+	}
+	bucket, err := tx.Bucket(bucketUndecrypted).CreateBucketIfNotExists([]byte(content.Original.SessionID))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(evt.ID), []byte(roomID))
 }
 
 func (hm *HistoryManager) Append(room *rooms.Room, events []*event.Event) ([]*mxevents.Event, error) {
@@ -166,34 +314,35 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append
 				newEvents[i] = mxevents.Wrap(evt)
 				if err := put(stream, eventIDs, newEvents[i], ptrStart+uint64(i)); err != nil {
 					return err
+				} else if err := trackUndecrypted(tx, room.ID, newEvents[i]); err != nil {
+					return err
+				} else if err := indexEvent(tx, room.ID, newEvents[i]); err != nil {
+					return err
+				} else if err := uncacheEvent(tx, room.ID, newEvents[i].ID); err != nil {
+					return err
 				}
 			}
 			err = stream.SetSequence(ptrStart + uint64(len(events)) - 1)
 			if err != nil {
 				return err
 			}
-		} else {
-			ptrStart, ok := hm.historyEndPtr[room]
-			if !ok {
-				ptrStartRaw := streamPointers.Get(rid)
-				if ptrStartRaw != nil {
-					ptrStart = btoi(ptrStartRaw)
-				} else {
-					ptrStart = halfUint64 - 1
-				}
-			}
-			eventCount := uint64(len(events))
+		} else if len(events) > 0 {
+			//the events are given newest first, each one is stored right below the previous
+			ptrStart := prependStart(stream, streamPointers.Get(rid))
 			for i, evt := range events {
 				newEvents[i] = mxevents.Wrap(evt)
-				if err := put(stream, eventIDs, newEvents[i], -ptrStart-uint64(i)); err != nil {
+				if err := put(stream, eventIDs, newEvents[i], ptrStart-uint64(i)); err != nil {
+					return err
+				} else if err := trackUndecrypted(tx, room.ID, newEvents[i]); err != nil {
+					return err
+				} else if err := indexEvent(tx, room.ID, newEvents[i]); err != nil {
+					return err
+				} else if err := uncacheEvent(tx, room.ID, newEvents[i].ID); err != nil {
 					return err
 				}
 			}
-			hm.historyEndPtr[room] = ptrStart + eventCount
-			// TODO this is not the correct value for newPtrStart, figure out what the f*ck is going on here
-			newPtrStart = ptrStart + eventCount
-			err := streamPointers.Put(rid, itob(ptrStart+eventCount))
-			if err != nil {
+			newPtrStart = ptrStart - uint64(len(events)-1)
+			if err := streamPointers.Put(rid, itob(newPtrStart)); err != nil {
 				return err
 			}
 		}
@@ -203,44 +352,95 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append
 	return
 }
 
+// Key under which the next older event is prepended: right below the oldest stored event. The pointer
+// written by older versions is ignored, as it did not follow this layout.
+func prependStart(stream *bolt.Bucket, oldest []byte) uint64 {
+	if oldest != nil && btoi(oldest) < halfUint64 {
+		return btoi(oldest) - 1
+	}
+	start := halfUint64 - 1
+	if k, _ := stream.Cursor().First(); k != nil && btoi(k)-1 < start {
+		start = btoi(k) - 1
+	}
+	return start
+}
+
+// Load returns up to num events older than the given pointer, newest first, and the pointer to continue
+// from. The newest events are returned if the pointer is 0.
 func (hm *HistoryManager) Load(room *rooms.Room, num int, ptrStart uint64) (events []*mxevents.Event, newPtrStart uint64, err error) {
 	hm.Lock()
 	defer hm.Unlock()
+	newPtrStart = ptrStart
 	err = hm.db.View(func(tx *bolt.Tx) error {
 		stream := tx.Bucket(bucketRoomStreams).Bucket([]byte(room.ID))
 		if stream == nil {
 			return nil
 		}
+		c := stream.Cursor()
+		var k, v []byte
 		if ptrStart == 0 {
-			ptrStart = stream.Sequence() + 1
+			k, v = c.Last()
+		} else if k, _ = c.Seek(itob(ptrStart)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
 		}
-		c := stream.Cursor()
-		k, v := c.Seek(itob(ptrStart - uint64(num)))
-		ptrStartFound := btoi(k)
-		if k == nil || ptrStartFound >= ptrStart {
+		for ; k != nil && len(events) < num; k, v = c.Prev() {
+			evt, parseError := unmarshalEvent(v)
+			if parseError != nil {
+				return parseError
+			}
+			events = append(events, evt)
+			newPtrStart = btoi(k)
+		}
+		return nil
+	})
+	return
+}
+
+// LoadAfter returns up to num events newer than the given pointer, newest first, and the pointer to the
+// newest of them to continue forward from
+func (hm *HistoryManager) LoadAfter(room *rooms.Room, num int, ptrEnd uint64) (events []*mxevents.Event, newPtrEnd uint64, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	newPtrEnd = ptrEnd
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		stream := tx.Bucket(bucketRoomStreams).Bucket([]byte(room.ID))
+		if stream == nil {
 			return nil
 		}
-		newPtrStart = ptrStartFound
-		for ; k != nil && btoi(k) < ptrStart; k, v = c.Next() {
+		c := stream.Cursor()
+		k, v := c.Seek(itob(ptrEnd + 1))
+		for ; k != nil && len(events) < num; k, v = c.Next() {
 			evt, parseError := unmarshalEvent(v)
 			if parseError != nil {
 				return parseError
 			}
 			events = append(events, evt)
+			newPtrEnd = btoi(k)
 		}
 		return nil
 	})
-	// Reverse array because we read/append the history in reverse order.
-	i := 0
-	j := len(events) - 1
-	for i < j {
+	// Reverse array to return the newest events first, like Load
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
 		events[i], events[j] = events[j], events[i]
-		i++
-		j--
 	}
 	return
 }
 
+// Pointer returns the position of an event in the stream of its room, to paginate from it
+func (hm *HistoryManager) Pointer(room *rooms.Room, eventID id.EventID) (ptr uint64, err error) {
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		_, index, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(eventID))
+		if err != nil {
+			return err
+		}
+		ptr = btoi(index)
+		return nil
+	})
+	return
+}
+
 func itob(v uint64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, v)
@@ -0,0 +1,181 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// A room key request we sent and that was not answered yet
+type outgoingKeyRequest struct {
+	RequestID string
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	Users     []id.UserID //the request goes to every device of these users
+	Sent      time.Time
+}
+
+// KeyRequests keeps track of the outstanding room key requests, by megolm session ID.
+// A session is only requested once, until its key arrives and the request is cancelled.
+type KeyRequests struct {
+	lock      sync.Mutex
+	bySession map[id.SessionID]*outgoingKeyRequest
+}
+
+func NewKeyRequests() *KeyRequests {
+	return &KeyRequests{bySession: make(map[id.SessionID]*outgoingKeyRequest)}
+}
+
+// add returns false if the session is already being requested
+func (kr *KeyRequests) add(sessionID id.SessionID, req *outgoingKeyRequest) bool {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	if _, ok := kr.bySession[sessionID]; ok {
+		return false
+	}
+	kr.bySession[sessionID] = req
+	return true
+}
+
+// take removes and returns the request of a session, nil if there is none
+func (kr *KeyRequests) take(sessionID id.SessionID) *outgoingKeyRequest {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	req := kr.bySession[sessionID]
+	delete(kr.bySession, sessionID)
+	return req
+}
+
+// Asks the devices of the sender and our own other devices for the megolm session of an event that could not
+// be decrypted because we do not have its session
+func (c *ClientWrapper) requestMissingKey(roomID id.RoomID, sender id.UserID, content *event.EncryptedEventContent, decryptErr error) {
+	if content == nil || !errors.Is(decryptErr, crypto.NoSessionFound) {
+		return
+	}
+	keyReq := c.buildKeyRequest(roomID, content.SenderKey, content.SessionID)
+	users := []id.UserID{c.client.UserID}
+	if sender != c.client.UserID {
+		users = append(users, sender)
+	}
+	req := &outgoingKeyRequest{
+		RequestID: keyReq.RequestID,
+		RoomID:    roomID,
+		SenderKey: content.SenderKey,
+		Users:     users,
+		Sent:      time.Now(),
+	}
+	if !c.keyRequests.add(content.SessionID, req) {
+		return
+	}
+	if err := c.sendKeyRequest(users, keyReq); err != nil {
+		c.keyRequests.take(content.SessionID)
+		c.logger.Err(err).Msg("Could not request the key of session " + content.SessionID.String())
+		return
+	}
+	debug.Printf("Requested session %s of %s from %v", content.SessionID, roomID, users)
+}
+
+// Cancels the request of a session whose key arrived, so the other devices stop answering it
+func (c *ClientWrapper) cancelKeyRequest(sessionID id.SessionID) {
+	req := c.keyRequests.take(sessionID)
+	if req == nil {
+		return
+	}
+	cancel := &event.RoomKeyRequestEventContent{
+		Action:             event.KeyRequestActionCancel,
+		RequestID:          req.RequestID,
+		RequestingDeviceID: c.client.DeviceID,
+	}
+	if err := c.sendKeyRequest(req.Users, cancel); err != nil {
+		c.logger.Err(err).Msg("Could not cancel the request of session " + sessionID.String())
+		return
+	}
+	debug.Printf("Cancelled request %s, session %s arrived after %s", req.RequestID, sessionID, time.Since(req.Sent))
+}
+
+// Sends a key request or cancellation to every device of the given users
+func (c *ClientWrapper) sendKeyRequest(users []id.UserID, content *event.RoomKeyRequestEventContent) error {
+	req := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content, len(users))}
+	for _, user := range users {
+		req.Messages[user] = map[id.DeviceID]*event.Content{"*": {Parsed: content}}
+	}
+	_, err := c.client.SendToDevice(event.ToDeviceRoomKeyRequest, req)
+	return err
+}
+
+// Decides if a device may receive a session it requested. Our own devices get it if we trust them enough,
+// other users only get the sessions we created in rooms they are joined to, and only on trusted devices.
+// An empty code means the key can be forwarded, otherwise it is the reason sent in the withheld notice.
+func (c *ClientWrapper) keyRequestDecision(device *id.Device, body event.RequestedKeyInfo) (event.RoomKeyWithheldCode, string) {
+	trust := c.ResolveTrust(device)
+	if trust == id.TrustStateBlacklisted {
+		return event.RoomKeyWithheldBlacklisted, "Device is blacklisted"
+	} else if trust < c.minTrust() {
+		return event.RoomKeyWithheldUnverified, "This device does not forward keys to unverified devices"
+	} else if device.UserID == c.client.UserID {
+		return "", ""
+	}
+
+	if body.SenderKey != c.crypto.OwnIdentity().IdentityKey {
+		return event.RoomKeyWithheldUnauthorized, "Only the sender of a session forwards it to other users"
+	}
+	member := c.GetOrCreateRoom(body.RoomID).GetMember(device.UserID)
+	if member == nil || member.Membership != event.MembershipJoin {
+		return event.RoomKeyWithheldUnauthorized, "User is not in the room"
+	}
+	return "", ""
+}
+
+// HandleKeyRequest answers the room key requests of other devices. The crypto machine is told to stay silent
+// (see ignoreKeyRequest) so that every request is answered here with the decision of keyRequestDecision.
+func (c *ClientWrapper) HandleKeyRequest(_ mautrix.EventSource, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.RoomKeyRequestEventContent)
+	if !ok || content.Action != event.KeyRequestActionRequest {
+		return
+	} else if evt.Sender == c.client.UserID && content.RequestingDeviceID == c.client.DeviceID {
+		return
+	}
+	go func() {
+		defer debug.Recover()
+		device, err := c.crypto.GetOrFetchDevice(context.TODO(), evt.Sender, content.RequestingDeviceID)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not fetch device " + content.RequestingDeviceID.String() + " that requested a key")
+			return
+		}
+
+		code, reason := c.keyRequestDecision(device, content.Body)
+		if code == "" {
+			forwardedRoomKey, err := c.parseKeyRequestEvent(content)
+			if err == nil {
+				err = c.crypto.SendEncryptedToDevice(context.TODO(), device, event.ToDeviceForwardedRoomKey, forwardedRoomKey)
+				if err != nil {
+					c.logger.Err(err).Msg("Could not forward session " + content.Body.SessionID.String())
+					return
+				}
+				debug.Printf("Forwarded session %s to device %s of %s", content.Body.SessionID, device.DeviceID, device.UserID)
+				return
+			}
+			code, reason = event.RoomKeyWithheldUnavailable, "Session is not available"
+		}
+
+		c.logger.Info().Msg("Refused the request of device " + device.DeviceID.String() + " of " + device.UserID.String() + " for session " + content.Body.SessionID.String() + ": " + reason)
+		req := &mautrix.ReqSendToDevice{Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			device.UserID: {device.DeviceID: {Parsed: withheldNotice(content.Body, code, reason)}},
+		}}
+		if _, err = c.client.SendToDevice(event.ToDeviceRoomKeyWithheld, req); err != nil {
+			c.logger.Err(err).Msg("Could not send withheld notice")
+		}
+	}()
+}
+
+// Hook of the crypto machine for incoming key requests, which are answered by HandleKeyRequest instead
+func (c *ClientWrapper) ignoreKeyRequest(context.Context, *id.Device, event.RequestedKeyInfo) *crypto.KeyShareRejection {
+	return &crypto.KeyShareRejectNoResponse
+}
@@ -0,0 +1,42 @@
+package matrix
+
+import (
+	"fmt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/crypto"
+)
+
+// ExportKeys dumps every inbound megolm session of the crypto store in the passphrase protected
+// MEGOLM SESSION DATA format, which other Matrix clients can import as well
+func (c *ClientWrapper) ExportKeys(passphrase string) ([]byte, error) {
+	if c.crypto == nil {
+		return nil, fmt.Errorf("encryption is not enabled")
+	}
+	sessions, err := c.crypto.CryptoStore.GetAllGroupSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	} else if len(sessions) == 0 {
+		return nil, fmt.Errorf("there are no room keys to export")
+	}
+	data, err := crypto.ExportKeys(passphrase, sessions)
+	if err != nil {
+		return nil, err
+	}
+	debug.Printf("Exported %d room keys", len(sessions))
+	return data, nil
+}
+
+// ImportKeys stores the sessions of a MEGOLM SESSION DATA export, keeping the copies already known
+// when they can decrypt earlier messages. Returns the number of imported sessions and the number in the file.
+func (c *ClientWrapper) ImportKeys(data []byte, passphrase string) (int, int, error) {
+	if c.crypto == nil {
+		return 0, 0, fmt.Errorf("encryption is not enabled")
+	}
+	imported, total, err := c.crypto.ImportKeys(passphrase, data)
+	if err != nil {
+		return imported, total, err
+	}
+	debug.Printf("Imported %d of %d room keys", imported, total)
+	return imported, total, nil
+}
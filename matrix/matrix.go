@@ -2,15 +2,13 @@
 package matrix
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime"
 	dbg "runtime/debug"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -20,15 +18,8 @@ import (
 	"thesgo/matrix/rooms"
 	"thesgo/offline"
 
-	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
-	"golang.org/x/exp/slices"
-
-	"github.com/libp2p/go-libp2p"
 	cryp "github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
-	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
-
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/rs/zerolog"
 
 	"maunium.net/go/gomuks/debug"
@@ -45,6 +36,21 @@ type ClientWrapper struct {
 
 	history *HistoryManager //responsible for storing event history
 
+	data *DataStore //state that must survive clearing the cache, kept in the data directory
+
+	queue *DeliveryQueue //events still waiting to be delivered offline
+
+	outbox *Outbox //events sent while disconnected, waiting to be uploaded to the homeserver
+
+	peers *PeerStore //libp2p peer IDs pinned to the matrix devices behind them
+
+	preKeys *PreKeyCache //keys claimed for peer devices, to start olm sessions with them offline
+
+	keyBackup *KeyBackup //inbound megolm sessions waiting to be uploaded to the server-side key backup
+
+	peerKey cryp.PrivKey //persistent identity of the offline host
+	peerID  peer.ID
+
 	crypto *crypto.OlmMachine //Main struct to handle Matrix E2EE
 
 	config *config.Config // persist user account information and configurations
@@ -53,11 +59,24 @@ type ClientWrapper struct {
 
 	running bool
 
-	disconnected bool
+	connectivity    *Connectivity //state of the connection to the homeserver
+	versionsPending bool          //the homeserver was unreachable at startup, so its versions are checked by the first probe
+
+	backfill sync.Mutex //held while the gaps left in history by limited syncs are filled
+
+	receiptLock     sync.Mutex
+	pendingReceipts map[id.RoomID]id.EventID //read receipts that could not be sent while offline
 
 	stop chan bool
 
-	sendOff chan offlineData
+	stopOffline chan struct{} //closed by Stop to end the offline routine
+
+	sendOff chan struct{} //wakes up the offline routine whenever a new delivery is queued
+
+	verifications *VerificationRegistry //every SAS verification since the client started
+	confirmer     Confirmer             //asks the user whether the SAS of a verification match
+
+	keyRequests *KeyRequests //megolm sessions we asked other devices for
 }
 
 var MinSpecVersion = mautrix.SpecV11
@@ -72,9 +91,12 @@ var (
 func NewWrapper(conf *config.Config) *ClientWrapper {
 
 	c := &ClientWrapper{
-		config:       conf,
-		running:      false,
-		disconnected: false,
+		config:        conf,
+		running:       false,
+		connectivity:  NewConnectivity(),
+		verifications: NewVerificationRegistry(),
+		keyRequests:   NewKeyRequests(),
+		confirmer:     StdinConfirmer{},
 	}
 
 	return c
@@ -103,9 +125,16 @@ func (c *ClientWrapper) InitClient(isStartup bool) error {
 
 	var err error
 	if mxid.String() != "" && len(accessToken) > 0 {
-		c.client, err = mautrix.NewClient("https://lpgains.duckdns.org", mxid, accessToken)
+		var homeserver string
+		homeserver, err = c.resolveHomeserver(mxid)
+		if err != nil {
+			c.logger.Error().Msg("failed to resolve homeserver: " + err.Error())
+			return err
+		}
+		c.client, err = mautrix.NewClient(homeserver, mxid, accessToken)
 	} else {
-		c.client, err = mautrix.NewClient("https://lpgains.duckdns.org", "", "")
+		//the homeserver may still be unknown at this point, Login resolves it before talking to the server
+		c.client, err = mautrix.NewClient(c.config.Homeserver, "", "")
 	}
 
 	if err != nil {
@@ -114,7 +143,6 @@ func (c *ClientWrapper) InitClient(isStartup bool) error {
 		return fmt.Errorf("failed to create mautrix client: %w", err)
 	}
 
-	c.disconnected = false
 	c.client.Log = c.initLogger()
 	c.client.DeviceID = c.config.DeviceID
 
@@ -130,6 +158,68 @@ func (c *ClientWrapper) InitClient(isStartup bool) error {
 			c.logger.Err(err).Msg("failed to initialize history")
 			return fmt.Errorf("failed to initialize history: %w", err)
 		}
+		go c.runPruner(c.history)
+	}
+
+	if c.data == nil {
+		c.data, err = NewDataStore(c.config.DataPath)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to initialize data store")
+			return fmt.Errorf("failed to initialize data store: %w", err)
+		}
+	}
+
+	if c.queue == nil {
+		c.queue, err = NewDeliveryQueue(c.history, c.config.Offline.RetryBase, c.config.Offline.RetryMax)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to initialize offline delivery queue")
+			return fmt.Errorf("failed to initialize offline delivery queue: %w", err)
+		}
+	}
+
+	if c.outbox == nil {
+		c.outbox, err = NewOutbox(c.data)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to initialize outbox")
+			return fmt.Errorf("failed to initialize outbox: %w", err)
+		}
+	}
+
+	if c.peers == nil {
+		c.peers, err = NewPeerStore(c.data)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to initialize peer store")
+			return fmt.Errorf("failed to initialize peer store: %w", err)
+		}
+	}
+
+	if c.preKeys == nil {
+		c.preKeys, err = NewPreKeyCache(c.history)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to initialize prekey cache")
+			return fmt.Errorf("failed to initialize prekey cache: %w", err)
+		}
+	}
+
+	if c.keyBackup == nil && c.crypto != nil {
+		c.keyBackup, err = NewKeyBackup(c.history)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to initialize key backup")
+			return fmt.Errorf("failed to initialize key backup: %w", err)
+		}
+		go c.runKeyBackup(c.keyBackup)
+	}
+
+	if c.peerKey == nil {
+		c.peerKey, err = offline.LoadIdentity(c.config.PeerKeyPath)
+		if err != nil {
+			c.logger.Err(err).Msg("failed to load offline host identity")
+			return fmt.Errorf("failed to load offline host identity: %w", err)
+		}
+		c.peerID, err = peer.IDFromPrivateKey(c.peerKey)
+		if err != nil {
+			return fmt.Errorf("failed to derive offline peer ID: %w", err)
+		}
 	}
 
 	/*allowInsecure := len(os.Getenv("CLIENT_ALLOW_INSECURE_CONNECTIONS")) > 0
@@ -139,35 +229,30 @@ func (c *ClientWrapper) InitClient(isStartup bool) error {
 		}
 	}*/ //just in case, but probably will not be necessary
 
+	c.versionsPending = false
 	if !SkipVersionCheck && (!isStartup || len(c.client.AccessToken) > 0) { //sanity check
-		debug.Printf("Checking versions that %s supports", c.client.HomeserverURL)
-		resp, err := c.client.Versions()
-		if err != nil {
-			debug.Print("Error checking supported versions")
-			return fmt.Errorf("failed to check server versions: %w", err)
-		} else if !resp.ContainsGreaterOrEqual(MinSpecVersion) {
-			debug.Print("Server doesn't support modern spec versions.")
-			bestVersionStr := "nothing"
-			bestVersion := mautrix.MustParseSpecVersion("r0.0.0")
-			for _, ver := range resp.Versions {
-				if ver.GreaterThan(bestVersion) {
-					bestVersion = ver
-					bestVersionStr = ver.String()
-				}
+		if err := c.checkVersions(); err != nil {
+			if len(c.client.AccessToken) == 0 || !isConnectivityError(err) {
+				return err
 			}
-			return fmt.Errorf("%w (it only supports %s, while this client requires %s)", ErrServerOutdated, bestVersionStr, MinSpecVersion.String())
-		} else {
-			debug.Print("Server supports modern spec versions")
+			//the stored session is enough to start: messages are kept for later and peers are still in reach
+			c.logger.Warn().Msg("Homeserver unreachable, starting offline")
+			c.connectivity.MarkOffline()
+			c.versionsPending = true
 		}
 	}
 
 	c.stop = make(chan bool, 1)
-	c.sendOff = make(chan offlineData) //possibly making this a buffered channel might be good
+	c.sendOff = make(chan struct{}, 1)
 
 	if len(accessToken) > 0 {
 		go c.Start()
 	}
-	go c.runOffline() //start routine to open a host for listening and/or sending offline comms
+	if c.config.Offline.Enabled {
+		//start routine to open a host for listening and/or sending offline comms
+		c.stopOffline = make(chan struct{})
+		go c.runOffline(c.stopOffline, &offlineStores{history: c.history, queue: c.queue, peers: c.peers})
+	}
 
 	return nil
 }
@@ -186,7 +271,54 @@ func (c *ClientWrapper) IsStopped() chan bool {
 }
 
 func (c *ClientWrapper) IsOffline() bool {
-	return c.disconnected
+	return c.connectivity.State() == StateOffline
+}
+
+// Connectivity returns the monitor of the connection to the homeserver, to subscribe to its changes
+func (c *ClientWrapper) Connectivity() *Connectivity {
+	return c.connectivity
+}
+
+// Probes the homeserver with a cheap unauthenticated request
+// The versions check skipped at startup while offline is made by the first probe that reaches the homeserver.
+// The client stops if the homeserver turns out to be outdated.
+func (c *ClientWrapper) probeHomeserver() error {
+	if !c.versionsPending {
+		_, err := c.client.Versions()
+		return err
+	}
+	err := c.checkVersions()
+	if errors.Is(err, ErrServerOutdated) {
+		c.logger.Err(err).Msg("Stopping the client")
+		go c.Stop()
+		return nil
+	} else if err == nil {
+		c.versionsPending = false
+	}
+	return err
+}
+
+// Checks that the homeserver supports the spec versions this client requires
+func (c *ClientWrapper) checkVersions() error {
+	debug.Printf("Checking versions that %s supports", c.client.HomeserverURL)
+	resp, err := c.client.Versions()
+	if err != nil {
+		debug.Print("Error checking supported versions")
+		return fmt.Errorf("failed to check server versions: %w", err)
+	} else if !resp.ContainsGreaterOrEqual(MinSpecVersion) {
+		debug.Print("Server doesn't support modern spec versions.")
+		bestVersionStr := "nothing"
+		bestVersion := mautrix.MustParseSpecVersion("r0.0.0")
+		for _, ver := range resp.Versions {
+			if ver.GreaterThan(bestVersion) {
+				bestVersion = ver
+				bestVersionStr = ver.String()
+			}
+		}
+		return fmt.Errorf("%w (it only supports %s, while this client requires %s)", ErrServerOutdated, bestVersionStr, MinSpecVersion.String())
+	}
+	debug.Print("Server supports modern spec versions")
+	return nil
 }
 
 // Initialized returns whether or not the matrix client is initialized, i.e., has been instantiated
@@ -194,8 +326,48 @@ func (c *ClientWrapper) Initialized() bool {
 	return c.running
 }
 
-// Login sends a password login request with the given username and password.
-func (c *ClientWrapper) Login(user, password string) error {
+// Resolves the base URL of the homeserver, either from the config or through the .well-known
+// discovery of the server name of the given user, persisting it in the config when discovered.
+// The URL in the config is only used for the server it was resolved for, or for any if that is unknown.
+func (c *ClientWrapper) resolveHomeserver(mxid id.UserID) (string, error) {
+	_, serverName, _ := mxid.Parse()
+	if len(c.config.Homeserver) > 0 && (len(c.config.HomeserverName) == 0 || len(serverName) == 0 || c.config.HomeserverName == serverName) {
+		return c.config.Homeserver, nil
+	} else if len(serverName) == 0 {
+		return "", ErrNoHomeserver
+	}
+
+	homeserver := "https://" + serverName
+	wellKnown, err := mautrix.DiscoverClientAPI(serverName)
+	if err != nil {
+		c.logger.Warn().Msg("could not discover the homeserver of " + serverName + ": " + err.Error())
+	} else if wellKnown != nil && len(wellKnown.Homeserver.BaseURL) > 0 {
+		homeserver = wellKnown.Homeserver.BaseURL
+	}
+
+	c.config.Homeserver = homeserver
+	c.config.HomeserverName = serverName
+	c.config.Save()
+	return homeserver, nil
+}
+
+// Login sends a password login request with the given username and password. The homeserver is the given
+// one if not empty, otherwise it is taken from the config or discovered from the user ID.
+func (c *ClientWrapper) Login(user, password, homeserver string) error {
+	if len(homeserver) > 0 {
+		c.config.Homeserver = homeserver
+		c.config.HomeserverName = id.UserID(user).Homeserver()
+	}
+	homeserver, err := c.resolveHomeserver(id.UserID(user))
+	if err != nil {
+		c.logger.Error().Msg("could not resolve the homeserver to login to")
+		return err
+	}
+	c.client.HomeserverURL, err = mautrix.ParseAndNormalizeBaseURL(homeserver)
+	if err != nil {
+		return err
+	}
+
 	resp, err := c.client.GetLoginFlows()
 	if err != nil {
 		c.logger.Error().Msg("could not check the login flows supported by the homeserver")
@@ -254,6 +426,7 @@ func (c *ClientWrapper) concludeLogin(resp *mautrix.RespLogin) {
 	if resp.WellKnown != nil && len(resp.WellKnown.Homeserver.BaseURL) > 0 {
 		c.config.Homeserver = resp.WellKnown.Homeserver.BaseURL
 	}
+	c.config.HomeserverName = resp.UserID.Homeserver()
 
 	c.config.Save()
 	go c.Start()
@@ -282,6 +455,11 @@ func (c *ClientWrapper) Start() {
 	debug.Print("Starting sync...")
 	c.running = true
 	c.client.StreamSyncMinAge = 30 * time.Minute //syncs with the server every 30min
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.connectivity.Run(c.probeHomeserver, done)
+	go c.sendReceiptsWhenOnline(done)
 	for {
 		select {
 		case <-c.stop:
@@ -293,8 +471,15 @@ func (c *ClientWrapper) Start() {
 				if errors.Is(err, mautrix.MUnknownToken) {
 					debug.Print("Access token was not recognized -> logging out")
 					c.Logout()
-				} else {
-					debug.Print("Sync() call errored with: " + err.Error())
+					continue
+				}
+				debug.Print("Sync() call errored with: " + err.Error())
+				select { //failed requests are retried by the syncer, see syncFailed, so this is e.g. a bad response
+				case <-c.stop:
+					debug.Print("Stopping sync...")
+					c.running = false
+					return
+				case <-time.After(probeUnreachable):
 				}
 			} else {
 				debug.Print("Sync() call returned successfully")
@@ -305,6 +490,10 @@ func (c *ClientWrapper) Start() {
 
 // Stop stops the Matrix syncer.
 func (c *ClientWrapper) Stop() {
+	if c.stopOffline != nil {
+		close(c.stopOffline)
+		c.stopOffline = nil
+	}
 	if c.running {
 		debug.Print("Stopping Matrix client...")
 		select {
@@ -318,6 +507,17 @@ func (c *ClientWrapper) Stop() {
 			debug.Print("Error closing history manager")
 		}
 		c.history = nil
+		debug.Print("Closing data store...")
+		err = c.data.Close()
+		if err != nil {
+			debug.Print("Error closing data store")
+		}
+		c.data = nil
+		c.queue = nil
+		c.outbox = nil
+		c.peers = nil
+		c.preKeys = nil
+		c.keyBackup = nil
 
 		if c.crypto != nil {
 			debug.Print("Flushing crypto store")
@@ -347,9 +547,25 @@ func (c *ClientWrapper) OnLogin() {
 			}
 		})
 		c.syncer.OnEventType(event.EventEncrypted, c.HandleEncrypted)
+		c.syncer.OnEventType(mxevents.ToDevicePeerBinding, c.HandlePeerBinding)
+		c.syncer.OnEventType(event.ToDeviceVerificationRequest, c.HandleVerificationEvent)
+		c.syncer.OnEventType(event.ToDeviceVerificationStart, c.HandleVerificationEvent)
+		c.syncer.OnEventType(event.ToDeviceRoomKeyRequest, c.HandleKeyRequest)
+		if c.config.Offline.Enabled {
+			c.syncer.FirstDoneCallback = func() { //announce our offline host on every start
+				go c.publishPeerBinding()
+				go c.runKeyRefresh(c.preKeys)
+			}
+			//and again to whoever joins later or adds a device
+			c.syncer.OnEventType(event.StateMember, c.announcePeerOnJoin)
+			c.syncer.OnSync(c.announcePeerToNewDevices)
+		}
 	} else {
 		c.syncer.OnEventType(event.EventEncrypted, c.HandleEncryptedUnsupported)
 	}
+	c.syncer.OnSync(c.syncSucceeded)
+	c.syncer.FailedCallback = c.syncFailed
+	c.syncer.LimitedCallback = c.fillGap
 	c.syncer.OnEventType(event.EventMessage, c.HandleMessage)
 	c.syncer.OnEventType(event.EventSticker, c.HandleMessage)
 	c.syncer.OnEventType(event.EventReaction, c.HandleMessage)
@@ -536,21 +752,16 @@ func (c *ClientWrapper) JoinRoom(roomID id.RoomID, server string) (*rooms.Room,
 // Retrieves the list of members of the given room
 func (c *ClientWrapper) JoinedMembers(roomID id.RoomID) ([]id.UserID, error) {
 	resp, err := c.client.JoinedMembers(roomID)
-	keys := make([]id.UserID, len(resp.Joined))
-
 	if err != nil {
 		fmt.Println(err)
 		c.logger.Error().Err(err).Msg("could not get the list of members of the given room")
 		return nil, err
-	} else {
-		i := 0
-		for key := range resp.Joined { //print out the room members' display names
-			fmt.Println(key)
-			keys[i] = key
-			i++
-		}
 	}
 
+	keys := make([]id.UserID, 0, len(resp.Joined))
+	for key := range resp.Joined {
+		keys = append(keys, key)
+	}
 	return keys, nil
 }
 
@@ -595,7 +806,42 @@ func (c *ClientWrapper) GetHistory(room *rooms.Room, limit int, dbPointer uint64
 	}
 
 	debug.Printf("Loaded %d events for %s from server", len(resp.Chunk), room.ID.String())
-	for i, evt := range resp.Chunk {
+	c.prepareServerEvents(room, resp.Chunk)
+
+	//update the local cache for the given room
+	for _, evt := range resp.State {
+		room.UpdateState(evt)
+	}
+	room.PrevBatch = resp.End
+	c.config.Rooms.Put(room)
+	if len(resp.Chunk) == 0 {
+		return []*mxevents.Event{}, dbPointer, nil
+	}
+	events, newDBPointer, err = c.history.Prepend(room, resp.Chunk) //update event history
+	if err != nil {
+		return nil, dbPointer, err
+	}
+	return events, newDBPointer, nil
+}
+
+// HistoryFrom returns up to limit events before or after the given event, newest first. Going backwards, the
+// events missing locally are fetched from the server like in GetHistory.
+func (c *ClientWrapper) HistoryFrom(room *rooms.Room, eventID id.EventID, limit int, forward bool) ([]*mxevents.Event, error) {
+	ptr, err := c.history.Pointer(room, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("event %s is not stored: %w", eventID, err)
+	}
+	if forward {
+		events, _, err := c.history.LoadAfter(room, limit, ptr)
+		return events, err
+	}
+	events, _, err := c.GetHistory(room, limit, ptr)
+	return events, err
+}
+
+// Parses and decrypts the events fetched with /messages, in place
+func (c *ClientWrapper) prepareServerEvents(room *rooms.Room, events []*event.Event) {
+	for i, evt := range events {
 		err := evt.Content.ParseRaw(evt.Type)
 		if err != nil {
 			debug.Printf("Failed to unmarshal content of event %s (type %s) by %s in %s: %v\n%s", evt.ID, evt.Type.Repr(), evt.Sender, evt.RoomID, err, string(evt.Content.VeryRaw))
@@ -613,32 +859,17 @@ func (c *ClientWrapper) GetHistory(room *rooms.Room, limit int, dbPointer uint64
 					c.logger.Err(err).Msg("Failed to decrypt event " + evt.ID.String())
 					evt.Type = mxevents.EventBadEncrypted
 					origContent, _ := evt.Content.Parsed.(*event.EncryptedEventContent)
+					go c.requestMissingKey(room.ID, evt.Sender, origContent, err)
 					evt.Content.Parsed = &mxevents.BadEncryptedContent{
 						Original: origContent,
 						Reason:   err.Error(),
 					}
 				} else {
-					resp.Chunk[i] = decrypted
+					events[i] = decrypted
 				}
 			}
 		}
 	}
-
-	//update the local cache for the given room
-	for _, evt := range resp.State {
-		room.UpdateState(evt)
-	}
-	room.PrevBatch = resp.End
-	c.config.Rooms.Put(room)
-	if len(resp.Chunk) == 0 {
-		return []*mxevents.Event{}, dbPointer, nil
-	}
-	// TODO newDBPointer isn't accurate in this case yet, fix later
-	events, _, err = c.history.Prepend(room, resp.Chunk) //update event history
-	if err != nil {
-		return nil, dbPointer, err
-	}
-	return events, dbPointer, nil
 }
 
 // Fetches a specific event of the given room
@@ -677,35 +908,53 @@ func (c *ClientWrapper) GetRoom(roomID id.RoomID) *rooms.Room {
 
 //*************************** EVENTS *******************************//
 
+// Whether events of the given type are encrypted before being sent into the room
+func (c *ClientWrapper) encryptsFor(room *rooms.Room, evtType event.Type) bool {
+	return room != nil && room.Encrypted && c.crypto != nil && evtType != event.EventReaction && evtType != event.EventEncrypted
+}
+
+// Encrypts the content of an event for a room, sharing a new megolm session first if there is none to use.
+// While offline no session can be shared, so the error of the olm machine is returned as is.
+func (c *ClientWrapper) encryptEvent(room *rooms.Room, evtType event.Type, content *event.Content) (*event.EncryptedEventContent, error) {
+	encrypted, err := c.crypto.EncryptMegolmEvent(context.TODO(), room.ID, evtType, content)
+	if err == nil || isBadEncryptError(err) || c.IsOffline() {
+		return encrypted, err
+	}
+	fmt.Print("Got ", err, " while trying to encrypt message, sharing group session and trying again...")
+	debug.Print("Got ", err, " while trying to encrypt message, sharing group session and trying again...")
+	if err = c.shareGroupSession(room); err != nil {
+		c.logger.Error().Err(err).Msg("Could not share the group session successfully")
+		return nil, err
+	}
+	return c.crypto.EncryptMegolmEvent(context.TODO(), room.ID, evtType, content)
+}
+
 // Sends a message event into a room
 func (c *ClientWrapper) SendEvent(evt *mxevents.Event) (id.EventID, error) {
 	room := c.GetRoom(evt.RoomID)
-	if room != nil && room.Encrypted && c.crypto != nil && evt.Type != event.EventReaction {
-		encrypted, err := c.crypto.EncryptMegolmEvent(context.TODO(), evt.RoomID, evt.Type, &evt.Content)
-		if err != nil {
-			if isBadEncryptError(err) {
-				c.logger.Error().Err(err).Msg("Could not encrypt the specified event")
-				return "", err
-			}
-			fmt.Print("Got ", err, " while trying to encrypt message, sharing group session and trying again...")
-			debug.Print("Got ", err, " while trying to encrypt message, sharing group session and trying again...")
-			err = c.crypto.ShareGroupSession(context.TODO(), room.ID, room.GetMemberList())
-			if err != nil {
-				c.logger.Error().Err(err).Msg("Could not share the group session successfully")
-				return "", err
-			}
-			encrypted, err = c.crypto.EncryptMegolmEvent(context.TODO(), evt.RoomID, evt.Type, &evt.Content)
-			if err != nil {
-				c.logger.Error().Err(err).Msg("Could not encrypt the specified event")
-				return "", err
-			}
+	plain := *evt.Event //kept as local echo if the homeserver cannot be reached
+	if c.encryptsFor(room, evt.Type) {
+		encrypted, err := c.encryptEvent(room, evt.Type, &evt.Content)
+		if err != nil && (isConnectivityError(err) || (c.IsOffline() && !isBadEncryptError(err))) {
+			//without the homeserver no session can be shared, the plaintext is kept and encrypted once online
+			c.connectivity.ReportFailure(err)
+			return c.sendLater(room, &plain, evt)
+		} else if err != nil {
+			c.logger.Error().Err(err).Msg("Could not encrypt the specified event")
+			return "", err
 		}
 		evt.Type = event.EventEncrypted
 		evt.Content = event.Content{Parsed: encrypted}
 	}
 
+	if c.IsOffline() && room != nil {
+		return c.sendLater(room, &plain, evt)
+	}
 	resp, err := c.client.SendMessageEvent(evt.RoomID, evt.Type, &evt.Content, mautrix.ReqSendEvent{TransactionID: evt.Unsigned.TransactionID})
-	if err != nil {
+	if err != nil && isConnectivityError(err) && room != nil {
+		c.connectivity.ReportFailure(err)
+		return c.sendLater(room, &plain, evt)
+	} else if err != nil {
 		fmt.Println(err)
 		c.logger.Error().Err(err).Msg("could not send message event")
 		return "", err
@@ -721,7 +970,7 @@ func (c *ClientWrapper) SendStateEvent(evt *mxevents.Event) (id.EventID, error)
 	fmt.Println(evt.RoomID)
 	fmt.Println(evt.Type)
 
-	resp, err := c.client.SendStateEvent(evt.RoomID, evt.Type, *evt.StateKey, &evt.Content)
+	resp, err := c.client.SendStateEvent(evt.RoomID, evt.Type, evt.GetStateKey(), &evt.Content)
 	if err != nil {
 		c.logger.Error().Err(err).Msg("could not send the specified event")
 		return "", err
@@ -768,6 +1017,8 @@ func (c *ClientWrapper) HandleMessage(source mautrix.EventSource, mxEvent *event
 		return
 	} else if source&mautrix.EventSourceState != 0 {
 		return
+	} else if c.reconcileLocalEcho(room, mxEvent) {
+		return
 	}
 
 	c.addMessageToHistory(room, mxEvent)
@@ -781,11 +1032,15 @@ func (c *ClientWrapper) HandleRoomEncryption(source mautrix.EventSource, mxEvent
 }
 
 func (c *ClientWrapper) HandleEncrypted(source mautrix.EventSource, mxEvent *event.Event) {
+	if c.reconcileLocalEcho(c.GetOrCreateRoom(mxEvent.RoomID), mxEvent) {
+		return //we already have it, it was sent offline
+	}
 	evt, err := c.crypto.DecryptMegolmEvent(context.TODO(), mxEvent)
 	if err != nil {
 		debug.Printf("Failed to decrypt event %s: %v", mxEvent.ID, err)
 		mxEvent.Type = mxevents.EventBadEncrypted
 		origContent, _ := mxEvent.Content.Parsed.(*event.EncryptedEventContent)
+		go c.requestMissingKey(mxEvent.RoomID, mxEvent.Sender, origContent, err)
 		mxEvent.Content.Parsed = &mxevents.BadEncryptedContent{
 			Original: origContent,
 			Reason:   err.Error(),
@@ -793,7 +1048,8 @@ func (c *ClientWrapper) HandleEncrypted(source mautrix.EventSource, mxEvent *eve
 		c.HandleMessage(source, mxEvent)
 		return
 	}
-	if evt.Type.IsInRoomVerification() {
+	if evt.Type.IsInRoomVerification() || isVerificationRequest(evt) {
+		c.recordVerificationEvent(evt)
 		err := c.crypto.ProcessInRoomVerification(evt)
 		if err != nil {
 			debug.Printf("[Crypto/Error] Failed to process in-room verification event %s of type %s: %v", evt.ID, evt.Type.String(), err)
@@ -885,13 +1141,28 @@ func (c *ClientWrapper) HandleReadReceipt(source mautrix.EventSource, evt *event
 
 func (c *ClientWrapper) parseReadReceipt(room *rooms.Room, evt *event.Event) (largestTimestampEvent id.EventID) {
 	var largestTimestamp time.Time
-	var offline offlineData
 
 	var members, _ = c.JoinedMembers(evt.RoomID) //fetch from server
 
 	//map[id.EventID]map[ReceiptType]map[id.UserID]ReadReceipt
 
 	for eventID, receipts := range *evt.Content.AsReceipt() {
+		//whoever read the event online no longer needs it offline
+		readers := make([]id.UserID, 0, len(receipts[event.ReceiptTypeRead]))
+		for user := range receipts[event.ReceiptTypeRead] {
+			if user != c.client.UserID {
+				readers = append(readers, user)
+			}
+			if room != nil {
+				room.SetReceipt(user, eventID)
+			}
+		}
+		if c.queue != nil {
+			if err := c.queue.Read(eventID, readers); err != nil {
+				c.logger.Err(err).Msg("Could not update the offline delivery queue")
+			}
+		}
+
 		myInfo, ok := receipts[event.ReceiptTypeRead][c.config.UserID]
 		if !ok {
 			continue
@@ -904,36 +1175,110 @@ func (c *ClientWrapper) parseReadReceipt(room *rooms.Room, evt *event.Event) (la
 
 		//********** OFFLINE COMMS LOGIC ***********//
 
-		actualEvent, _ := c.GetEvent(room, eventID)
-		if actualEvent.Sender == c.client.UserID { //only send events that we sent
-			ackUsers := receipts["m.read"] //get all users that saw the event with eventID
-			//compare them against room members
-			for _, user := range members {
-				if _, ok := ackUsers[user]; !ok {
-					offline.users = append(offline.users, user)
-				}
-			}
-
-			//if at least one user did not send a receipt for this event
-			if len(offline.users) > 0 {
-				fmt.Printf("Found event %s to send offline to %s", eventID, offline.users)
-				offline.eventID = eventID
-				offline.roomID = evt.RoomID
-				c.sendOff <- offline //send data to goroutine
-			}
-		} else {
+		actualEvent, err := c.GetEvent(c.GetOrCreateRoom(evt.RoomID), eventID)
+		if err != nil || actualEvent.Sender != c.client.UserID { //only send events that we sent
 			continue
 		}
 
+		ackUsers := receipts[event.ReceiptTypeRead] //get all users that saw the event with eventID
+		//compare them against room members
+		var missing []id.UserID
+		for _, user := range members {
+			if _, ok := ackUsers[user]; !ok {
+				missing = append(missing, user)
+			}
+		}
+		c.queueOfflineDelivery(evt.RoomID, eventID, missing)
 	}
 	return
 }
 
+// Queues one of our events to be delivered offline to the given users, if there is any
+func (c *ClientWrapper) queueOfflineDelivery(roomID id.RoomID, eventID id.EventID, users []id.UserID) {
+	if len(users) == 0 {
+		return
+	}
+	var original *event.Event
+	if existing, err := c.queue.Get(eventID); err != nil || existing == nil || existing.Original == nil {
+		if original, err = c.originalCiphertext(roomID, eventID); err != nil {
+			c.logger.Err(err).Msg("Could not fetch the ciphertext of event " + eventID.String() + " for offline delivery")
+			return
+		}
+	}
+	c.enqueueDelivery(roomID, eventID, original, users)
+}
+
+// Queues an event for offline delivery to the given users. The ciphertext may be nil if the event is queued already.
+func (c *ClientWrapper) enqueueDelivery(roomID id.RoomID, eventID id.EventID, original *event.Event, users []id.UserID) {
+	pending := &PendingDelivery{
+		EventID:  eventID,
+		RoomID:   roomID,
+		Original: original,
+		Users:    users,
+		Devices:  make(map[id.UserID][]id.DeviceID),
+		Expires:  time.Now().Add(c.config.Offline.RelayTTL),
+		HopsLeft: c.config.Offline.RelayHops,
+	}
+	for _, user := range users {
+		devices, _ := c.crypto.CryptoStore.GetDevices(user)
+		for deviceID := range devices {
+			pending.Devices[user] = append(pending.Devices[user], deviceID)
+		}
+	}
+
+	fmt.Printf("Found event %s to send offline to %s", eventID, pending.Users)
+	if err := c.queue.Enqueue(pending); err != nil {
+		c.logger.Err(err).Msg("Could not queue event " + eventID.String() + " for offline delivery")
+		return
+	}
+	select { //wake up the offline routine, unless it already has a pending signal
+	case c.sendOff <- struct{}{}:
+	default:
+	}
+}
+
+// SearchHistory looks for messages in the local history of the joined rooms. While online the homeserver is
+// searched too, for the unencrypted rooms, and its results are merged with the local ones.
+func (c *ClientWrapper) SearchHistory(query SearchQuery) ([]SearchResult, error) {
+	if c.history == nil {
+		return nil, fmt.Errorf("history is not loaded, log in first")
+	}
+	results, err := c.history.Search(query)
+	if err != nil {
+		return nil, err
+	}
+	if room := c.GetRoom(query.RoomID); c.IsOffline() || (room != nil && room.Encrypted) {
+		return results, nil
+	}
+
+	events, err := c.searchServer(query)
+	if err != nil {
+		if isConnectivityError(err) {
+			c.connectivity.ReportFailure(err)
+		}
+		c.logger.Err(err).Msg("Could not search the homeserver, showing local results only")
+		return results, nil
+	}
+	results = append(results, c.cacheServerResults(query, events, results)...)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Timestamp > results[j].Timestamp
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
 // Auxiliary method called whenever a message is received, whether the client is offline or online (through handleMessage)
 func (c *ClientWrapper) addMessageToHistory(room *rooms.Room, mxEvent *event.Event) {
-	events, err := c.history.Append(room, []*event.Event{mxEvent}) //add the newly-received event to room history
+	history := c.history
+	if history == nil { //the client was stopped
+		return
+	}
+	events, err := history.Append(room, []*event.Event{mxEvent}) //add the newly-received event to room history
 	if err != nil {
 		debug.Printf("Failed to add event %s to history: %v", mxEvent.ID, err)
+		return
 	}
 
 	evt := events[0]
@@ -949,11 +1294,18 @@ func (c *ClientWrapper) addMessageToHistory(room *rooms.Room, mxEvent *event.Eve
 		Str("body", evt.Content.AsMessage().Body).
 		Msg("Received message")
 
+	//without the receipt the other clients keep trying to deliver this event offline, so a receipt that
+	//cannot be sent now is kept until the homeserver is reachable again
+	if c.IsOffline() {
+		c.queueReceipt(room.ID, evt.ID)
+		return
+	}
 	err = c.MarkRead(room.ID, evt.ID)
-	if err != nil { //this will fail if the device is offline
-		//TODO: Add support for this case, otherwise client will be stuck in a permanent loop because it has the event, but
-		//did not send the receipt cause it was offline, meaning that the other clients will always try to send this event to this device
-		//over and over
+	if err != nil && isConnectivityError(err) {
+		c.connectivity.ReportFailure(err)
+		c.queueReceipt(room.ID, evt.ID)
+		return
+	} else if err != nil {
 		return
 	}
 
@@ -962,351 +1314,42 @@ func (c *ClientWrapper) addMessageToHistory(room *rooms.Room, mxEvent *event.Eve
 	//Talvez so mandar o receipt quando o user usar o commando da history de uma sala?
 }
 
-func (c *ClientWrapper) FetchDeviceKeys(userToFetch id.UserID, deviceToFetch id.DeviceID) (id.Curve25519, id.Ed25519, error) {
-	device := make(mautrix.DeviceIDList, 1)
-	device = append(device, (id.DeviceID(deviceToFetch)))
-
-	respKey, err := c.client.QueryKeys(&mautrix.ReqQueryKeys{ //turn into a function
-		DeviceKeys: mautrix.DeviceKeysRequest{
-			userToFetch: device,
-		},
-		Timeout: 10000,
-	})
-
-	if err != nil {
-		c.logger.Err(err).Msg("Could not obtain user's device keys")
-		return "", "", err
-	}
-
-	//The receiving user's keys, obtained from the server
-	idKey := respKey.DeviceKeys[userToFetch][device[0]].Keys.GetCurve25519(device[0]) //identity key
-	edKey := respKey.DeviceKeys[userToFetch][device[0]].Keys.GetEd25519(device[0])    //fingerprint key
-
-	return idKey, edKey, nil
-}
-
-//****************** OFFLINE COMMS *********************//
-
-const protocolID = "/matrix-offline/1.0.0"
-
-// struct to hold data to send to clients outside of matrix if needed
-type offlineData struct {
-	eventID id.EventID  //the event to send
-	roomID  id.RoomID   //the room to whom the event belongs to
-	users   []id.UserID //the users that did not receive the event
-}
-
-func newHost() host.Host {
-	// Set your own keypair
-	//Would like to use matrix's Ed25519 fingerprint key pair, but the private part is never disclosed to the API
-	priv, _, err := cryp.GenerateKeyPair(
-		cryp.Ed25519, // Select your key type. Ed25519 are nice short
-		-1,           // Select key length when possible (i.e. RSA).
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	//might need some tuning - want small groups
-	connmgr, err := connmgr.NewConnManager(
-		10, // Lowwater
-		20, // HighWater,
-		connmgr.WithGracePeriod(time.Minute),
-	)
-	if err != nil {
-		panic(err)
-	}
-	host, err := libp2p.New(
-		// Use the keypair we generated
-		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/8080",
-		),
-		// support TLS connections
-		libp2p.Security(libp2ptls.ID, libp2ptls.New),
-		libp2p.DefaultTransports,
-		// Let's prevent our peer from having too many
-		// connections by attaching a connection manager.
-		libp2p.ConnectionManager(connmgr),
-	)
-	if err != nil {
-		fmt.Println("Uh oh - panicked when creating host")
-		panic(err)
+// Keeps the latest read receipt of a room until it can be sent
+func (c *ClientWrapper) queueReceipt(roomID id.RoomID, eventID id.EventID) {
+	c.receiptLock.Lock()
+	defer c.receiptLock.Unlock()
+	if c.pendingReceipts == nil {
+		c.pendingReceipts = make(map[id.RoomID]id.EventID)
 	}
-
-	fmt.Println("Listen Addresses:", host.Addrs())
-
-	return host
+	c.pendingReceipts[roomID] = eventID
 }
 
-func (c *ClientWrapper) runOffline() {
-
-	// The context governs the lifetime of the libp2p node.
-	// Cancelling it will stop the host.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	host := newHost()
-
-	defer host.Close()
-	host.SetStreamHandler(protocolID, c.handleIncomingStream)
-
-	peerChan := offline.InitMDNS(host, "matrix-offline")
+// Sends the read receipts kept while offline every time the homeserver becomes reachable, until done is closed
+func (c *ClientWrapper) sendReceiptsWhenOnline(done <-chan struct{}) {
+	defer debug.Recover()
+	states := c.connectivity.Subscribe()
+	defer c.connectivity.Unsubscribe(states)
 	for {
 		select {
-		case <-c.sendOff: //if there is something to send, look for peers
-			fmt.Println("Starting search for offline host")
-			for { // allows multiple peers to join
-				peer := <-peerChan // will block until we discover a peer
-				fmt.Println("Found peer:", peer, ", connecting")
-				debug.Print("Found peer: " + peer.String() + ", connecting")
-
-				if err := host.Connect(ctx, peer); err != nil {
-					fmt.Println("Connection failed:", err)
-					debug.Print("Connection failed")
-					continue
-				}
-
-				// open a stream, this stream will be handled by handleIncomingStream other end
-				stream, err := host.NewStream(ctx, peer.ID, protocolID)
-
-				if err != nil {
-					fmt.Println("Stream open failed", err)
-					debug.Print("Could not open stream")
-				} else {
-					rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-					fmt.Println("Connected to:", peer)
-					debug.Print("Connected to: " + peer.String())
-					go c.sendOffline(rw)
-
-				}
-			}
-		case <-time.After(15 * time.Minute):
-			//Repeat this loop every 15 min
-			fmt.Println("No data to be sent yet.")
-			//default:
-			/*fmt.Print("Waiting for connections in case we are offline, or for data to be ready to send")
-			debug.Print("Listening for connections in case we are offline")
-			select {} //thread hangs forever until the other case is true*/
-		}
-	}
-}
-
-func (c *ClientWrapper) handleIncomingStream(s network.Stream) {
-	debug.Print("Got a new stream!")
-	fmt.Println("Got a new stream!")
-	// Create a buffer stream for non blocking read and write.
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	//if stream is incoming, it means we are offline, therefore only need to do the receiving end of the logic
-	go func() {
-		//Wrap the worker call in a closure that makes sure to tell the WaitGroup that this worker is done.
-		//This way the worker itself does not have to be aware of the concurrency primitives involved in its execution.
-		defer wg.Done()
-		fmt.Println("Starting to read from stream...")
-		c.readData(rw)
-	}()
-
-	//go c.readData(rw)
-
-	// stream 's' will stay open until you close it (or the other side closes it).
-	wg.Wait() //wait for the readData subroutine to finish and close stream
-	s.Close()
-}
-
-func (c *ClientWrapper) sendOffline(rw *bufio.ReadWriter) {
-	toSend := <-c.sendOff
-	room := c.GetRoom(toSend.roomID)
-	evt, _ := c.GetEvent(room, toSend.eventID)
-
-	fmt.Println("Starting protocol to send event with matrix encryption.")
-	offlineHost := c.credentialsToOffline(rw)
-
-	if slices.Contains(toSend.users, offlineHost.UserID) {
-		idKey, edKey, err := c.FetchDeviceKeys(offlineHost.UserID, id.DeviceID(offlineHost.DeviceID))
-		if err != nil {
+		case <-done:
 			return
-		}
-
-		//If there is an established Olm session with the identity key of the offline client, first assume a Megolm session has also been shared with the
-		//offline device previously and send the encrypted event as normal. In case the offline client cannot decrypt it, then share the megolm session a posteriori.
-		if b := c.crypto.CryptoStore.HasSession(idKey); b {
-			encrypted, err := c.crypto.EncryptMegolmEvent(context.TODO(), evt.RoomID, evt.Type, &evt.Content)
-			if err != nil {
-				c.logger.Error().Err(err).Msg("Could not encrypt the specified event")
+		case state := <-states:
+			if state != StateOnline {
+				continue
 			}
-			evt.Type = event.EventEncrypted
-			evt.Content = event.Content{Parsed: encrypted}
-			c.writeBytes(rw, evt)
-
-			//Wait for the other client's response here -> can be a key request or an ACK
-			keyReq, ack := c.readBytes(rw)
-			if ack != "" { //An ACK was received
-				return
-			}
-
-			originalContent, _ := keyReq.Content.Parsed.(*event.RoomKeyRequestEventContent)
-			forwardedRoomKey, _ := c.parseKeyRequestEvent(originalContent)
-
-			olmSesh, _ := c.crypto.CryptoStore.GetLatestSession(idKey)
-
-			olmContent := c.encryptOlm(idKey, edKey, olmSesh, offlineHost.UserID, event.ToDeviceForwardedRoomKey, forwardedRoomKey)
-			olmEvent := &mxevents.Event{
-				Event: &event.Event{
-					Type:    event.ToDeviceEncrypted,
-					Content: event.Content{Parsed: olmContent},
-				},
-			}
-			c.writeBytes(rw, olmEvent)
-
 		}
 
-		_, ack := c.readBytes(rw) //cover the case where the session had to be shared with the offline client
-		if ack != "" {            //An ACK was received
-			fmt.Printf("Event with eventID %s was delivered successfully user with ID %s.", toSend.eventID, offlineHost.UserID)
-			debug.Printf("Event with eventID %s was delivered successfully to user with ID %s.", toSend.eventID, offlineHost.UserID)
-			return
-		}
-	}
-}
-
-func (c *ClientWrapper) readData(rw *bufio.ReadWriter) {
-	fmt.Println("Exchanging Matrix credentials...")
-	hostDevice := c.credentialsToOnline(rw)
-	senderCredentials := map[id.UserID][]id.DeviceID{hostDevice.UserID: {hostDevice.DeviceID}}
-
-	var missingEvt *mxevents.Event
-	var evt *event.Event
-	var err error
-
-	fmt.Println("Received encrypted event from online host.")
-	missingEvt, _ = c.readBytes(rw)
-	room := c.GetOrCreateRoom(missingEvt.RoomID)
-
-	if existing, _ := c.history.Get(room, missingEvt.ID); existing != nil {
-		debug.Print("Event is already stored, probably was already sent by another host")
-		fmt.Println("Event is already stored, terminating connection to host")
-		return
-	}
-
-	evt, err = c.crypto.DecryptMegolmEvent(context.TODO(), missingEvt.Event)
-
-	if err != nil {
-		c.logger.Err(err).Msg("Could not decrypt event received offline")
-
-		//Ask for megolm session details here -> build m.room.key.request event
-		keyReq := c.buildKeyRequest(evt.RoomID, evt.Content.AsEncrypted().SenderKey, evt.Content.AsEncrypted().SessionID, senderCredentials)
-		c.writeBytes(rw, keyReq)
-
-		//Receive encrypted megolm session
-		encrypted, _ := c.readBytes(rw)
-
-		//Decrypt the event with Olm
-		decryptedEvt, err := c.decryptOlm(context.Background(), encrypted.Event)
-		if err != nil {
-			c.logger.Err(err).Msg("Could not decrypt olm event")
-		}
-		decryptedContent := decryptedEvt.Content.Parsed.(*event.ForwardedRoomKeyEventContent)
-
-		//Update the megolm session
-		if c.importForwardedRoomKey(context.Background(), decryptedEvt, decryptedContent) {
-			c.logger.Trace().Msg("Handled forwarded room key event")
-			//Should now be able to decrypt
-			evt, _ = c.crypto.DecryptMegolmEvent(context.TODO(), missingEvt.Event) //not expecting an err here
+		c.receiptLock.Lock()
+		pending := c.pendingReceipts
+		c.pendingReceipts = nil
+		c.receiptLock.Unlock()
+		for roomID, eventID := range pending {
+			if err := c.MarkRead(roomID, eventID); err != nil {
+				c.logger.Err(err).Msg("Could not send read receipt for " + eventID.String())
+				c.queueReceipt(roomID, eventID)
+				continue
+			}
+			debug.Printf("Sent read receipt for %s kept while offline", eventID)
 		}
 	}
-
-	c.addMessageToHistory(room, evt)
-	fmt.Printf("Message with eventID %s was received successfully.", evt.ID)
-	rw.Write([]byte("ACK"))
-}
-
-func (c *ClientWrapper) credentialsToOnline(rw *bufio.ReadWriter) *id.Device {
-	//receive other host's client credentials
-	var hostDevice *id.Device
-	bytes, _ := rw.ReadBytes('\n')
-	json.Unmarshal(bytes, hostDevice)
-	fmt.Println("Received online host's credentials.")
-
-	//Should be safe to call both on and offline
-	if trusted := c.crypto.IsDeviceTrusted(hostDevice); !trusted {
-		c.logger.Info().Msg("Host device is not trusted")
-		return nil
-	}
-
-	//send our credentials to connected host
-	selfID, err := c.crypto.CryptoStore.GetDevice(c.client.UserID, c.client.DeviceID)
-	if err != nil { //since the store used by the crypto module is a db, this probably won't fail while offline
-		c.logger.Err(err).Msg("Could not fetch own device info from crypto store")
-	}
-
-	marshalled, _ := json.Marshal(selfID)
-	rw.Write(marshalled)
-	fmt.Println("Sent credentials to online host.")
-
-	return hostDevice
-
-}
-
-func (c *ClientWrapper) credentialsToOffline(rw *bufio.ReadWriter) *id.Device {
-	//send our credentials to connected host
-	selfID, err := c.crypto.CryptoStore.GetDevice(c.client.UserID, c.client.DeviceID)
-	if err != nil { //since the store used by the crypto module is a db, this probably won't fail while offline
-		c.logger.Err(err).Msg("Could not fetch own device info from crypto store")
-	}
-
-	marshalled, _ := json.Marshal(selfID)
-	rw.Write(marshalled)
-	fmt.Println("Sent credentials to offline host.")
-
-	//receive other host's client credentials
-	var hostDevice *id.Device
-	bytes, _ := rw.ReadBytes('\n')
-	json.Unmarshal(bytes, hostDevice)
-	fmt.Println("Received offline host's credentials.")
-
-	//Should be safe to call both on and offline
-	if trusted := c.crypto.IsDeviceTrusted(hostDevice); !trusted {
-		c.logger.Info().Msg("Host device is not trusted")
-		return nil
-	}
-
-	return hostDevice
-
-}
-
-func (c *ClientWrapper) writeBytes(rw *bufio.ReadWriter, evt *mxevents.Event) {
-	reqBytes, err := json.Marshal(evt)
-	if err != nil {
-		c.logger.Err(err).Msg("Could not marshal key request event bytes")
-	}
-
-	if _, err := rw.Write(reqBytes); err != nil {
-		c.logger.Error().Msg("Could not send bytes to stream")
-	}
-}
-
-func (c *ClientWrapper) readBytes(rw *bufio.ReadWriter) (evt *mxevents.Event, ack string) {
-	//Next, it will receive the encrypted event
-	evtBytes, err := rw.ReadBytes('\n')
-	if err != nil {
-		// if it reaches this, need to find the correct delim
-		c.logger.Error().Msg("Failed to read bytes from stream")
-		return nil, ""
-	}
-
-	//Clause exclusively for the case where the event was succesfully decrypted
-	//and an ACK was sent to the online client
-	ack = string(evtBytes)
-	if strings.Compare(ack, "ACK") == 0 {
-		return nil, ack
-	}
-
-	json.Unmarshal(evtBytes, evt)
-
-	return evt, ""
 }
@@ -10,12 +10,19 @@ import (
 	"reflect"
 
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 // create two new types of events: when a message event is badly encrypted; another for when a room does not support encryption
 var EventBadEncrypted = event.Type{Type: "net.maunium.gomuks.bad_encrypted", Class: event.MessageEventType}
 var EventEncryptionUnsupported = event.Type{Type: "net.maunium.gomuks.encryption_unsupported", Class: event.MessageEventType}
 
+// state event with the retention policy of a room (MSC1763), not supported by mautrix
+var StateRetention = event.Type{Type: "m.room.retention", Class: event.StateEventType}
+
+// to-device event announcing the libp2p peer ID used by a device for offline comms
+var ToDevicePeerBinding = event.Type{Type: "thesgo.offline.peer_binding", Class: event.ToDeviceEventType}
+
 type BadEncryptedContent struct {
 	Original *event.EncryptedEventContent `json:"-"`
 
@@ -26,10 +33,27 @@ type EncryptionUnsupportedContent struct {
 	Original *event.EncryptedEventContent `json:"-"` //the original event content
 }
 
+// PeerBindingContent maps a Matrix device to its libp2p peer ID, signed with the Ed25519 key of the device
+type PeerBindingContent struct {
+	UserID    id.UserID   `json:"user_id"`
+	DeviceID  id.DeviceID `json:"device_id"`
+	PeerID    string      `json:"peer_id"`
+	Signature string      `json:"signature"`
+}
+
+// RetentionContent tells how long the events of a room should be kept, in milliseconds
+type RetentionContent struct {
+	MinLifetime *int64 `json:"min_lifetime,omitempty"`
+	MaxLifetime *int64 `json:"max_lifetime,omitempty"`
+}
+
 // register the new event types to the local database, mapping the event type to its content type
 func init() {
 	gob.Register(&BadEncryptedContent{})
 	gob.Register(&EncryptionUnsupportedContent{})
+	gob.Register(&RetentionContent{})
 	event.TypeMap[EventBadEncrypted] = reflect.TypeOf(&BadEncryptedContent{})
 	event.TypeMap[EventEncryptionUnsupported] = reflect.TypeOf(&EncryptionUnsupportedContent{})
+	event.TypeMap[ToDevicePeerBinding] = reflect.TypeOf(&PeerBindingContent{})
+	event.TypeMap[StateRetention] = reflect.TypeOf(&RetentionContent{})
 }
@@ -0,0 +1,624 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"thesgo/config"
+	"thesgo/matrix/mxevents"
+	"thesgo/offline"
+	"thesgo/offline/wire"
+
+	"github.com/libp2p/go-libp2p"
+	cryp "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//****************** OFFLINE COMMS *********************//
+
+const protocolID = "/matrix-offline/2.0.0"
+
+// How long a single offline exchange with a peer may take before the stream is dropped
+const offlineStreamTimeout = 2 * time.Minute
+
+// Creates the libp2p host with the given persistent identity and the offline settings of the config.
+// Matrix's Ed25519 fingerprint key can't be used directly since its private part is never disclosed by the
+// API, so the two are bound by a signed peer binding.
+func newHost(priv cryp.PrivKey, conf *config.OfflineConfig) (host.Host, error) {
+	connmgr, err := connmgr.NewConnManager(
+		conf.LowWater,
+		conf.HighWater,
+		connmgr.WithGracePeriod(conf.GracePeriod),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []libp2p.Option{
+		// Use the keypair stored in the data dir
+		libp2p.Identity(priv),
+		libp2p.ListenAddrStrings(conf.ListenAddrs...),
+		// support TLS connections
+		libp2p.Security(libp2ptls.ID, libp2ptls.New),
+		// Let's prevent our peer from having too many
+		// connections by attaching a connection manager.
+		libp2p.ConnectionManager(connmgr),
+	}
+	for _, transport := range conf.Transports {
+		switch transport {
+		case config.TransportTCP:
+			opts = append(opts, libp2p.Transport(tcp.NewTCPTransport))
+		case config.TransportQUIC:
+			opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+		case config.TransportWebSocket:
+			opts = append(opts, libp2p.Transport(websocket.New))
+		default:
+			return nil, fmt.Errorf("unknown offline transport %q", transport)
+		}
+	}
+
+	host, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Listen Addresses:", host.Addrs())
+
+	return host, nil
+}
+
+// Stores used by the offline routine, kept from when it started so that it never sees the ones Stop clears
+type offlineStores struct {
+	history *HistoryManager
+	queue   *DeliveryQueue
+	peers   *PeerStore
+}
+
+// Runs the offline host until stop is closed, see Stop
+func (c *ClientWrapper) runOffline(stop <-chan struct{}, stores *offlineStores) {
+	defer debug.Recover()
+
+	// The context governs the lifetime of the libp2p node.
+	// Cancelling it will stop the host.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := &c.config.Offline
+	host, err := newHost(c.peerKey, conf)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not create the offline host")
+		return
+	}
+
+	defer host.Close()
+	host.SetStreamHandler(protocolID, func(s network.Stream) {
+		c.handleIncomingStream(s, stores)
+	})
+
+	peers := make(map[peer.ID]peer.AddrInfo) //peers discovered in the local network
+
+	retry := time.NewTicker(conf.RetryInterval)
+	defer retry.Stop()
+
+	//losing the homeserver makes the peers the only way out, so delivery is attempted right away
+	states := c.connectivity.Subscribe()
+	defer c.connectivity.Unsubscribe(states)
+
+	peerChan := offline.InitMDNS(host, conf.Rendezvous)
+	for {
+		select {
+		case <-stop:
+			debug.Print("Stopping offline host...")
+			return
+		case pi := <-peerChan:
+			if pi.ID == host.ID() {
+				continue
+			}
+			fmt.Println("Found peer:", pi)
+			debug.Print("Found peer: " + pi.String())
+			peers[pi.ID] = pi
+		case <-c.sendOff: //a new event was queued, try to deliver it right away
+		case state := <-states:
+			debug.Printf("Homeserver connectivity is now %s, delivering pending events", state)
+			if gaps, _ := stores.history.Gaps(); state == StateOffline && len(gaps) > 0 {
+				//our events in the gaps are only queued once they are fetched, see queueHiddenEvents
+				debug.Printf("History of %d rooms has gaps, events hidden by them are not delivered until they are filled", len(gaps))
+			}
+		case <-retry.C:
+		}
+		c.deliverPending(ctx, host, peers, stores)
+	}
+}
+
+// Tries to deliver every queued event whose backoff has passed to the peers currently in reach
+func (c *ClientWrapper) deliverPending(ctx context.Context, host host.Host, peers map[peer.ID]peer.AddrInfo, stores *offlineStores) {
+	if len(peers) == 0 {
+		return
+	}
+	if err := stores.queue.DropExpired(time.Now()); err != nil {
+		c.logger.Err(err).Msg("Could not drop expired relayed events")
+	}
+	due, err := stores.queue.Due(time.Now())
+	if err != nil {
+		c.logger.Err(err).Msg("Could not read the offline delivery queue")
+		return
+	} else if len(due) == 0 {
+		return
+	}
+
+	attempted := make(map[id.EventID]bool) //events sent to a peer or handed to a relay, only their backoff grows
+	for pid, pi := range peers {
+		binding, err := stores.peers.Get(pid)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not read the peer store")
+			continue
+		} else if binding == nil {
+			continue //only pinned peers are trusted to be who they claim
+		} else if !anyTargets(due, binding.UserID) && !anyRelayable(due, binding.UserID, binding.DeviceID) {
+			continue //this peer is not one of the users missing the events, nor can it carry them
+		}
+
+		user, acked, tried, err := c.deliverTo(ctx, host, pi, due, stores)
+		for _, eventID := range tried {
+			attempted[eventID] = true
+		}
+		for _, eventID := range acked {
+			fmt.Printf("Event with eventID %s was delivered successfully to user with ID %s.", eventID, user)
+			debug.Printf("Event with eventID %s was delivered successfully to user with ID %s.", eventID, user)
+			if err := stores.queue.Ack(eventID, user); err != nil {
+				c.logger.Err(err).Msg("Could not remove acknowledged user from the offline delivery queue")
+			}
+		}
+		if err != nil {
+			debug.Print("Offline delivery to " + pid.String() + " failed: " + err.Error())
+			delete(peers, pid) //will be added again once mDNS finds it
+		}
+	}
+
+	for eventID := range attempted {
+		if err = stores.queue.MarkAttempt(eventID); err != nil {
+			c.logger.Err(err).Msg("Could not update the offline delivery queue")
+		}
+	}
+}
+
+func anyTargets(due []*PendingDelivery, user id.UserID) bool {
+	for _, pending := range due {
+		if pending.Targets(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens a stream to the given peer and runs the offline protocol for the pending events, returning
+// the user behind the peer, the events it acknowledged and the events that were sent or handed to it
+func (c *ClientWrapper) deliverTo(ctx context.Context, host host.Host, pi peer.AddrInfo, due []*PendingDelivery, stores *offlineStores) (id.UserID, []id.EventID, []id.EventID, error) {
+	if err := host.Connect(ctx, pi); err != nil {
+		return "", nil, nil, fmt.Errorf("connection failed: %w", err)
+	}
+
+	// open a stream, this stream will be handled by handleIncomingStream other end
+	stream, err := host.NewStream(ctx, pi.ID, protocolID)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("stream open failed: %w", err)
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(offlineStreamTimeout))
+
+	fmt.Println("Connected to:", pi)
+	debug.Print("Connected to: " + pi.String())
+	return c.sendOffline(newPeerConn(stream), due, stores)
+}
+
+func (c *ClientWrapper) handleIncomingStream(s network.Stream, stores *offlineStores) {
+	defer debug.Recover()
+	debug.Print("Got a new stream!")
+	fmt.Println("Got a new stream!")
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(offlineStreamTimeout))
+
+	//if stream is incoming, it means we are offline, therefore only need to do the receiving end of the logic
+	fmt.Println("Starting to read from stream...")
+	if err := c.readData(newPeerConn(s), stores); err != nil {
+		c.logger.Err(err).Msg("Offline exchange with " + s.Conn().RemotePeer().String() + " failed")
+	}
+}
+
+// Runs the sending side of the offline protocol, delivering every pending event that targets the user behind the peer.
+// Besides the acknowledged events, it returns the ones that were tried, i.e. sent to the peer or handed to it to carry.
+func (c *ClientWrapper) sendOffline(conn *peerConn, due []*PendingDelivery, stores *offlineStores) (user id.UserID, acked, tried []id.EventID, err error) {
+	fmt.Println("Starting protocol to send event with matrix encryption.")
+	offlineHost, err := c.credentialsToOffline(conn, stores.peers)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	user = offlineHost.UserID
+
+	//the keys of the host device come from the crypto store, kept fresh by runKeyRefresh while online
+	idKey, edKey := offlineHost.IdentityKey, offlineHost.SigningKey
+
+	for _, pending := range due {
+		if !pending.Targets(user) {
+			continue
+		}
+		tried = append(tried, pending.EventID)
+		ok, err := c.sendOfflineEvent(conn, offlineHost, idKey, edKey, pending)
+		if err != nil {
+			return user, acked, tried, err
+		} else if ok {
+			acked = append(acked, pending.EventID)
+		}
+	}
+
+	//the events for other users are handed over for the host to carry
+	now := time.Now()
+	for _, pending := range due {
+		if !pending.Relayable(user, offlineHost.DeviceID, now) {
+			continue
+		}
+		ok, err := c.sendRelay(conn, offlineHost, pending)
+		if err != nil {
+			return user, acked, tried, err
+		} else if !ok {
+			continue
+		}
+		tried = append(tried, pending.EventID)
+		debug.Printf("Event %s is carried by device %s of %s", pending.EventID, offlineHost.DeviceID, user)
+		if err = stores.queue.MarkCarried(pending.EventID, user, offlineHost.DeviceID); err != nil {
+			c.logger.Err(err).Msg("Could not update the offline delivery queue")
+		}
+	}
+	return user, acked, tried, nil
+}
+
+// Sends a single event to the offline host, forwarding its megolm session if the host asks for it
+func (c *ClientWrapper) sendOfflineEvent(conn *peerConn, offlineHost *id.Device, idKey id.Curve25519, edKey id.Ed25519, pending *PendingDelivery) (bool, error) {
+	//First assume a Megolm session has also been shared with the offline device previously and send the encrypted event as normal.
+	//In case the offline client cannot decrypt it, then share the megolm session a posteriori.
+	//Events we relay for someone else are sent as the ciphertext we were given.
+	evt, err := c.relayedCiphertext(pending)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not prepare queued event " + pending.EventID.String())
+		return false, nil
+	}
+	if err = conn.Encode(wire.TypeEncryptedEvent, evt); err != nil {
+		return false, err
+	}
+
+	//Wait for the other client's response here -> can be a key request or an ACK
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return false, err
+		}
+
+		switch frame.Type {
+		case wire.TypeAck:
+			var ack wire.Ack
+			if err = frame.Decode(&ack); err != nil {
+				return false, err
+			}
+			return ack.EventID == pending.EventID && ack.UserID == offlineHost.UserID, nil
+		case wire.TypeNack:
+			var nack wire.Nack
+			if err = frame.Decode(&nack); err != nil {
+				return false, err
+			}
+			debug.Printf("Offline host could not handle event %s: %s", nack.EventID, nack.Reason)
+			return false, nil
+		case wire.TypeKeyRequest:
+			var keyReq event.RoomKeyRequestEventContent
+			if err = frame.Decode(&keyReq); err != nil {
+				return false, err
+			}
+			//only the session of the event being delivered is forwarded, under the same policy as online key requests
+			var code event.RoomKeyWithheldCode
+			var reason string
+			if content, ok := evt.Content.Parsed.(*event.EncryptedEventContent); !ok || keyReq.Body.RoomID != pending.RoomID ||
+				keyReq.Body.SessionID != content.SessionID || keyReq.Body.SenderKey != content.SenderKey {
+				code, reason = event.RoomKeyWithheldUnauthorized, "the key request does not match the delivered event"
+			} else {
+				code, reason = c.keyRequestDecision(offlineHost, keyReq.Body)
+			}
+			if code != "" {
+				if err = conn.Encode(wire.TypeWithheld, withheldNotice(keyReq.Body, code, reason)); err != nil {
+					return false, err
+				}
+				continue //the host answers with a NACK for the event
+			}
+			forwarded, err := c.forwardKeyOffline(&keyReq, offlineHost, idKey, edKey)
+			if err != nil {
+				c.logger.Err(err).Msg("Could not forward the room key to the offline host")
+				return false, conn.Encode(wire.TypeNack, &wire.Nack{EventID: pending.EventID, Reason: err.Error()})
+			}
+			if err = conn.Encode(wire.TypeForwardedKey, forwarded); err != nil {
+				return false, err
+			}
+			//the host now answers with an ACK or NACK for the event
+		case wire.TypeError:
+			remote := &wire.Error{}
+			_ = frame.Decode(remote)
+			return false, remote
+		default:
+			return false, fmt.Errorf("%w: %s", wire.ErrUnexpectedFrame, frame.Type)
+		}
+	}
+}
+
+// Builds the olm encrypted forwarded room key event answering a key request of the offline host
+func (c *ClientWrapper) forwardKeyOffline(keyReq *event.RoomKeyRequestEventContent, offlineHost *id.Device, idKey id.Curve25519, edKey id.Ed25519) (*event.Event, error) {
+	//An Olm session with the identity key of the offline client is needed to share the megolm session,
+	//a new one is started from the key prefetched for that device if they never exchanged Olm messages
+	olmSesh, err := c.olmSessionWith(offlineHost, idKey)
+	if err != nil {
+		return nil, err
+	}
+
+	forwardedRoomKey, err := c.parseKeyRequestEvent(keyReq)
+	if err != nil {
+		return nil, err
+	}
+
+	olmContent := c.encryptOlm(idKey, edKey, olmSesh, offlineHost.UserID, event.ToDeviceForwardedRoomKey, forwardedRoomKey)
+	return &event.Event{
+		Sender:  c.client.UserID,
+		Type:    event.ToDeviceEncrypted,
+		Content: event.Content{Parsed: olmContent},
+	}, nil
+}
+
+// Runs the receiving side of the offline protocol, until the online host closes the stream
+func (c *ClientWrapper) readData(conn *peerConn, stores *offlineStores) error {
+	fmt.Println("Exchanging Matrix credentials...")
+	hostDevice, err := c.credentialsToOnline(conn, stores.peers)
+	if err != nil {
+		return err
+	}
+
+	for {
+		frame, err := conn.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch frame.Type {
+		case wire.TypeEncryptedEvent:
+		case wire.TypeRelay:
+			if err = c.receiveRelay(conn, frame, stores); err != nil {
+				return err
+			}
+			continue
+		case wire.TypeError:
+			remote := &wire.Error{}
+			_ = frame.Decode(remote)
+			return remote
+		default:
+			return fmt.Errorf("%w: %s", wire.ErrUnexpectedFrame, frame.Type)
+		}
+
+		var missingEvt event.Event
+		if err = decodeEvent(frame, &missingEvt); err != nil {
+			return err
+		}
+		fmt.Println("Received encrypted event from online host.")
+		if err = c.receiveOfflineEvent(conn, hostDevice, &missingEvt, stores.history); err != nil {
+			return err
+		}
+	}
+}
+
+// Stores a single event received from the online host, asking it for the megolm session if needed
+func (c *ClientWrapper) receiveOfflineEvent(conn *peerConn, hostDevice *id.Device, missingEvt *event.Event, history *HistoryManager) error {
+	room := c.GetOrCreateRoom(missingEvt.RoomID)
+	ack := &wire.Ack{EventID: missingEvt.ID, UserID: c.client.UserID, DeviceID: c.client.DeviceID}
+
+	if existing, _ := history.Get(room, missingEvt.ID); existing != nil && existing.Type != mxevents.EventBadEncrypted {
+		debug.Print("Event is already stored, probably was already sent by another host")
+		fmt.Println("Event is already stored, acknowledging it to the host")
+		return conn.Encode(wire.TypeAck, ack)
+	}
+
+	//the event was sent offline and has no server copy yet, remember it to recognise that copy once it syncs
+	if content, ok := missingEvt.Content.Parsed.(*event.EncryptedEventContent); ok && isLocalEcho(missingEvt.ID) {
+		if err := history.TrackLocalEcho(room.ID, missingEvt.ID, content); err != nil {
+			c.logger.Err(err).Msg("Could not track event " + missingEvt.ID.String() + " sent offline")
+		}
+	}
+
+	evt, err := c.crypto.DecryptMegolmEvent(context.TODO(), missingEvt)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not decrypt event received offline")
+
+		//Ask for megolm session details here -> build m.room.key.request event
+		content := missingEvt.Content.AsEncrypted()
+		keyReq := c.buildKeyRequest(missingEvt.RoomID, content.SenderKey, content.SessionID)
+		if err = conn.Encode(wire.TypeKeyRequest, keyReq); err != nil {
+			return err
+		}
+
+		evt, err = c.receiveForwardedKey(conn, missingEvt)
+		if err != nil {
+			var nack *nackError
+			if !errors.As(err, &nack) {
+				return err
+			}
+			c.logger.Err(err).Msg("Could not decrypt event " + missingEvt.ID.String() + " received offline")
+			c.addMessageToHistory(room, badEncrypted(missingEvt, err))
+			if nack.local { //the host is waiting for our answer
+				return conn.Encode(wire.TypeNack, &wire.Nack{EventID: missingEvt.ID, Reason: err.Error()})
+			}
+			return nil
+		}
+	}
+
+	c.addMessageToHistory(room, evt)
+	fmt.Printf("Message with eventID %s was received successfully.", evt.ID)
+	return conn.Encode(wire.TypeAck, ack)
+}
+
+// nackError is a failure to handle a single event that does not abort the whole exchange
+type nackError struct {
+	reason string
+	local  bool //whether the failure happened on our side, rather than being reported by the host
+}
+
+func (e *nackError) Error() string {
+	return e.reason
+}
+
+// Waits for the olm encrypted room key sent by the online host and uses it to decrypt the missing event
+func (c *ClientWrapper) receiveForwardedKey(conn *peerConn, missingEvt *event.Event) (*event.Event, error) {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	switch frame.Type {
+	case wire.TypeForwardedKey:
+	case wire.TypeWithheld:
+		var withheld event.RoomKeyWithheldEventContent
+		if err = frame.Decode(&withheld); err != nil {
+			return nil, err
+		}
+		if err = c.crypto.CryptoStore.PutWithheldGroupSession(withheld); err != nil {
+			c.logger.Err(err).Msg("Could not store withheld room key")
+		}
+		return nil, &nackError{reason: "host withheld the room key: " + withheld.Error(), local: true}
+	case wire.TypeNack:
+		var nack wire.Nack
+		_ = frame.Decode(&nack)
+		return nil, &nackError{reason: "host could not forward the room key: " + nack.Reason}
+	case wire.TypeError:
+		remote := &wire.Error{}
+		_ = frame.Decode(remote)
+		return nil, remote
+	default:
+		return nil, fmt.Errorf("%w: %s", wire.ErrUnexpectedFrame, frame.Type)
+	}
+
+	var encrypted event.Event
+	if err = decodeEvent(frame, &encrypted); err != nil {
+		return nil, err
+	}
+
+	//Decrypt the event with Olm
+	decryptedEvt, err := c.decryptOlm(context.Background(), &encrypted)
+	if err != nil {
+		return nil, &nackError{reason: "could not decrypt olm event: " + err.Error(), local: true}
+	}
+	decryptedContent, ok := decryptedEvt.Content.Parsed.(*event.ForwardedRoomKeyEventContent)
+	if !ok {
+		return nil, &nackError{reason: "olm event is not a forwarded room key", local: true}
+	}
+
+	//Update the megolm session
+	if !c.importForwardedRoomKey(context.Background(), decryptedEvt, decryptedContent) {
+		return nil, &nackError{reason: "could not import forwarded room key", local: true}
+	}
+	c.logger.Trace().Msg("Handled forwarded room key event")
+
+	//Should now be able to decrypt
+	evt, err := c.crypto.DecryptMegolmEvent(context.TODO(), missingEvt)
+	if err != nil {
+		return nil, &nackError{reason: err.Error(), local: true}
+	}
+	return evt, nil
+}
+
+func (c *ClientWrapper) credentialsToOnline(conn *peerConn, peers *PeerStore) (*id.Device, error) {
+	//receive other host's client credentials
+	hostDevice, err := c.receiveCredentials(conn, peers)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Received online host's credentials.")
+
+	//send our credentials to connected host
+	if err = c.sendCredentials(conn); err != nil {
+		return nil, err
+	}
+	fmt.Println("Sent credentials to online host.")
+
+	//each side proves it holds the signing key of the device it presented: the online host challenges first,
+	//so this side answers with its proof and only then challenges the host
+	if err = c.proveIdentity(conn); err != nil {
+		return nil, err
+	}
+	if err = c.challengeHost(conn, hostDevice); err != nil {
+		return nil, err
+	}
+	fmt.Println("Mutual authentication with online host done.")
+
+	return hostDevice, nil
+}
+
+func (c *ClientWrapper) credentialsToOffline(conn *peerConn, peers *PeerStore) (*id.Device, error) {
+	//send our credentials to connected host
+	if err := c.sendCredentials(conn); err != nil {
+		return nil, err
+	}
+	fmt.Println("Sent credentials to offline host.")
+
+	//receive other host's client credentials
+	hostDevice, err := c.receiveCredentials(conn, peers)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Received offline host's credentials.")
+
+	if err = c.challengeHost(conn, hostDevice); err != nil {
+		return nil, err
+	}
+	if err = c.proveIdentity(conn); err != nil {
+		return nil, err
+	}
+	fmt.Println("Mutual authentication with offline host done.")
+
+	return hostDevice, nil
+}
+
+func (c *ClientWrapper) sendCredentials(conn *peerConn) error {
+	selfID, err := c.crypto.CryptoStore.GetDevice(c.client.UserID, c.client.DeviceID)
+	if err != nil { //since the store used by the crypto module is a db, this probably won't fail while offline
+		c.logger.Err(err).Msg("Could not fetch own device info from crypto store")
+		return err
+	} else if selfID == nil {
+		selfID = c.crypto.OwnIdentity()
+	}
+	return conn.Encode(wire.TypeCredentials, selfID)
+}
+
+// Unmarshals an event sent in a frame and parses its content
+func decodeEvent(frame *wire.Frame, evt *event.Event) error {
+	if err := json.Unmarshal(frame.Payload, evt); err != nil {
+		return err
+	}
+	return evt.Content.ParseRaw(evt.Type)
+}
+
+// Replaces the content of an event that could not be decrypted, so that it can still be stored in history
+func badEncrypted(evt *event.Event, err error) *event.Event {
+	evt.Type = mxevents.EventBadEncrypted
+	origContent, _ := evt.Content.Parsed.(*event.EncryptedEventContent)
+	evt.Content.Parsed = &mxevents.BadEncryptedContent{
+		Original: origContent,
+		Reason:   err.Error(),
+	}
+	return evt
+}
@@ -0,0 +1,321 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"thesgo/matrix/mxevents"
+	"thesgo/matrix/rooms"
+)
+
+var bucketOutbox = []byte("outbox")
+
+// Events sent while the homeserver is unreachable get a temporary ID made of this prefix and their transaction ID
+const localEchoPrefix = "~"
+
+func isLocalEcho(eventID id.EventID) bool {
+	return strings.HasPrefix(string(eventID), localEchoPrefix)
+}
+
+// OutboxEntry is an event sent while disconnected, waiting to be uploaded to the homeserver
+type OutboxEntry struct {
+	TxnID   string        `json:"txn_id"`
+	RoomID  id.RoomID     `json:"room_id"`
+	LocalID id.EventID    `json:"local_id"` //temporary ID of the local echo stored in history
+	Type    event.Type    `json:"type"`
+	Content event.Content `json:"content"` //already encrypted if the room is, so peers and server get the same ciphertext
+	Created time.Time     `json:"created"`
+
+	// Encrypt tells that the content is still plaintext, as no megolm session could be shared while offline.
+	// It is encrypted for the room right before being uploaded.
+	Encrypt bool `json:"encrypt,omitempty"`
+}
+
+// Outbox persists the events sent while disconnected in the data store, so clearing the cache does not drop them
+type Outbox struct {
+	db    *bolt.DB
+	flush sync.Mutex //only one upload of the outbox at a time
+}
+
+func NewOutbox(ds *DataStore) (*Outbox, error) {
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketOutbox)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{db: ds.db}, nil
+}
+
+func (ob *Outbox) Put(entry *OutboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ob.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutbox).Put([]byte(entry.TxnID), data)
+	})
+}
+
+// All returns every waiting event, oldest first
+func (ob *Outbox) All() (entries []*OutboxEntry, err error) {
+	err = ob.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutbox).ForEach(func(_, v []byte) error {
+			entry := &OutboxEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return
+}
+
+func (ob *Outbox) Delete(txnID string) error {
+	return ob.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutbox).Delete([]byte(txnID))
+	})
+}
+
+// Whether a request failed because the homeserver could not be reached, rather than being refused by it.
+// Gateway and timeout statuses come from a proxy in front of a homeserver it cannot reach.
+func isConnectivityError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Response == nil {
+		return false
+	}
+	switch httpErr.Response.StatusCode {
+	case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Keeps an event that could not reach the homeserver: it is stored in history as a local echo, handed to the
+// reachable peers if the room is encrypted, and uploaded with the same transaction ID once back online.
+// plain is the event before encryption, sent is the event as it would have been uploaded. If the room is
+// encrypted but sent is not, it is encrypted when uploaded and cannot be handed to peers until then.
+func (c *ClientWrapper) sendLater(room *rooms.Room, plain *event.Event, sent *mxevents.Event) (id.EventID, error) {
+	txnID := sent.Unsigned.TransactionID
+	if txnID == "" {
+		txnID = c.client.TxnID()
+	}
+	localID := id.EventID(localEchoPrefix + txnID)
+	err := c.outbox.Put(&OutboxEntry{
+		TxnID:   txnID,
+		RoomID:  room.ID,
+		LocalID: localID,
+		Type:    sent.Type,
+		Content: sent.Content,
+		Created: time.Now(),
+		Encrypt: c.encryptsFor(room, sent.Type),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	echo := *plain
+	echo.ID = localID
+	echo.Sender = c.client.UserID
+	echo.Timestamp = time.Now().UnixMilli()
+	echo.Unsigned.TransactionID = txnID
+	if _, err = c.history.Append(room, []*event.Event{&echo}); err != nil {
+		return "", err
+	}
+	err = c.history.Update(room, localID, func(evt *mxevents.Event) error {
+		evt.Cont.OutgoingState = mxevents.StateLocalEcho
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, ok := sent.Content.Parsed.(*event.EncryptedEventContent)
+	if ok {
+		if err = c.history.TrackLocalEcho(room.ID, localID, encrypted); err != nil {
+			return "", err
+		}
+		c.queueLocalEcho(room, localID, echo.Timestamp, sent)
+	}
+	c.logger.Info().Msg("Homeserver unreachable, event " + localID.String() + " will be uploaded once online")
+	return localID, nil
+}
+
+// Queues the ciphertext of an event sent offline for delivery to the other members through the peers in reach.
+// It is queued as our own event, under its temporary ID until reconcileLocalEcho learns the server one.
+func (c *ClientWrapper) queueLocalEcho(room *rooms.Room, localID id.EventID, timestamp int64, sent *mxevents.Event) {
+	if c.queue == nil {
+		return
+	}
+	var users []id.UserID
+	for _, user := range room.GetMemberList() {
+		if user != c.client.UserID {
+			users = append(users, user)
+		}
+	}
+	c.enqueueDelivery(room.ID, localID, &event.Event{
+		ID:        localID,
+		Sender:    c.client.UserID,
+		RoomID:    room.ID,
+		Timestamp: timestamp,
+		Type:      sent.Type,
+		Content:   sent.Content,
+	}, users)
+}
+
+// Sync handler that reports the homeserver as reachable, uploads the outbox and resumes filling the gaps in history
+func (c *ClientWrapper) syncSucceeded(_ *mautrix.RespSync, _ string) bool {
+	c.connectivity.ReportSuccess()
+	go c.flushOutbox()
+	go c.backfillGaps()
+	return true
+}
+
+// Uploads the events sent while disconnected, in order, with their original transaction IDs. Their local
+// echoes get the server event ID once the server copy comes back through sync, see reconcileLocalEcho.
+func (c *ClientWrapper) flushOutbox() {
+	defer debug.Recover()
+	outbox := c.outbox
+	if outbox == nil || !outbox.flush.TryLock() {
+		return
+	}
+	defer outbox.flush.Unlock()
+
+	entries, err := outbox.All()
+	if err != nil {
+		c.logger.Err(err).Msg("Could not read the outbox")
+		return
+	}
+	for _, entry := range entries {
+		if entry.Encrypt {
+			err = c.encryptEntry(outbox, entry)
+			if isConnectivityError(err) {
+				c.connectivity.ReportFailure(err)
+				return
+			} else if err != nil {
+				c.logger.Err(err).Msg("Could not encrypt event " + entry.LocalID.String() + " sent offline")
+				continue
+			}
+		}
+		resp, err := c.client.SendMessageEvent(entry.RoomID, entry.Type, &entry.Content, mautrix.ReqSendEvent{TransactionID: entry.TxnID})
+		if isConnectivityError(err) {
+			c.connectivity.ReportFailure(err)
+			return //still offline, the next sync tries again
+		}
+		state := mxevents.StateDefault
+		if err != nil {
+			c.logger.Err(err).Msg("Homeserver refused event " + entry.LocalID.String() + " sent offline")
+			state = mxevents.StateSendFail
+		} else {
+			debug.Printf("Uploaded event %s sent offline as %s", entry.LocalID, resp.EventID)
+		}
+		err = c.history.Update(c.GetOrCreateRoom(entry.RoomID), entry.LocalID, func(evt *mxevents.Event) error {
+			evt.Cont.OutgoingState = state
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrEventNotFound) {
+			c.logger.Err(err).Msg("Could not update local echo " + entry.LocalID.String())
+		}
+		if err = outbox.Delete(entry.TxnID); err != nil {
+			c.logger.Err(err).Msg("Could not remove event from the outbox")
+		}
+	}
+}
+
+// Encrypts the plaintext of an outbox entry for its room and stores the ciphertext, so that a retry of the
+// upload sends the same one under the same transaction ID
+func (c *ClientWrapper) encryptEntry(outbox *Outbox, entry *OutboxEntry) error {
+	if c.crypto == nil {
+		return errors.New("encryption is not enabled")
+	}
+	if err := entry.Content.ParseRaw(entry.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return err
+	}
+	encrypted, err := c.encryptEvent(c.GetOrCreateRoom(entry.RoomID), entry.Type, &entry.Content)
+	if err != nil {
+		return err
+	}
+	entry.Type = event.EventEncrypted
+	entry.Content = event.Content{Parsed: encrypted}
+	entry.Encrypt = false
+	return outbox.Put(entry)
+}
+
+// Replaces the temporary ID of an event sent offline with its server event ID when the server copy is synced.
+// The sender recognises it by its transaction ID, peers by its megolm ciphertext. Returns whether the event
+// was a local echo, in which case it must not be stored again.
+func (c *ClientWrapper) reconcileLocalEcho(room *rooms.Room, mxEvent *event.Event) bool {
+	if c.history == nil || isLocalEcho(mxEvent.ID) {
+		return false
+	}
+	var localID id.EventID
+	encrypted, _ := mxEvent.Content.Parsed.(*event.EncryptedEventContent)
+	if mxEvent.Sender == c.client.UserID && mxEvent.Unsigned.TransactionID != "" {
+		localID = id.EventID(localEchoPrefix + mxEvent.Unsigned.TransactionID)
+		if existing, _ := c.history.Get(room, localID); existing == nil {
+			localID = ""
+		}
+	}
+	if localID == "" && encrypted != nil {
+		if roomID, eventID, err := c.history.LocalEcho(encrypted); err == nil && roomID == room.ID {
+			localID = eventID
+		}
+	}
+	if localID == "" {
+		return false
+	}
+
+	var waitingSession id.SessionID //the old ID must leave the index of events waiting for their key
+	err := c.history.Update(room, localID, func(evt *mxevents.Event) error {
+		if content, ok := evt.Content.Parsed.(*mxevents.BadEncryptedContent); ok && content.Original != nil {
+			waitingSession = content.Original.SessionID
+		}
+		evt.ID = mxEvent.ID
+		evt.Timestamp = mxEvent.Timestamp
+		evt.Cont.OutgoingState = mxevents.StateDefault
+		return nil
+	})
+	if err != nil {
+		c.logger.Err(err).Msg("Could not reconcile local echo " + localID.String())
+		return false
+	}
+	if waitingSession != "" {
+		_ = c.history.ForgetUndecrypted(waitingSession, localID)
+	}
+	if encrypted != nil {
+		_ = c.history.ForgetLocalEcho(encrypted)
+	}
+	if queue := c.queue; queue != nil && mxEvent.Sender == c.client.UserID {
+		if err = queue.Rekey(localID, mxEvent.ID); err != nil {
+			c.logger.Err(err).Msg("Could not update the offline delivery of " + localID.String())
+		}
+	}
+	debug.Printf("Event %s sent offline is now %s", localID, mxEvent.ID)
+	if c.config.AuthCache.InitialSyncDone && mxEvent.Sender != c.client.UserID {
+		_ = c.MarkRead(room.ID, mxEvent.ID)
+	}
+	return true
+}
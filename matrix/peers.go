@@ -0,0 +1,230 @@
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"thesgo/matrix/mxevents"
+)
+
+var bucketPeerBindings = []byte("peer_bindings")
+
+var ErrPeerPinned = errors.New("peer is already pinned to another device")
+
+// Builds the message signed by a device to bind itself to a libp2p peer ID
+func peerBindingMessage(user id.UserID, device id.DeviceID, peerID string) string {
+	return strings.Join([]string{"thesgo.offline.peer_binding.v1", user.String(), device.String(), peerID}, "|")
+}
+
+// PeerStore pins the libp2p peer ID of every Matrix device we know of. Only bindings signed by both the device
+// and the peer are pinned, as peer IDs are public. It lives in the data store, so clearing the cache keeps the pins.
+type PeerStore struct {
+	db *bolt.DB
+}
+
+func NewPeerStore(ds *DataStore) (*PeerStore, error) {
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketPeerBindings)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PeerStore{db: ds.db}, nil
+}
+
+// Get returns the binding pinned for the given peer, or nil if the peer is unknown
+func (ps *PeerStore) Get(pid peer.ID) (binding *mxevents.PeerBindingContent, err error) {
+	err = ps.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketPeerBindings).Get([]byte(pid))
+		if data == nil {
+			return nil
+		}
+		binding = &mxevents.PeerBindingContent{}
+		return json.Unmarshal(data, binding)
+	})
+	return
+}
+
+// Pin stores the binding of a device, replacing any older peer ID of that same device.
+// A peer that is already pinned to a different device is never rebound.
+func (ps *PeerStore) Pin(binding *mxevents.PeerBindingContent) error {
+	return ps.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketPeerBindings)
+		var stale [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var existing mxevents.PeerBindingContent
+			if err := json.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			sameDevice := existing.UserID == binding.UserID && existing.DeviceID == binding.DeviceID
+			if string(k) == binding.PeerID && !sameDevice {
+				return ErrPeerPinned
+			} else if sameDevice && string(k) != binding.PeerID {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(binding)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(binding.PeerID), data)
+	})
+}
+
+// Signs the binding between our own device and the peer ID of the offline host
+func (c *ClientWrapper) ownPeerBinding() *mxevents.PeerBindingContent {
+	msg := peerBindingMessage(c.client.UserID, c.client.DeviceID, c.peerID.String())
+	return &mxevents.PeerBindingContent{
+		UserID:    c.client.UserID,
+		DeviceID:  c.client.DeviceID,
+		PeerID:    c.peerID.String(),
+		Signature: string(c.crypto.GetAccount().Internal.Sign([]byte(msg))),
+	}
+}
+
+// Checks the signature of a binding against the signing key of the device stored in the crypto store
+func (c *ClientWrapper) verifyPeerBinding(binding *mxevents.PeerBindingContent) error {
+	device, err := c.crypto.CryptoStore.GetDevice(binding.UserID, binding.DeviceID)
+	if err != nil {
+		return err
+	} else if device == nil {
+		return fmt.Errorf("device %s of %s is not known", binding.DeviceID, binding.UserID)
+	}
+	if _, err = peer.Decode(binding.PeerID); err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	msg := peerBindingMessage(binding.UserID, binding.DeviceID, binding.PeerID)
+	ok, err := olm.NewUtility().VerifySignature(msg, device.SigningKey, binding.Signature)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("invalid signature on peer binding of device %s of %s", binding.DeviceID, binding.UserID)
+	}
+	return nil
+}
+
+// Sends the binding of our device to every user we share a room with, so they can recognise our offline host
+func (c *ClientWrapper) publishPeerBinding() {
+	defer debug.Recover()
+	resp, err := c.client.JoinedRooms()
+	if err != nil {
+		c.logger.Err(err).Msg("Could not fetch joined rooms to publish peer binding")
+		return
+	}
+
+	var users []id.UserID
+	for _, roomID := range resp.JoinedRooms {
+		members, err := c.client.JoinedMembers(roomID)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not fetch members of " + roomID.String())
+			continue
+		}
+		for user := range members.Joined {
+			users = append(users, user)
+		}
+	}
+	c.sendPeerBinding(users)
+}
+
+// Sends the binding of our device to every device of the given users
+func (c *ClientWrapper) sendPeerBinding(users []id.UserID) {
+	defer debug.Recover()
+	if len(users) == 0 {
+		return
+	}
+	binding := c.ownPeerBinding()
+	req := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	for _, user := range users {
+		req.Messages[user] = map[id.DeviceID]*event.Content{"*": {Parsed: binding}}
+	}
+
+	if _, err := c.client.SendToDevice(mxevents.ToDevicePeerBinding, req); err != nil {
+		c.logger.Err(err).Msg("Could not publish peer binding")
+		return
+	}
+	debug.Printf("Published peer binding for %s to %d users", c.peerID, len(users))
+}
+
+// Sends our binding to users who join a room after it was published on start, or to every member of a room we join
+func (c *ClientWrapper) announcePeerOnJoin(_ mautrix.EventSource, evt *event.Event) {
+	if !c.syncer.FirstSyncDone || evt.StateKey == nil {
+		return //the binding is published to everyone once the first sync is done
+	}
+	membership := evt.Content.AsMember().Membership
+	if membership != event.MembershipJoin {
+		return
+	} else if evt.Unsigned.PrevContent != nil && evt.Unsigned.PrevContent.AsMember().Membership == event.MembershipJoin {
+		return //profile changes are sent as joins too
+	}
+
+	user := id.UserID(*evt.StateKey)
+	if user != c.client.UserID {
+		go c.sendPeerBinding([]id.UserID{user})
+		return
+	}
+	go func() {
+		defer debug.Recover()
+		members, err := c.client.JoinedMembers(evt.RoomID)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not fetch members of " + evt.RoomID.String())
+			return
+		}
+		users := make([]id.UserID, 0, len(members.Joined))
+		for member := range members.Joined {
+			users = append(users, member)
+		}
+		c.sendPeerBinding(users)
+	}()
+}
+
+// Sends our binding again to users whose device list changed, as their new devices have not seen it yet
+func (c *ClientWrapper) announcePeerToNewDevices(resp *mautrix.RespSync, _ string) bool {
+	if c.syncer.FirstSyncDone && len(resp.DeviceLists.Changed) > 0 {
+		go c.sendPeerBinding(resp.DeviceLists.Changed)
+	}
+	return true
+}
+
+// HandlePeerBinding pins the peer ID announced by another device, if the announcement is correctly signed
+func (c *ClientWrapper) HandlePeerBinding(source mautrix.EventSource, evt *event.Event) {
+	binding, ok := evt.Content.Parsed.(*mxevents.PeerBindingContent)
+	if !ok || binding.UserID != evt.Sender {
+		return
+	}
+	if err := c.verifyPeerBinding(binding); err != nil {
+		c.logger.Err(err).Msg("Rejected peer binding from " + evt.Sender.String())
+		return
+	}
+	if err := c.peers.Pin(binding); err != nil {
+		c.logger.Err(err).Msg("Could not pin peer " + binding.PeerID)
+		return
+	}
+	debug.Printf("Pinned peer %s to device %s of %s", binding.PeerID, binding.DeviceID, binding.UserID)
+	go func() {
+		defer debug.Recover()
+		if err := c.prefetchPreKey(binding.UserID, binding.DeviceID); err != nil {
+			c.logger.Err(err).Msg("Could not prefetch the key of device " + binding.DeviceID.String())
+		}
+	}()
+}
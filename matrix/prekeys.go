@@ -0,0 +1,256 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+)
+
+var bucketPreKeys = []byte("prekeys")
+
+// A one-time or fallback key claimed from the server for a peer device while online, used to start an Olm
+// session with that device offline if none exists yet
+type cachedPreKey struct {
+	IdentityKey id.Curve25519 `json:"identity_key"` //identity key of the device the key belongs to
+	KeyID       id.KeyID      `json:"key_id"`
+	Key         id.Curve25519 `json:"key"`
+	Fallback    bool          `json:"fallback"` //fallback keys can be used more than once
+	Claimed     time.Time     `json:"claimed"`
+}
+
+// PreKeyCache keeps one claimed key per peer device, refreshed in the background by runKeyRefresh.
+// It lives in the same bolt database as the event history.
+type PreKeyCache struct {
+	db *bolt.DB
+}
+
+func NewPreKeyCache(hm *HistoryManager) (*PreKeyCache, error) {
+	err := hm.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketPreKeys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PreKeyCache{db: hm.db}, nil
+}
+
+func preKeyID(user id.UserID, device id.DeviceID) []byte {
+	return []byte(user.String() + "|" + device.String())
+}
+
+// Get returns the key cached for a device, or nil if there is none
+func (pc *PreKeyCache) Get(user id.UserID, device id.DeviceID) (key *cachedPreKey, err error) {
+	err = pc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketPreKeys).Get(preKeyID(user, device))
+		if data == nil {
+			return nil
+		}
+		key = &cachedPreKey{}
+		return json.Unmarshal(data, key)
+	})
+	return
+}
+
+func (pc *PreKeyCache) Put(user id.UserID, device id.DeviceID, key *cachedPreKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return pc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPreKeys).Put(preKeyID(user, device), data)
+	})
+}
+
+func (pc *PreKeyCache) Delete(user id.UserID, device id.DeviceID) error {
+	return pc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPreKeys).Delete(preKeyID(user, device))
+	})
+}
+
+// Keeps the device keys of every member of our joined rooms fresh in the crypto store, and a claimed key for each
+// of their devices we have no Olm session with, so the offline protocol never needs the homeserver.
+// Runs until the client stops or the cache is replaced.
+func (c *ClientWrapper) runKeyRefresh(pc *PreKeyCache) {
+	defer debug.Recover()
+	ticker := time.NewTicker(c.config.Offline.KeyRefresh)
+	defer ticker.Stop()
+	for {
+		if c.crypto == nil || c.preKeys != pc {
+			return
+		}
+		c.refreshPeerKeys()
+		<-ticker.C
+	}
+}
+
+// Fetches the devices of every member of the joined rooms and claims the keys missing from the cache. Skipped while
+// offline, as both need the homeserver.
+func (c *ClientWrapper) refreshPeerKeys() {
+	if c.IsOffline() {
+		return
+	}
+	joined, err := c.RoomsJoined()
+	if err != nil {
+		return
+	}
+	members := make(map[id.UserID]struct{})
+	var users []id.UserID
+	for _, room := range joined {
+		for _, user := range room.GetMemberList() {
+			if _, ok := members[user]; !ok {
+				members[user] = struct{}{}
+				users = append(users, user)
+			}
+		}
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	fetched, err := c.fetchKeys(users)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not fetch keys of peer devices")
+		return
+	}
+	var devices []*id.Device
+	for _, userDevices := range fetched {
+		for _, device := range userDevices {
+			if device.UserID == c.client.UserID && device.DeviceID == c.client.DeviceID {
+				continue
+			}
+			devices = append(devices, device)
+		}
+	}
+	if err = c.claimPreKeys(devices); err != nil {
+		c.logger.Err(err).Msg("Could not claim keys of peer devices")
+		return
+	}
+	debug.Printf("Refreshed the keys of %d devices of %d users", len(devices), len(users))
+}
+
+// Claims the key of a single device, used as soon as a peer binding of that device arrives
+func (c *ClientWrapper) prefetchPreKey(user id.UserID, deviceID id.DeviceID) error {
+	device, err := c.crypto.GetOrFetchDevice(context.TODO(), user, deviceID)
+	if err != nil {
+		return err
+	}
+	return c.claimPreKeys([]*id.Device{device})
+}
+
+// Claims a one-time key of every given device from the server, or its fallback key if it ran out of them, and
+// caches it. Nothing is claimed for a device that has a key cached for its current identity key or an Olm session.
+func (c *ClientWrapper) claimPreKeys(devices []*id.Device) error {
+	preKeys := c.preKeys
+	if preKeys == nil {
+		return nil
+	}
+	request := make(mautrix.OneTimeKeysRequest)
+	byID := make(map[id.UserID]map[id.DeviceID]*id.Device)
+	for _, device := range devices {
+		cached, err := preKeys.Get(device.UserID, device.DeviceID)
+		if err != nil {
+			return err
+		} else if cached != nil && cached.IdentityKey == device.IdentityKey {
+			continue
+		} else if c.crypto.CryptoStore.HasSession(device.IdentityKey) {
+			continue
+		}
+		if request[device.UserID] == nil {
+			request[device.UserID] = make(map[id.DeviceID]id.KeyAlgorithm)
+			byID[device.UserID] = make(map[id.DeviceID]*id.Device)
+		}
+		request[device.UserID][device.DeviceID] = id.KeyAlgorithmSignedCurve25519
+		byID[device.UserID][device.DeviceID] = device
+	}
+	if len(request) == 0 {
+		return nil
+	}
+
+	resp, err := c.client.ClaimKeys(&mautrix.ReqClaimKeys{OneTimeKeys: request, Timeout: 10 * 1000})
+	if err != nil {
+		return fmt.Errorf("failed to claim keys: %w", err)
+	}
+	for user, userKeys := range resp.OneTimeKeys {
+		for deviceID, keys := range userKeys {
+			device := byID[user][deviceID]
+			if device == nil {
+				continue
+			}
+			for keyID, key := range keys {
+				if alg, _ := keyID.Parse(); alg != id.KeyAlgorithmSignedCurve25519 {
+					continue
+				}
+				if ok, err := olm.VerifySignatureJSON(key.RawData, user, deviceID.String(), device.SigningKey); err != nil || !ok {
+					c.logger.Warn().Msg("Claimed key " + keyID.String() + " of device " + deviceID.String() + " has an invalid signature")
+					break
+				}
+				err = preKeys.Put(user, deviceID, &cachedPreKey{
+					IdentityKey: device.IdentityKey,
+					KeyID:       keyID,
+					Key:         key.Key,
+					Fallback:    key.Fallback,
+					Claimed:     time.Now(),
+				})
+				if err != nil {
+					return err
+				}
+				debug.Printf("Cached key %s of device %s of %s for offline sessions", keyID, deviceID, user)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the Olm session to use with a device, creating a new outbound session from its cached key if there
+// is none yet. One-time keys are dropped from the cache once used, fallback keys are kept.
+func (c *ClientWrapper) olmSessionWith(device *id.Device, idKey id.Curve25519) (*crypto.OlmSession, error) {
+	session, err := c.crypto.CryptoStore.GetLatestSession(idKey)
+	if err != nil || session != nil {
+		return session, err
+	}
+
+	var cached *cachedPreKey
+	if c.preKeys != nil {
+		if cached, err = c.preKeys.Get(device.UserID, device.DeviceID); err != nil {
+			return nil, err
+		}
+	}
+	if cached == nil {
+		return nil, fmt.Errorf("no olm session with device %s and no cached key to start one", device.DeviceID)
+	} else if cached.IdentityKey != idKey {
+		return nil, fmt.Errorf("cached key of device %s belongs to another identity key", device.DeviceID)
+	}
+
+	internal, err := c.crypto.GetAccount().Internal.NewOutboundSession(idKey, cached.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create outbound olm session: %w", err)
+	}
+	now := time.Now()
+	session = &crypto.OlmSession{
+		Internal: *internal,
+		ExpirationMixin: crypto.ExpirationMixin{
+			TimeMixin: crypto.TimeMixin{CreationTime: now, LastEncryptedTime: now, LastDecryptedTime: now},
+		},
+	}
+	if err = c.crypto.CryptoStore.AddSession(idKey, session); err != nil {
+		return nil, err
+	}
+	if !cached.Fallback {
+		if err = c.preKeys.Delete(device.UserID, device.DeviceID); err != nil {
+			c.logger.Err(err).Msg("Could not drop used one-time key")
+		}
+	}
+	debug.Printf("Created olm session %s with device %s of %s from cached key %s", session.ID(), device.DeviceID, device.UserID, cached.KeyID)
+	return session, nil
+}
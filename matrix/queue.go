@@ -0,0 +1,415 @@
+package matrix
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/exp/slices"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var bucketOfflineQueue = []byte("offline_queue")
+var bucketOfflineAcks = []byte("offline_acks") //event ID -> users who already have the event, and since when
+
+// users who have an event are remembered this long, so that later read receipts do not queue it for them again
+const ackRetention = 30 * 24 * time.Hour
+
+// PendingDelivery is an event that still has to be delivered to at least one user through offline comms
+type PendingDelivery struct {
+	EventID id.EventID `json:"event_id"`
+	RoomID  id.RoomID  `json:"room_id"`
+
+	Users   []id.UserID                 `json:"users"`   //the users that did not receive the event yet
+	Devices map[id.UserID][]id.DeviceID `json:"devices"` //the known devices of each of those users
+
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+
+	Carried  *event.Event                `json:"carried,omitempty"`  //megolm ciphertext of an event relayed for someone else, nil for our own events
+	Original *event.Event                `json:"original,omitempty"` //megolm ciphertext of our own event, as stored by the homeserver
+	Expires  time.Time                   `json:"expires"`            //relays drop the event after this moment
+	HopsLeft int                         `json:"hops_left"`          //how many more relays the event may go through
+	Carriers map[id.UserID][]id.DeviceID `json:"carriers,omitempty"` //the relays the event was already handed to
+}
+
+// NextAttempt returns the moment after which the delivery may be retried, doubling the wait on every failed attempt
+func (pd *PendingDelivery) NextAttempt(base, max time.Duration) time.Time {
+	if pd.Attempts == 0 {
+		return pd.LastAttempt
+	}
+	delay := base
+	for i := 1; i < pd.Attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return pd.LastAttempt.Add(delay)
+}
+
+// Targets reports whether the given user still has to receive the event
+func (pd *PendingDelivery) Targets(user id.UserID) bool {
+	return slices.Contains(pd.Users, user)
+}
+
+// Relayable reports whether the event may be handed to the given device, to carry it to the users who missed it.
+// Carried events are never handed back to their sender.
+func (pd *PendingDelivery) Relayable(user id.UserID, device id.DeviceID, now time.Time) bool {
+	if pd.HopsLeft <= 0 || !now.Before(pd.Expires) || pd.Targets(user) || (pd.Carried != nil && pd.Carried.Sender == user) {
+		return false
+	}
+	return !slices.Contains(pd.Carriers[user], device)
+}
+
+// DeliveryQueue persists the events waiting to be delivered offline, in the same bolt database as the
+// event history, so that they are not lost when no peer is around or the process restarts.
+type DeliveryQueue struct {
+	db *bolt.DB
+
+	retryBase time.Duration //backoff applied between delivery attempts of the same event
+	retryMax  time.Duration
+}
+
+func NewDeliveryQueue(hm *HistoryManager, retryBase, retryMax time.Duration) (*DeliveryQueue, error) {
+	err := hm.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketOfflineQueue, bucketOfflineAcks} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DeliveryQueue{db: hm.db, retryBase: retryBase, retryMax: retryMax}, nil
+}
+
+// Enqueue stores a new pending delivery, merging its target users with an existing entry for the same event.
+// Users who already acknowledged the event or read it online are left out.
+func (q *DeliveryQueue) Enqueue(pd *PendingDelivery) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		acks, err := getAcks(tx, pd.EventID)
+		if err != nil {
+			return err
+		}
+		var users []id.UserID
+		for _, user := range pd.Users {
+			if _, ok := acks[user]; ok {
+				delete(pd.Devices, user)
+				continue
+			}
+			users = append(users, user)
+		}
+		pd.Users = users
+
+		bucket := tx.Bucket(bucketOfflineQueue)
+		existing, err := getDelivery(bucket, pd.EventID)
+		if err != nil {
+			return err
+		} else if existing == nil && len(pd.Users) == 0 {
+			return nil
+		} else if existing != nil {
+			for _, user := range pd.Users {
+				if !existing.Targets(user) {
+					existing.Users = append(existing.Users, user)
+				}
+			}
+			if existing.Devices == nil {
+				existing.Devices = make(map[id.UserID][]id.DeviceID)
+			}
+			for user, devices := range pd.Devices {
+				existing.Devices[user] = devices
+			}
+			if existing.Original == nil {
+				existing.Original = pd.Original
+			}
+			pd = existing
+		}
+		return putDelivery(bucket, pd)
+	})
+}
+
+// Get returns the pending delivery of the given event, or nil if it is not queued
+func (q *DeliveryQueue) Get(eventID id.EventID) (pd *PendingDelivery, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		pd, err = getDelivery(tx.Bucket(bucketOfflineQueue), eventID)
+		return err
+	})
+	return
+}
+
+// Due returns every pending delivery whose backoff period has already passed
+func (q *DeliveryQueue) Due(now time.Time) (due []*PendingDelivery, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOfflineQueue).ForEach(func(_, v []byte) error {
+			var pd PendingDelivery
+			if err := json.Unmarshal(v, &pd); err != nil {
+				return err
+			}
+			if !now.Before(pd.NextAttempt(q.retryBase, q.retryMax)) {
+				due = append(due, &pd)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// MarkAttempt records a delivery attempt of the given event, pushing its next retry further away
+func (q *DeliveryQueue) MarkAttempt(eventID id.EventID) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketOfflineQueue)
+		pd, err := getDelivery(bucket, eventID)
+		if err != nil || pd == nil {
+			return err
+		}
+		pd.Attempts++
+		pd.LastAttempt = time.Now()
+		return putDelivery(bucket, pd)
+	})
+}
+
+// MarkCarried records that a relay device accepted to carry the event
+func (q *DeliveryQueue) MarkCarried(eventID id.EventID, user id.UserID, device id.DeviceID) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketOfflineQueue)
+		pd, err := getDelivery(bucket, eventID)
+		if err != nil || pd == nil {
+			return err
+		}
+		if pd.Carriers == nil {
+			pd.Carriers = make(map[id.UserID][]id.DeviceID)
+		}
+		pd.Carriers[user] = append(pd.Carriers[user], device)
+		return putDelivery(bucket, pd)
+	})
+}
+
+// DropExpired removes the events we carry for other users once their time to live has passed, and forgets
+// old acknowledgements and relayed event IDs. Our own events stay queued until every target acknowledges them.
+func (q *DeliveryQueue) DropExpired(now time.Time) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketOfflineQueue)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var pd PendingDelivery
+			if err := json.Unmarshal(v, &pd); err != nil {
+				return err
+			}
+			if pd.Carried != nil && !now.Before(pd.Expires) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		acks := tx.Bucket(bucketOfflineAcks)
+		var forgotten [][]byte
+		err = acks.ForEach(func(k, v []byte) error {
+			users := make(map[id.UserID]int64)
+			if err := json.Unmarshal(v, &users); err != nil {
+				return err
+			}
+			for _, acked := range users {
+				if now.Sub(time.UnixMilli(acked)) < ackRetention {
+					return nil
+				}
+			}
+			forgotten = append(forgotten, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range forgotten {
+			if err = acks.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		relayed := tx.Bucket(bucketRelayed)
+		if relayed == nil {
+			return nil
+		}
+		var past [][]byte
+		_ = relayed.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && !now.Before(time.UnixMilli(int64(btoi(v)))) {
+				past = append(past, k)
+			}
+			return nil
+		})
+		for _, k := range past {
+			if err = relayed.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rekey moves the delivery of an event sent offline, and the users who acknowledged it, from its temporary ID to
+// the ID the homeserver gave it, so that the read receipts of the server copy reach the entry.
+// The stored ciphertext takes the new ID as well.
+func (q *DeliveryQueue) Rekey(oldID, newID id.EventID) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		acks, err := getAcks(tx, oldID)
+		if err != nil {
+			return err
+		} else if len(acks) > 0 {
+			acked := make([]id.UserID, 0, len(acks))
+			for user := range acks {
+				acked = append(acked, user)
+			}
+			if err = putAcks(tx, newID, acked); err != nil {
+				return err
+			} else if err = tx.Bucket(bucketOfflineAcks).Delete([]byte(oldID)); err != nil {
+				return err
+			}
+		}
+
+		bucket := tx.Bucket(bucketOfflineQueue)
+		pd, err := getDelivery(bucket, oldID)
+		if err != nil || pd == nil {
+			return err
+		} else if err = bucket.Delete([]byte(oldID)); err != nil {
+			return err
+		}
+		pd.EventID = newID
+		if pd.Original != nil {
+			pd.Original.ID = newID
+		}
+		if existing, err := getDelivery(bucket, newID); err != nil {
+			return err
+		} else if existing != nil {
+			if pd.Devices == nil {
+				pd.Devices = make(map[id.UserID][]id.DeviceID)
+			}
+			for _, user := range existing.Users {
+				if !pd.Targets(user) {
+					pd.Users = append(pd.Users, user)
+				}
+			}
+			for user, devices := range existing.Devices {
+				if _, ok := pd.Devices[user]; !ok {
+					pd.Devices[user] = devices
+				}
+			}
+		}
+		if err = putDelivery(bucket, pd); err != nil {
+			return err
+		}
+		if acks, err = getAcks(tx, newID); err != nil {
+			return err
+		}
+		acked := make([]id.UserID, 0, len(acks))
+		for user := range acks {
+			acked = append(acked, user)
+		}
+		return removeTargets(bucket, newID, acked)
+	})
+}
+
+// Ack removes the given user from the targets of the event, dropping the entry once every user has acknowledged it.
+// The user is remembered, so that the event is not queued for them again.
+func (q *DeliveryQueue) Ack(eventID id.EventID, user id.UserID) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := putAcks(tx, eventID, []id.UserID{user}); err != nil {
+			return err
+		}
+		return removeTargets(tx.Bucket(bucketOfflineQueue), eventID, []id.UserID{user})
+	})
+}
+
+// Read removes the users whose read receipt for the event was reported by the homeserver, as they got it online
+func (q *DeliveryQueue) Read(eventID id.EventID, users []id.UserID) error {
+	if len(users) == 0 {
+		return nil
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketOfflineQueue)
+		if bucket.Get([]byte(eventID)) == nil {
+			return nil //receipts of events that were never queued are not worth keeping
+		}
+		if err := putAcks(tx, eventID, users); err != nil {
+			return err
+		}
+		return removeTargets(bucket, eventID, users)
+	})
+}
+
+// Removes users from the targets of an event, dropping the entry once no user is left
+func removeTargets(bucket *bolt.Bucket, eventID id.EventID, users []id.UserID) error {
+	pd, err := getDelivery(bucket, eventID)
+	if err != nil || pd == nil {
+		return err
+	}
+	for _, user := range users {
+		if i := slices.Index(pd.Users, user); i >= 0 {
+			pd.Users = slices.Delete(pd.Users, i, i+1)
+		}
+		delete(pd.Devices, user)
+	}
+	if len(pd.Users) == 0 {
+		return bucket.Delete([]byte(eventID))
+	}
+	return putDelivery(bucket, pd)
+}
+
+func getAcks(tx *bolt.Tx, eventID id.EventID) (map[id.UserID]int64, error) {
+	users := make(map[id.UserID]int64)
+	data := tx.Bucket(bucketOfflineAcks).Get([]byte(eventID))
+	if data == nil {
+		return users, nil
+	}
+	err := json.Unmarshal(data, &users)
+	return users, err
+}
+
+func putAcks(tx *bolt.Tx, eventID id.EventID, acked []id.UserID) error {
+	users, err := getAcks(tx, eventID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for _, user := range acked {
+		if _, ok := users[user]; !ok {
+			users[user] = now
+		}
+	}
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketOfflineAcks).Put([]byte(eventID), data)
+}
+
+func getDelivery(bucket *bolt.Bucket, eventID id.EventID) (*PendingDelivery, error) {
+	data := bucket.Get([]byte(eventID))
+	if data == nil {
+		return nil, nil
+	}
+	var pd PendingDelivery
+	if err := json.Unmarshal(data, &pd); err != nil {
+		return nil, err
+	}
+	return &pd, nil
+}
+
+func putDelivery(bucket *bolt.Bucket, pd *PendingDelivery) error {
+	data, err := json.Marshal(pd)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(pd.EventID), data)
+}
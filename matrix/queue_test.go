@@ -0,0 +1,217 @@
+package matrix
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	queuedEvent  = id.EventID("$queued")
+	carriedEvent = id.EventID("$carried")
+	queueRoom    = id.RoomID("!room:example.org")
+	carol        = id.UserID("@carol:example.org")
+	dave         = id.UserID("@dave:example.org")
+	erin         = id.UserID("@erin:example.org")
+
+	retryBase = 30 * time.Second
+	retryMax  = 30 * time.Minute
+)
+
+// Opens a delivery queue in a temporary bolt database, with one event queued for carol and dave
+func testQueue(t *testing.T) *DeliveryQueue {
+	hm, err := NewHistoryManager(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = hm.Close()
+	})
+	q, err := NewDeliveryQueue(hm, retryBase, retryMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Enqueue(&PendingDelivery{
+		EventID: queuedEvent,
+		RoomID:  queueRoom,
+		Users:   []id.UserID{carol, dave},
+		Devices: map[id.UserID][]id.DeviceID{carol: {"CAROL"}, dave: {"DAVE"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func queuedUsers(t *testing.T, q *DeliveryQueue) []id.UserID {
+	pd, err := q.Get(queuedEvent)
+	if err != nil {
+		t.Fatal(err)
+	} else if pd == nil {
+		return nil
+	}
+	return pd.Users
+}
+
+func TestNextAttempt(t *testing.T) {
+	last := time.UnixMilli(1000000)
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, retryBase},
+		{2, 2 * retryBase},
+		{3, 4 * retryBase},
+		{100, retryMax},
+	}
+	for _, tt := range tests {
+		pd := &PendingDelivery{Attempts: tt.attempts, LastAttempt: last}
+		if got := pd.NextAttempt(retryBase, retryMax).Sub(last); got != tt.want {
+			t.Errorf("NextAttempt() after %d attempts is %s later, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(q *DeliveryQueue) error
+		want   []id.UserID
+	}{
+		{"enqueue merges users", func(q *DeliveryQueue) error {
+			return q.Enqueue(&PendingDelivery{EventID: queuedEvent, RoomID: queueRoom, Users: []id.UserID{dave, erin}})
+		}, []id.UserID{carol, dave, erin}},
+		{"ack removes the user", func(q *DeliveryQueue) error {
+			return q.Ack(queuedEvent, carol)
+		}, []id.UserID{dave}},
+		{"enqueue skips acked users", func(q *DeliveryQueue) error {
+			if err := q.Ack(queuedEvent, carol); err != nil {
+				return err
+			}
+			return q.Enqueue(&PendingDelivery{EventID: queuedEvent, RoomID: queueRoom, Users: []id.UserID{carol}})
+		}, []id.UserID{dave}},
+		{"ack of every user drops the entry", func(q *DeliveryQueue) error {
+			if err := q.Ack(queuedEvent, carol); err != nil {
+				return err
+			}
+			return q.Ack(queuedEvent, dave)
+		}, nil},
+		{"read removes the users", func(q *DeliveryQueue) error {
+			return q.Read(queuedEvent, []id.UserID{carol, dave})
+		}, nil},
+		{"read users are not queued again", func(q *DeliveryQueue) error {
+			if err := q.Read(queuedEvent, []id.UserID{carol, dave}); err != nil {
+				return err
+			}
+			return q.Enqueue(&PendingDelivery{EventID: queuedEvent, RoomID: queueRoom, Users: []id.UserID{carol, dave}})
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := testQueue(t)
+			if err := tt.update(q); err != nil {
+				t.Fatal(err)
+			}
+			if got := queuedUsers(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queued users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropExpired(t *testing.T) {
+	tests := []struct {
+		name    string
+		after   time.Duration
+		forgets bool
+	}{
+		{"recent acks and carried events are kept", time.Hour, false},
+		{"old acks and carried events are forgotten", ackRetention + time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := testQueue(t)
+			if err := q.Ack(queuedEvent, carol); err != nil {
+				t.Fatal(err)
+			}
+			err := q.Enqueue(&PendingDelivery{
+				EventID: carriedEvent,
+				RoomID:  queueRoom,
+				Users:   []id.UserID{erin},
+				Carried: &event.Event{ID: carriedEvent, Sender: erin, RoomID: queueRoom},
+				Expires: time.Now().Add(ackRetention),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := q.DropExpired(time.Now().Add(tt.after)); err != nil {
+				t.Fatal(err)
+			}
+			if pd, _ := q.Get(carriedEvent); (pd == nil) != tt.forgets {
+				t.Errorf("carried event dropped = %v, want %v", pd == nil, tt.forgets)
+			}
+			if pd, _ := q.Get(queuedEvent); pd == nil { //our own events never expire
+				t.Error("own event is dropped")
+			}
+			err = q.db.View(func(tx *bolt.Tx) error {
+				if forgotten := tx.Bucket(bucketOfflineAcks).Get([]byte(queuedEvent)) == nil; forgotten != tt.forgets {
+					t.Errorf("acks forgotten = %v, want %v", forgotten, tt.forgets)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMarkCarried(t *testing.T) {
+	q := testQueue(t)
+	err := q.Enqueue(&PendingDelivery{
+		EventID:  carriedEvent,
+		RoomID:   queueRoom,
+		Users:    []id.UserID{carol},
+		Carried:  &event.Event{ID: carriedEvent, Sender: erin, RoomID: queueRoom},
+		Expires:  time.Now().Add(time.Hour),
+		HopsLeft: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.MarkCarried(carriedEvent, dave, "DAVE"); err != nil {
+		t.Fatal(err)
+	}
+	pd, err := q.Get(carriedEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		user   id.UserID
+		device id.DeviceID
+		want   bool
+	}{
+		{"device that carries it already", dave, "DAVE", false},
+		{"other device of the carrier", dave, "DAVE2", true},
+		{"target", carol, "CAROL", false},
+		{"sender", erin, "ERIN", false},
+	}
+	for _, tt := range tests {
+		if got := pd.Relayable(tt.user, tt.device, now); got != tt.want {
+			t.Errorf("%s: Relayable(%s, %s) = %v, want %v", tt.name, tt.user, tt.device, got, tt.want)
+		}
+	}
+	if pd.Relayable(dave, "DAVE2", pd.Expires) {
+		t.Error("expired event is relayable")
+	}
+}
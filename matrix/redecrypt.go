@@ -0,0 +1,65 @@
+package matrix
+
+import (
+	"context"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"thesgo/matrix/mxevents"
+)
+
+// Decrypts in place the stored events that were waiting for a megolm session, once it arrives through a
+// room key, a forwarded key, a key import or a backup restore. Their rooms are flagged as redecrypted.
+func (c *ClientWrapper) retryDecryption(sessionID id.SessionID) {
+	defer debug.Recover()
+	history := c.history
+	if history == nil || c.crypto == nil {
+		return
+	}
+	waiting, err := history.Undecrypted(sessionID)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not load events waiting for session " + sessionID.String())
+		return
+	}
+
+	for eventID, roomID := range waiting {
+		room := c.GetOrCreateRoom(roomID)
+		stored, err := history.Get(room, eventID)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not load undecrypted event " + eventID.String())
+			continue
+		}
+		content, ok := stored.Content.Parsed.(*mxevents.BadEncryptedContent)
+		if !ok || content.Original == nil { //was already decrypted or replaced
+			_ = history.ForgetUndecrypted(sessionID, eventID)
+			continue
+		}
+
+		encrypted := *stored.Event
+		encrypted.Type = event.EventEncrypted
+		encrypted.Content = event.Content{Parsed: content.Original}
+		decrypted, err := c.crypto.DecryptMegolmEvent(context.TODO(), &encrypted)
+		if err != nil {
+			debug.Printf("Event %s still cannot be decrypted: %v", eventID, err)
+			continue
+		}
+
+		err = history.Update(room, eventID, func(evt *mxevents.Event) error {
+			evt.Event = decrypted
+			return nil
+		})
+		if err != nil {
+			c.logger.Err(err).Msg("Could not store decrypted event " + eventID.String())
+			continue
+		}
+		if err = history.ForgetUndecrypted(sessionID, eventID); err != nil {
+			c.logger.Err(err).Msg("Could not update undecrypted events index")
+		}
+		if err = room.SetRedecrypted(true); err != nil {
+			c.logger.Err(err).Msg("Could not save the room list")
+		}
+		debug.Printf("Decrypted stored event %s of %s with late session %s", eventID, roomID, sessionID)
+	}
+}
@@ -0,0 +1,164 @@
+package matrix
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"thesgo/offline/wire"
+)
+
+// Relaying lets a trusted peer that is not a target of an event carry it to the users who missed it, for
+// as long as its time to live and hop limit allow. Relays only ever hold the megolm ciphertext.
+
+// Whether any of the queued events may be handed to the given device to relay
+func anyRelayable(due []*PendingDelivery, user id.UserID, device id.DeviceID) bool {
+	now := time.Now()
+	for _, pending := range due {
+		if pending.Relayable(user, device, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the megolm ciphertext to hand over for a queued event. Carried events are passed on untouched,
+// our own events as the ciphertext stored when they were queued, so every copy matches the one on the server.
+func (c *ClientWrapper) relayedCiphertext(pending *PendingDelivery) (*event.Event, error) {
+	evt := pending.Carried
+	if evt == nil {
+		evt = pending.Original
+	}
+	if evt == nil {
+		return nil, fmt.Errorf("no ciphertext stored for event %s", pending.EventID)
+	}
+	if evt.Content.Parsed == nil { //the content is only kept raw in the queue
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			return nil, err
+		}
+	}
+	return evt, nil
+}
+
+// Fetches the megolm ciphertext of one of our events as the homeserver stored it. The local history only
+// keeps the decrypted copy.
+func (c *ClientWrapper) originalCiphertext(roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := c.client.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, err
+	} else if evt.Type != event.EventEncrypted {
+		return nil, fmt.Errorf("event %s is not encrypted", eventID)
+	}
+	if err = evt.Content.ParseRaw(evt.Type); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
+
+// Hands a queued event over to the relay on the other end of the stream, returning whether it accepted it
+func (c *ClientWrapper) sendRelay(conn *peerConn, relay *id.Device, pending *PendingDelivery) (bool, error) {
+	ciphertext, err := c.relayedCiphertext(pending)
+	if err != nil {
+		c.logger.Err(err).Msg("Could not prepare event " + pending.EventID.String() + " for relaying")
+		return false, nil
+	}
+	err = conn.Encode(wire.TypeRelay, &wire.Relay{
+		Event:    ciphertext,
+		Users:    pending.Users,
+		Devices:  pending.Devices,
+		Expires:  pending.Expires.UnixMilli(),
+		HopsLeft: pending.HopsLeft - 1,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		return false, err
+	}
+	switch frame.Type {
+	case wire.TypeAck:
+		var ack wire.Ack
+		if err = frame.Decode(&ack); err != nil {
+			return false, err
+		}
+		return ack.EventID == pending.EventID && ack.UserID == relay.UserID, nil
+	case wire.TypeNack:
+		var nack wire.Nack
+		if err = frame.Decode(&nack); err != nil {
+			return false, err
+		}
+		debug.Printf("Relay refused event %s: %s", nack.EventID, nack.Reason)
+		return false, nil
+	case wire.TypeError:
+		remote := &wire.Error{}
+		_ = frame.Decode(remote)
+		return false, remote
+	default:
+		return false, fmt.Errorf("%w: %s", wire.ErrUnexpectedFrame, frame.Type)
+	}
+}
+
+// Accepts an event to carry for other users. It is queued as is, without being decrypted or stored in history.
+func (c *ClientWrapper) receiveRelay(conn *peerConn, frame *wire.Frame, stores *offlineStores) error {
+	var relay wire.Relay
+	if err := frame.Decode(&relay); err != nil {
+		return err
+	}
+	if relay.Event == nil {
+		return conn.Encode(wire.TypeNack, &wire.Nack{Reason: "relay without event"})
+	}
+	nack := &wire.Nack{EventID: relay.Event.ID}
+	expires := time.UnixMilli(relay.Expires)
+	if relay.Event.Type.Type != event.EventEncrypted.Type {
+		nack.Reason = "only encrypted events are relayed"
+	} else if !time.Now().Before(expires) {
+		nack.Reason = "event expired"
+	} else if relay.HopsLeft < 0 {
+		nack.Reason = "hop limit reached"
+	} else if relay.Event.Sender == c.client.UserID {
+		nack.Reason = "event was sent by this user"
+	}
+	if nack.Reason != "" {
+		return conn.Encode(wire.TypeNack, nack)
+	}
+	//the sender does not get to make us carry the event longer or further than our own events
+	if limit := time.Now().Add(c.config.Offline.RelayTTL); expires.After(limit) {
+		expires = limit
+	}
+	if relay.HopsLeft > c.config.Offline.RelayHops {
+		relay.HopsLeft = c.config.Offline.RelayHops
+	}
+
+	ack := &wire.Ack{EventID: relay.Event.ID, UserID: c.client.UserID, DeviceID: c.client.DeviceID}
+	fresh, err := stores.history.MarkRelayed(relay.Event.ID, expires)
+	if err != nil {
+		return err
+	} else if !fresh {
+		debug.Print("Already relaying event " + relay.Event.ID.String())
+		return conn.Encode(wire.TypeAck, ack)
+	}
+
+	err = stores.queue.Enqueue(&PendingDelivery{
+		EventID:  relay.Event.ID,
+		RoomID:   relay.Event.RoomID,
+		Users:    relay.Users,
+		Devices:  relay.Devices,
+		Carried:  relay.Event,
+		Expires:  expires,
+		HopsLeft: relay.HopsLeft,
+	})
+	if err != nil {
+		return err
+	}
+	debug.Printf("Relaying event %s of %s to %v, %d more hops until %s", relay.Event.ID, relay.Event.Sender, relay.Users, relay.HopsLeft, expires)
+	select { //wake up the offline routine, unless it already has a pending signal
+	case c.sendOff <- struct{}{}:
+	default:
+	}
+	return conn.Encode(wire.TypeAck, ack)
+}
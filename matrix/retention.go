@@ -0,0 +1,201 @@
+package matrix
+
+import (
+	"time"
+
+	"thesgo/config"
+	"thesgo/matrix/mxevents"
+	"thesgo/matrix/rooms"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix/id"
+)
+
+// Prune removes from the stream of a room the events sent before the cutoff and the oldest events past the
+// given count, skipping the zero limits. Events still waiting in the offline delivery queue or in the outbox
+// are kept. Gaps whose missing events would be removed anyway are dropped, so they are not fetched again.
+func (hm *HistoryManager) Prune(room *rooms.Room, cutoff time.Time, maxEvents int) (removed int, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		rid := []byte(room.ID)
+		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
+		eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket(rid)
+		if stream == nil || eventIDs == nil {
+			return nil
+		}
+		excess := stream.Stats().KeyN - maxEvents
+		if maxEvents <= 0 {
+			excess = 0
+		}
+
+		if err := pruneCache(tx, room.ID, cutoff); err != nil {
+			return err
+		}
+
+		queued := tx.Bucket(bucketOfflineQueue)
+		var prunedKeys [][]byte
+		var prunedEvents []*mxevents.Event
+		position := 0
+		err := stream.ForEach(func(k, v []byte) error {
+			position++
+			evt, err := unmarshalEvent(v)
+			if err != nil {
+				return err
+			}
+			tooOld := !cutoff.IsZero() && time.UnixMilli(evt.Timestamp).Before(cutoff)
+			if (position > excess && !tooOld) || isLocalEcho(evt.ID) || (queued != nil && queued.Get([]byte(evt.ID)) != nil) {
+				return nil
+			}
+			prunedKeys = append(prunedKeys, k)
+			prunedEvents = append(prunedEvents, evt)
+			return nil
+		})
+		if err != nil || len(prunedKeys) == 0 {
+			return err
+		}
+
+		for i, key := range prunedKeys { //deleted afterwards, as a bolt cursor skips entries when deleting while iterating
+			evt := prunedEvents[i]
+			if err = stream.Delete(key); err != nil {
+				return err
+			} else if err = eventIDs.Delete([]byte(evt.ID)); err != nil {
+				return err
+			} else if err = unindexEvent(tx, room.ID, evt.ID); err != nil {
+				return err
+			}
+			if content, ok := evt.Content.Parsed.(*mxevents.BadEncryptedContent); ok && content.Original != nil {
+				if err = forgetUndecrypted(tx, content.Original.SessionID, evt.ID); err != nil {
+					return err
+				}
+			}
+		}
+		removed = len(prunedKeys)
+
+		//the pointer keeps the oldest prepended event, which may be gone now
+		pointers := tx.Bucket(bucketStreamPointers)
+		if k, _ := stream.Cursor().First(); k != nil && btoi(k) < halfUint64 {
+			err = pointers.Put(rid, k)
+		} else {
+			err = pointers.Delete(rid)
+		}
+		if err != nil {
+			return err
+		}
+
+		newestPruned := btoi(prunedKeys[len(prunedKeys)-1])
+		if gaps := tx.Bucket(bucketGaps).Bucket(rid); gaps != nil {
+			var closed [][]byte
+			_ = gaps.ForEach(func(k, v []byte) error {
+				if low := btoi(k) - gapReserve; low <= newestPruned { //newer events than the missing ones were removed
+					closed = append(closed, k)
+				}
+				return nil
+			})
+			for _, k := range closed {
+				if err = gaps.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Removes the server search results sent before the cutoff
+func pruneCache(tx *bolt.Tx, roomID id.RoomID, cutoff time.Time) error {
+	cached := tx.Bucket(bucketCachedEvents).Bucket([]byte(roomID))
+	if cached == nil || cutoff.IsZero() {
+		return nil
+	}
+	var expired []id.EventID
+	err := cached.ForEach(func(k, v []byte) error {
+		evt, err := unmarshalEvent(v)
+		if err != nil {
+			return err
+		} else if time.UnixMilli(evt.Timestamp).Before(cutoff) {
+			expired = append(expired, id.EventID(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, eventID := range expired {
+		if err = cached.Delete([]byte(eventID)); err != nil {
+			return err
+		} else if err = unindexEvent(tx, roomID, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retention policy of a room: the configured one, made stricter by the max_lifetime of the room if honoured
+func (c *ClientWrapper) retentionPolicy(room *rooms.Room) config.RetentionPolicy {
+	policy := c.config.Retention.Policy(room.ID)
+	if !c.config.Retention.HonourServer {
+		return policy
+	}
+	evt := room.GetStateEvent(mxevents.StateRetention, "")
+	if evt == nil {
+		return policy
+	}
+	content, ok := evt.Content.Parsed.(*mxevents.RetentionContent)
+	if !ok || content.MaxLifetime == nil || *content.MaxLifetime <= 0 {
+		return policy
+	}
+	if maxLifetime := time.Duration(*content.MaxLifetime) * time.Millisecond; policy.MaxAge == 0 || maxLifetime < policy.MaxAge {
+		policy.MaxAge = maxLifetime
+	}
+	return policy
+}
+
+// Prunes the history on every interval, until the history manager is replaced
+func (c *ClientWrapper) runPruner(hm *HistoryManager) {
+	defer debug.Recover()
+	ticker := time.NewTicker(c.config.Retention.PruneInterval)
+	defer ticker.Stop()
+	for {
+		if c.history != hm {
+			return
+		}
+		c.pruneHistory(hm)
+		<-ticker.C
+	}
+}
+
+// Applies the retention policy of every known room
+func (c *ClientWrapper) pruneHistory(hm *HistoryManager) {
+	c.config.Rooms.Lock()
+	roomIDs := make([]id.RoomID, 0, len(c.config.Rooms.Map))
+	for roomID := range c.config.Rooms.Map {
+		roomIDs = append(roomIDs, roomID)
+	}
+	c.config.Rooms.Unlock()
+
+	for _, roomID := range roomIDs {
+		room := c.GetRoom(roomID)
+		if room == nil {
+			continue
+		}
+		policy := c.retentionPolicy(room)
+		if policy.MaxAge <= 0 && policy.MaxEvents <= 0 {
+			continue
+		}
+		var cutoff time.Time
+		if policy.MaxAge > 0 {
+			cutoff = time.Now().Add(-policy.MaxAge)
+		}
+		removed, err := hm.Prune(room, cutoff, policy.MaxEvents)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not prune the history of " + roomID.String())
+			continue
+		} else if removed > 0 {
+			debug.Printf("Pruned %d events from the history of %s", removed, roomID)
+		}
+	}
+}
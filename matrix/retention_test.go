@@ -0,0 +1,73 @@
+package matrix
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"thesgo/matrix/rooms"
+
+	"golang.org/x/exp/slices"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		cutoff    time.Time
+		maxEvents int
+		removed   []id.EventID
+	}{
+		{"age", time.UnixMilli(4500), 0, []id.EventID{"$1", "$4"}},
+		{"count", time.Time{}, 1, []id.EventID{"$1", "$4"}},
+		{"age and count", time.UnixMilli(2500), 4, []id.EventID{"$1"}},
+		{"no limits", time.Time{}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hm, err := NewHistoryManager(filepath.Join(t.TempDir(), "history.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hm.Close()
+			queue, err := NewDeliveryQueue(hm, time.Second, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			room := &rooms.Room{ID: roomA}
+			echo := id.EventID(localEchoPrefix + "txn")
+			_, err = hm.Append(room, []*event.Event{
+				message("$1", alice, 1000, "first"),
+				message(echo, alice, 2000, "sent offline"),
+				message("$3", alice, 3000, "queued"),
+				message("$4", bob, 4000, "fourth"),
+				message("$5", bob, 5000, "fifth"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = queue.Enqueue(&PendingDelivery{EventID: "$3", RoomID: roomA, Users: []id.UserID{bob}, Expires: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := hm.Prune(room, tt.cutoff, tt.maxEvents)
+			if err != nil {
+				t.Fatal(err)
+			} else if removed != len(tt.removed) {
+				t.Errorf("Prune() removed %d events, want %d", removed, len(tt.removed))
+			}
+			for _, eventID := range []id.EventID{"$1", echo, "$3", "$4", "$5"} {
+				_, err := hm.Get(room, eventID)
+				if wantGone := slices.Contains(tt.removed, eventID); wantGone && err == nil {
+					t.Errorf("event %s is kept", eventID)
+				} else if !wantGone && err != nil {
+					t.Errorf("event %s is removed: %v", eventID, err)
+				}
+			}
+		})
+	}
+}
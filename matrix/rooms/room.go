@@ -64,6 +64,8 @@ type Room struct {
 	HasLeft bool
 	// Whether or not the room is encrypted.
 	Encrypted bool
+	// Whether stored events were decrypted after their room key arrived late, since the history was last read.
+	Redecrypted bool
 
 	// The first batch of events that has been fetched for this room.
 	// Used for fetching additional history.
@@ -79,6 +81,8 @@ type Room struct {
 	unreadCountCache *int
 	highlightCache   *bool
 	lastMarkedRead   id.EventID
+	// The event of the latest read receipt of each member.
+	Receipts map[id.UserID]id.EventID
 	// Whether or not this room is marked as a direct chat.
 	IsDirect  bool
 	OtherUser id.UserID
@@ -194,6 +198,14 @@ func (room *Room) Touch() {
 	room.cache.TouchNode(room)
 }
 
+func (room *Room) SetRedecrypted(redecrypted bool) error {
+	return room.cache.SetRedecrypted(room, redecrypted)
+}
+
+func (room *Room) IsRedecrypted() bool {
+	return room.cache.IsRedecrypted(room)
+}
+
 func (room *Room) Unload() bool {
 	if room.preUnload != nil && !room.preUnload() {
 		return false
@@ -275,6 +287,23 @@ func (room *Room) MarkRead(eventID id.EventID) bool {
 	return true
 }
 
+// SetReceipt remembers the latest event read by the user
+func (room *Room) SetReceipt(user id.UserID, eventID id.EventID) {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if room.Receipts == nil {
+		room.Receipts = make(map[id.UserID]id.EventID)
+	}
+	room.Receipts[user] = eventID
+}
+
+// Receipt returns the latest event read by the user, or an empty ID if no receipt was seen
+func (room *Room) Receipt(user id.UserID) id.EventID {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	return room.Receipts[user]
+}
+
 func (room *Room) UnreadCount() int {
 	room.lock.Lock()
 	defer room.lock.Unlock()
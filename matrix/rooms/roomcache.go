@@ -260,6 +260,26 @@ func (cache *RoomCache) Put(room *Room) {
 	node.Save()
 }
 
+// SetRedecrypted updates whether stored events of the room were decrypted late. The flag is kept in the
+// room list, so it is changed under the cache lock and the list is saved right away.
+func (cache *RoomCache) SetRedecrypted(room *Room, redecrypted bool) error {
+	cache.Lock()
+	if room.Redecrypted == redecrypted {
+		cache.Unlock()
+		return nil
+	}
+	room.Redecrypted = redecrypted
+	cache.Unlock()
+	return cache.SaveList()
+}
+
+// IsRedecrypted reads the flag set by SetRedecrypted
+func (cache *RoomCache) IsRedecrypted(room *Room) bool {
+	cache.Lock()
+	defer cache.Unlock()
+	return room.Redecrypted
+}
+
 func (cache *RoomCache) roomPath(roomID id.RoomID) string {
 	escapedRoomID := strings.ReplaceAll(strings.ReplaceAll(string(roomID), "%", "%25"), "/", "%2F")
 	return filepath.Join(cache.directory, escapedRoomID+".gob.gz")
@@ -0,0 +1,257 @@
+package matrix
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"thesgo/matrix/mxevents"
+	"thesgo/matrix/rooms"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var bucketSearchTerms = []byte("search_terms")   //term -> room ID and event ID of every message containing it
+var bucketSearchDocs = []byte("search_docs")     //room ID and event ID -> terms of the message, to remove them again
+var bucketCachedEvents = []byte("cached_events") //room ID -> event ID -> event found by a server search, outside the stored timeline
+
+// words shorter than this are not indexed
+const minTermLength = 2
+
+// SearchQuery selects messages of the local history. Every word of the text must be in the message body,
+// the other fields are optional filters.
+type SearchQuery struct {
+	Text   string    `json:"text"`
+	RoomID id.RoomID `json:"room_id,omitempty"` //every room if empty
+	Sender id.UserID `json:"sender,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	Until  time.Time `json:"until,omitempty"`
+	Limit  int       `json:"limit,omitempty"`
+}
+
+// SearchResult is a message of the local history that matched a search
+type SearchResult struct {
+	RoomID    id.RoomID  `json:"room_id"`
+	EventID   id.EventID `json:"event_id"`
+	Sender    id.UserID  `json:"sender"`
+	Timestamp int64      `json:"timestamp"`
+	Body      string     `json:"body"`
+}
+
+// Splits a text in lowercase words, without repetitions
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]bool, len(words))
+	terms := words[:0]
+	for _, word := range words {
+		if len([]rune(word)) < minTermLength || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+func searchDocKey(roomID id.RoomID, eventID id.EventID) []byte {
+	return []byte(roomID.String() + "|" + eventID.String())
+}
+
+func messageBody(evt *mxevents.Event) (string, bool) {
+	if evt.Type != event.EventMessage {
+		return "", false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return "", false
+	}
+	return content.Body, true
+}
+
+// Adds the body of a message to the search index. Events that are not messages, e.g. the ones that could
+// not be decrypted yet, are skipped and indexed once they are updated.
+func indexEvent(tx *bolt.Tx, roomID id.RoomID, evt *mxevents.Event) error {
+	body, ok := messageBody(evt)
+	if !ok {
+		return nil
+	}
+	terms := searchTerms(body)
+	if len(terms) == 0 {
+		return nil
+	}
+	doc := searchDocKey(roomID, evt.ID)
+	index := tx.Bucket(bucketSearchTerms)
+	for _, term := range terms {
+		postings, err := index.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		if err = postings.Put(doc, []byte{}); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketSearchDocs).Put(doc, []byte(strings.Join(terms, " ")))
+}
+
+// Removes an event from the search index
+func unindexEvent(tx *bolt.Tx, roomID id.RoomID, eventID id.EventID) error {
+	doc := searchDocKey(roomID, eventID)
+	docs := tx.Bucket(bucketSearchDocs)
+	terms := docs.Get(doc)
+	if terms == nil {
+		return nil
+	}
+	index := tx.Bucket(bucketSearchTerms)
+	for _, term := range strings.Fields(string(terms)) {
+		postings := index.Bucket([]byte(term))
+		if postings == nil {
+			continue
+		}
+		if err := postings.Delete(doc); err != nil {
+			return err
+		}
+		if k, _ := postings.Cursor().First(); k == nil {
+			if err := index.DeleteBucket([]byte(term)); err != nil {
+				return err
+			}
+		}
+	}
+	return docs.Delete(doc)
+}
+
+// Indexes the history stored before the search index existed
+func reindexHistory(tx *bolt.Tx) error {
+	streams := tx.Bucket(bucketRoomStreams)
+	return streams.ForEach(func(roomID, v []byte) error {
+		if v != nil { //not a room stream
+			return nil
+		}
+		return streams.Bucket(roomID).ForEach(func(_, data []byte) error {
+			evt, err := unmarshalEvent(data)
+			if err != nil {
+				return err
+			}
+			return indexEvent(tx, id.RoomID(roomID), evt)
+		})
+	})
+}
+
+// Cache keeps the events found by a server search that are not in the stored timeline of the room. They are
+// searchable locally from then on, and are dropped from the cache once the timeline reaches them.
+func (hm *HistoryManager) Cache(room *rooms.Room, events []*event.Event) error {
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		rid := []byte(room.ID)
+		cached, err := tx.Bucket(bucketCachedEvents).CreateBucketIfNotExists(rid)
+		if err != nil {
+			return err
+		}
+		for _, evt := range events {
+			if _, _, err = hm.getStreamIndex(tx, rid, []byte(evt.ID)); err == nil {
+				continue //already in the timeline
+			}
+			wrapped := mxevents.Wrap(evt)
+			data, err := marshalEvent(wrapped)
+			if err != nil {
+				return err
+			}
+			if err = cached.Put([]byte(evt.ID), data); err != nil {
+				return err
+			} else if err = indexEvent(tx, room.ID, wrapped); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Removes an event from the cache, once it is stored in the timeline
+func uncacheEvent(tx *bolt.Tx, roomID id.RoomID, eventID id.EventID) error {
+	cached := tx.Bucket(bucketCachedEvents).Bucket([]byte(roomID))
+	if cached == nil {
+		return nil
+	}
+	return cached.Delete([]byte(eventID))
+}
+
+// Looks for an event in the timeline of the room, then in the cache of server search results
+func (hm *HistoryManager) lookupEvent(tx *bolt.Tx, roomID, eventID []byte) (*mxevents.Event, error) {
+	if stream, index, err := hm.getStreamIndex(tx, roomID, eventID); err == nil {
+		return hm.getEvent(tx, stream, index)
+	}
+	cached := tx.Bucket(bucketCachedEvents).Bucket(roomID)
+	if cached == nil {
+		return nil, ErrEventNotFound
+	}
+	data := cached.Get(eventID)
+	if data == nil {
+		return nil, ErrEventNotFound
+	}
+	return unmarshalEvent(data)
+}
+
+// Matches tells if a message passes the sender and date filters of the query
+func (query *SearchQuery) Matches(sender id.UserID, timestamp int64) bool {
+	sent := time.UnixMilli(timestamp)
+	return (query.Sender == "" || sender == query.Sender) &&
+		(query.Since.IsZero() || !sent.Before(query.Since)) &&
+		(query.Until.IsZero() || sent.Before(query.Until))
+}
+
+// Search returns the stored messages matching the query, most recent first
+func (hm *HistoryManager) Search(query SearchQuery) (results []SearchResult, err error) {
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("the query has no words to search for")
+	}
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketSearchTerms)
+		postings := make([]*bolt.Bucket, len(terms))
+		for i, term := range terms {
+			if postings[i] = index.Bucket([]byte(term)); postings[i] == nil {
+				return nil //no message has every word
+			}
+		}
+		return postings[0].ForEach(func(doc, _ []byte) error {
+			for _, other := range postings[1:] {
+				if other.Get(doc) == nil {
+					return nil
+				}
+			}
+			roomID, eventID, found := strings.Cut(string(doc), "|")
+			if !found || (query.RoomID != "" && id.RoomID(roomID) != query.RoomID) {
+				return nil
+			}
+			evt, err := hm.lookupEvent(tx, []byte(roomID), []byte(eventID))
+			if err == ErrEventNotFound {
+				return nil //the index may point to an event that was renamed meanwhile
+			} else if err != nil {
+				return err
+			} else if !query.Matches(evt.Sender, evt.Timestamp) {
+				return nil
+			}
+			body, _ := messageBody(evt)
+			results = append(results, SearchResult{
+				RoomID:    id.RoomID(roomID),
+				EventID:   evt.ID,
+				Sender:    evt.Sender,
+				Timestamp: evt.Timestamp,
+				Body:      body,
+			})
+			return nil
+		})
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Timestamp > results[j].Timestamp
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package matrix
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"thesgo/matrix/mxevents"
+	"thesgo/matrix/rooms"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	roomA = id.RoomID("!a:example.org")
+	roomB = id.RoomID("!b:example.org")
+	alice = id.UserID("@alice:example.org")
+	bob   = id.UserID("@bob:example.org")
+)
+
+func message(eventID id.EventID, sender id.UserID, timestamp int64, body string) *event.Event {
+	return &event.Event{
+		ID:        eventID,
+		Sender:    sender,
+		Type:      event.EventMessage,
+		Timestamp: timestamp,
+		Content:   event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+	}
+}
+
+// Opens a history in a temporary bolt database, with a few messages in two rooms
+func searchHistory(t *testing.T) (*HistoryManager, *rooms.Room) {
+	hm, err := NewHistoryManager(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = hm.Close()
+	})
+
+	a, b := &rooms.Room{ID: roomA}, &rooms.Room{ID: roomB}
+	_, err = hm.Append(a, []*event.Event{
+		message("$1", alice, 1000, "Hello world"),
+		message("$2", bob, 2000, "hello there"),
+		message("$3", alice, 3000, "goodbye, world!"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hm.Append(b, []*event.Event{message("$4", alice, 4000, "hello world again")}); err != nil {
+		t.Fatal(err)
+	}
+	return hm, a
+}
+
+func resultIDs(results []SearchResult) (ids []id.EventID) {
+	for _, result := range results {
+		ids = append(ids, result.EventID)
+	}
+	return
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello world", []string{"hello", "world"}},
+		{"hello, HELLO! hello?", []string{"hello"}},
+		{"a b cd", []string{"cd"}},
+		{"área 51", []string{"área", "51"}},
+		{"  ", []string{}},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	hm, _ := searchHistory(t)
+
+	tests := []struct {
+		name    string
+		query   SearchQuery
+		want    []id.EventID
+		wantErr bool
+	}{
+		{"every term", SearchQuery{Text: "world hello"}, []id.EventID{"$4", "$1"}, false},
+		{"single term", SearchQuery{Text: "HELLO"}, []id.EventID{"$4", "$2", "$1"}, false},
+		{"term not indexed", SearchQuery{Text: "hello nobody"}, nil, false},
+		{"room", SearchQuery{Text: "hello", RoomID: roomA}, []id.EventID{"$2", "$1"}, false},
+		{"sender", SearchQuery{Text: "hello", Sender: bob}, []id.EventID{"$2"}, false},
+		{"since", SearchQuery{Text: "world", Since: time.UnixMilli(3000)}, []id.EventID{"$4", "$3"}, false},
+		{"until is exclusive", SearchQuery{Text: "world", Until: time.UnixMilli(3000)}, []id.EventID{"$1"}, false},
+		{"date range", SearchQuery{Text: "hello", Since: time.UnixMilli(1500), Until: time.UnixMilli(4000)}, []id.EventID{"$2"}, false},
+		{"limit keeps the most recent", SearchQuery{Text: "hello", Limit: 2}, []id.EventID{"$4", "$2"}, false},
+		{"limit above the results", SearchQuery{Text: "world", Limit: 10}, []id.EventID{"$4", "$3", "$1"}, false},
+		{"no words", SearchQuery{Text: "a !"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := hm.Search(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Search() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := resultIDs(results); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchAfterUpdate(t *testing.T) {
+	hm, room := searchHistory(t)
+
+	err := hm.Update(room, "$2", func(evt *mxevents.Event) error {
+		evt.Content = event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "hello again"}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketSearchTerms)
+		if index.Bucket([]byte("there")) != nil {
+			t.Error("posting bucket of a term no message has is kept")
+		}
+		for _, term := range []string{"hello", "again"} {
+			if index.Bucket([]byte(term)).Get(searchDocKey(roomA, "$2")) == nil {
+				t.Errorf("updated message is not indexed under %q", term)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results, _ := hm.Search(SearchQuery{Text: "there"}); len(results) != 0 {
+		t.Errorf("Search() found %v for a removed term", resultIDs(results))
+	}
+	if results, _ := hm.Search(SearchQuery{Text: "hello again"}); !reflect.DeepEqual(resultIDs(results), []id.EventID{"$4", "$2"}) {
+		t.Errorf("Search() = %v, want [$4 $2]", resultIDs(results))
+	}
+}
@@ -0,0 +1,100 @@
+package matrix
+
+import (
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Body of the /search request, mautrix has no support for it
+type reqSearch struct {
+	SearchCategories struct {
+		RoomEvents reqRoomEventsSearch `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type reqRoomEventsSearch struct {
+	SearchTerm string              `json:"search_term"`
+	Keys       []string            `json:"keys,omitempty"`
+	Filter     *mautrix.FilterPart `json:"filter,omitempty"`
+	OrderBy    string              `json:"order_by,omitempty"`
+}
+
+type respSearch struct {
+	SearchCategories struct {
+		RoomEvents struct {
+			Count   int `json:"count"`
+			Results []struct {
+				Rank   float64      `json:"rank"`
+				Result *event.Event `json:"result"`
+			} `json:"results"`
+		} `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+// Asks the homeserver for the messages matching the query. The server cannot read encrypted messages, so only
+// the unencrypted rooms are answered, including the parts of their history that were never fetched.
+func (c *ClientWrapper) searchServer(query SearchQuery) ([]*event.Event, error) {
+	var req reqSearch
+	req.SearchCategories.RoomEvents = reqRoomEventsSearch{
+		SearchTerm: query.Text,
+		Keys:       []string{"content.body"},
+		Filter:     &mautrix.FilterPart{Types: []event.Type{event.EventMessage}, Limit: query.Limit},
+		OrderBy:    "recent",
+	}
+	if query.RoomID != "" {
+		req.SearchCategories.RoomEvents.Filter.Rooms = []id.RoomID{query.RoomID}
+	}
+	if query.Sender != "" {
+		req.SearchCategories.RoomEvents.Filter.Senders = []id.UserID{query.Sender}
+	}
+
+	var resp respSearch
+	if _, err := c.client.MakeRequest("POST", c.client.BuildClientURL("v3", "search"), &req, &resp); err != nil {
+		return nil, err
+	}
+	events := make([]*event.Event, 0, len(resp.SearchCategories.RoomEvents.Results))
+	for _, result := range resp.SearchCategories.RoomEvents.Results {
+		evt := result.Result
+		if evt == nil {
+			continue
+		}
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			debug.Printf("Failed to unmarshal content of search result %s: %v", evt.ID, err)
+			continue
+		}
+		events = append(events, evt)
+	}
+	debug.Printf("Homeserver found %d of %d messages matching the search", len(events), resp.SearchCategories.RoomEvents.Count)
+	return events, nil
+}
+
+// Stores the server results in history, so that they can be searched offline, and returns the ones
+// that were not found locally
+func (c *ClientWrapper) cacheServerResults(query SearchQuery, events []*event.Event, local []SearchResult) []SearchResult {
+	seen := make(map[id.EventID]bool, len(local))
+	for _, result := range local {
+		seen[result.EventID] = true
+	}
+	byRoom := make(map[id.RoomID][]*event.Event)
+	var found []SearchResult
+	for _, evt := range events {
+		byRoom[evt.RoomID] = append(byRoom[evt.RoomID], evt)
+		content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if !ok || seen[evt.ID] {
+			continue
+		}
+		seen[evt.ID] = true
+		result := SearchResult{RoomID: evt.RoomID, EventID: evt.ID, Sender: evt.Sender, Timestamp: evt.Timestamp, Body: content.Body}
+		if query.Matches(result.Sender, result.Timestamp) {
+			found = append(found, result)
+		}
+	}
+	for roomID, roomEvents := range byRoom {
+		if err := c.history.Cache(c.GetOrCreateRoom(roomID), roomEvents); err != nil {
+			c.logger.Err(err).Msg("Could not cache search results of room " + roomID.String())
+		}
+	}
+	return found
+}
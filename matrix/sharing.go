@@ -0,0 +1,211 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"thesgo/matrix/rooms"
+)
+
+// Decides if a device receives our megolm sessions. Blacklisted devices never do, and with
+// send_to_verified_only set only the devices verified directly or through cross-signing do.
+// An empty code means the session can be shared, otherwise it is the reason sent in the withheld notice.
+func (c *ClientWrapper) keyShareDecision(device *id.Device) (event.RoomKeyWithheldCode, string) {
+	trust := c.ResolveTrust(device)
+	if trust == id.TrustStateBlacklisted {
+		return event.RoomKeyWithheldBlacklisted, "Device is blacklisted"
+	} else if c.config.SendToVerifiedOnly && trust < id.TrustStateCrossSignedVerified {
+		return event.RoomKeyWithheldUnverified, "This device does not encrypt messages for unverified devices"
+	}
+	return "", ""
+}
+
+// Shares the outbound megolm session of a room with the devices of its members. Without send_to_verified_only
+// this is left to the olm machine, which only withholds the session from blacklisted devices. Otherwise the
+// machine cannot be used, as it resolves cross-signing the wrong way (see ResolveTrust), so the session is
+// created here and sent to the devices that pass keyShareDecision, and the others get an m.room_key.withheld
+// notice instead. The stored trust of the devices is never changed.
+func (c *ClientWrapper) shareGroupSession(room *rooms.Room) error {
+	members := room.GetMemberList()
+	if !c.config.SendToVerifiedOnly {
+		return c.crypto.ShareGroupSession(context.TODO(), room.ID, members)
+	}
+
+	session := crypto.NewOutboundGroupSession(room.ID, c.crypto.StateStore.GetEncryptionEvent(room.ID))
+	if err := c.storeOwnGroupSession(session); err != nil {
+		return err
+	}
+
+	allowed := make(map[id.UserID]map[id.DeviceID]*id.Device)
+	withheld := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	for _, user := range members {
+		devices, err := c.crypto.CryptoStore.GetDevices(user)
+		if err != nil {
+			c.logger.Err(err).Msg("Could not load devices of " + user.String())
+			continue
+		} else if devices == nil {
+			devices = c.crypto.LoadDevices(user)
+		}
+		for _, device := range devices {
+			userKey := crypto.UserDevice{UserID: device.UserID, DeviceID: device.DeviceID}
+			if device.UserID == c.client.UserID && device.DeviceID == c.client.DeviceID {
+				session.Users[userKey] = crypto.OGSIgnored
+				continue
+			}
+			code, reason := c.keyShareDecision(device)
+			if code != "" {
+				c.logger.Info().Msg("Withholding room keys from device " + device.DeviceID.String() + " of " + device.UserID.String() + ": " + reason)
+				if withheld.Messages[user] == nil {
+					withheld.Messages[user] = make(map[id.DeviceID]*event.Content)
+				}
+				withheld.Messages[user][device.DeviceID] = &event.Content{Parsed: withheldNotice(event.RequestedKeyInfo{
+					Algorithm: id.AlgorithmMegolmV1,
+					RoomID:    room.ID,
+					SenderKey: c.crypto.OwnIdentity().IdentityKey,
+					SessionID: session.ID(),
+				}, code, reason)}
+				session.Users[userKey] = crypto.OGSIgnored
+				continue
+			}
+			if allowed[user] == nil {
+				allowed[user] = make(map[id.DeviceID]*id.Device)
+			}
+			allowed[user][device.DeviceID] = device
+		}
+	}
+
+	if err := c.createOlmSessions(allowed); err != nil {
+		c.logger.Err(err).Msg("Could not claim keys to share room keys")
+	}
+	shared := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	var recipients []crypto.UserDevice
+	for user, devices := range allowed {
+		for deviceID, device := range devices {
+			olmSession, err := c.crypto.CryptoStore.GetLatestSession(device.IdentityKey)
+			if err != nil || olmSession == nil {
+				c.logger.Warn().Msg("No olm session to share room keys with device " + deviceID.String() + " of " + user.String())
+				continue
+			}
+			if shared.Messages[user] == nil {
+				shared.Messages[user] = make(map[id.DeviceID]*event.Content)
+			}
+			encrypted := c.encryptOlm(device.IdentityKey, device.SigningKey, olmSession, user, event.ToDeviceRoomKey, session.ShareContent())
+			shared.Messages[user][deviceID] = &event.Content{Parsed: encrypted}
+			recipients = append(recipients, crypto.UserDevice{UserID: user, DeviceID: deviceID})
+		}
+	}
+	if len(recipients) > 0 {
+		if _, err := c.client.SendToDevice(event.ToDeviceEncrypted, shared); err != nil {
+			return fmt.Errorf("failed to share group session: %w", err)
+		}
+	}
+	for _, userKey := range recipients {
+		session.Users[userKey] = crypto.OGSAlreadyShared
+	}
+
+	session.Shared = true
+	if err := c.crypto.CryptoStore.AddOutboundGroupSession(session); err != nil {
+		return fmt.Errorf("failed to store group session: %w", err)
+	}
+	debug.Printf("Shared session %s of %s with %d devices", session.ID(), room.ID, len(recipients))
+
+	if len(withheld.Messages) > 0 {
+		if _, err := c.client.SendToDevice(event.ToDeviceRoomKeyWithheld, withheld); err != nil {
+			c.logger.Err(err).Msg("Could not send withheld notices")
+		}
+	}
+	return nil
+}
+
+// Starts an Olm session with every given device that has none yet, claiming their one-time keys in a single
+// request, like the olm machine does before sharing a session
+func (c *ClientWrapper) createOlmSessions(devices map[id.UserID]map[id.DeviceID]*id.Device) error {
+	request := make(mautrix.OneTimeKeysRequest)
+	for user, userDevices := range devices {
+		for deviceID, device := range userDevices {
+			if c.crypto.CryptoStore.HasSession(device.IdentityKey) {
+				continue
+			}
+			if request[user] == nil {
+				request[user] = make(map[id.DeviceID]id.KeyAlgorithm)
+			}
+			request[user][deviceID] = id.KeyAlgorithmSignedCurve25519
+		}
+	}
+	if len(request) == 0 {
+		return nil
+	}
+
+	resp, err := c.client.ClaimKeys(&mautrix.ReqClaimKeys{OneTimeKeys: request, Timeout: 10 * 1000})
+	if err != nil {
+		return fmt.Errorf("failed to claim keys: %w", err)
+	}
+	for user, userKeys := range resp.OneTimeKeys {
+		for deviceID, keys := range userKeys {
+			device := devices[user][deviceID]
+			if device == nil {
+				continue
+			}
+			for keyID, key := range keys {
+				if alg, _ := keyID.Parse(); alg != id.KeyAlgorithmSignedCurve25519 {
+					continue
+				}
+				if ok, err := olm.VerifySignatureJSON(key.RawData, user, deviceID.String(), device.SigningKey); err != nil || !ok {
+					c.logger.Warn().Msg("Claimed key " + keyID.String() + " of device " + deviceID.String() + " has an invalid signature")
+					break
+				}
+				internal, err := c.crypto.GetAccount().Internal.NewOutboundSession(device.IdentityKey, key.Key)
+				if err != nil {
+					c.logger.Err(err).Msg("Could not create olm session with device " + deviceID.String())
+					break
+				}
+				now := time.Now()
+				session := &crypto.OlmSession{
+					Internal: *internal,
+					ExpirationMixin: crypto.ExpirationMixin{
+						TimeMixin: crypto.TimeMixin{CreationTime: now, LastEncryptedTime: now, LastDecryptedTime: now},
+					},
+				}
+				if err = c.crypto.CryptoStore.AddSession(device.IdentityKey, session); err != nil {
+					c.logger.Err(err).Msg("Could not store olm session with device " + deviceID.String())
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Keeps the inbound side of a megolm session we created, like the olm machine does, so that our own
+// messages can be decrypted
+func (c *ClientWrapper) storeOwnGroupSession(session *crypto.OutboundGroupSession) error {
+	if c.crypto.DontStoreOutboundKeys {
+		return nil
+	}
+	own := c.crypto.OwnIdentity()
+	inbound, err := crypto.NewInboundGroupSession(own.IdentityKey, own.SigningKey, session.RoomID, session.Internal.Key(), session.MaxAge, session.MaxMessages, false)
+	if err != nil {
+		return fmt.Errorf("failed to create inbound group session: %w", err)
+	}
+	return c.crypto.CryptoStore.PutGroupSession(session.RoomID, own.IdentityKey, session.ID(), inbound)
+}
+
+// Builds the withheld notice for a session requested by a device that may not receive it
+func withheldNotice(body event.RequestedKeyInfo, code event.RoomKeyWithheldCode, reason string) *event.RoomKeyWithheldEventContent {
+	return &event.RoomKeyWithheldEventContent{
+		RoomID:    body.RoomID,
+		Algorithm: body.Algorithm,
+		SessionID: body.SessionID,
+		SenderKey: body.SenderKey,
+		Code:      code,
+		Reason:    reason,
+	}
+}
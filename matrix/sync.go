@@ -20,6 +20,12 @@ type ThesgoSyncer struct {
 	FirstSyncDone     bool
 	InitDoneCallback  func()
 	FirstDoneCallback func()
+	// LimitedCallback is called before the timeline of a room is processed when the server left out events
+	// between the previous sync and this one, with the token to fetch them
+	LimitedCallback func(room *rooms.Room, prevBatch string)
+	// FailedCallback is called when a /sync fails and returns how long to wait before the next one.
+	// Returning an error stops syncing.
+	FailedCallback func(err error) (time.Duration, error)
 }
 
 // NewThesgoSyncer returns an instantiated ThesgoSyncer
@@ -56,6 +62,7 @@ func (s *ThesgoSyncer) ProcessResponse(res *mautrix.RespSync, since string) (err
 	//s.Progress.Step()
 	s.processSyncEvents(nil, res.AccountData.Events, mautrix.EventSourceAccountData)
 	//s.Progress.Step()
+	s.processSyncEvents(nil, res.ToDevice.Events, mautrix.EventSourceToDevice)
 
 	wait.Add(steps)
 
@@ -99,6 +106,9 @@ func (s *ThesgoSyncer) processJoinedRoom(roomID id.RoomID, roomData mautrix.Sync
 	room := s.rooms.GetOrCreate(roomID)
 	room.UpdateSummary(roomData.Summary)
 	s.processSyncEvents(room, roomData.State.Events, mautrix.EventSourceJoin|mautrix.EventSourceState)
+	if roomData.Timeline.Limited && s.LimitedCallback != nil {
+		s.LimitedCallback(room, roomData.Timeline.PrevBatch)
+	}
 	s.processSyncEvents(room, roomData.Timeline.Events, mautrix.EventSourceJoin|mautrix.EventSourceTimeline)
 	s.processSyncEvents(room, roomData.Ephemeral.Events, mautrix.EventSourceJoin|mautrix.EventSourceEphemeral)
 	s.processSyncEvents(room, roomData.AccountData.Events, mautrix.EventSourceJoin|mautrix.EventSourceAccountData)
@@ -195,9 +205,12 @@ func (s *ThesgoSyncer) notifyListeners(source mautrix.EventSource, evt *event.Ev
 	}
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+// OnFailedSync leaves the wait period between failed /syncs to FailedCallback, or waits 10 seconds without it.
 func (s *ThesgoSyncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
 	debug.Printf("Sync failed: %v", err)
+	if s.FailedCallback != nil {
+		return s.FailedCallback(err)
+	}
 	return 10 * time.Second, nil
 }
 
@@ -6,47 +6,81 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/exp/slices"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
-// Struct to pass as the VerificationHook for the verification process
-type VerificationContainer struct {
-	device    *id.Device
-	emojiText *EmojiView
+type VerificationState string
+
+// The states a verification goes through, from being started until it either succeeds or is cancelled
+const (
+	VerificationRequested       VerificationState = "requested" //incoming request waiting to be accepted or declined
+	VerificationDeclined        VerificationState = "declined"
+	VerificationStarted         VerificationState = "started"
+	VerificationAwaitingConfirm VerificationState = "awaiting_confirmation"
+	VerificationConfirmed       VerificationState = "confirmed" //SAS matched on our side, waiting for the other device
+	VerificationRejected        VerificationState = "rejected"
+	VerificationSucceeded       VerificationState = "success"
+	VerificationCancelled       VerificationState = "cancelled"
+)
 
-	confirmChan chan bool
-	done        bool
+// Limits of the verification registry, so that requests nobody answers and finished verifications do not pile up
+const (
+	verificationRequestTimeout = 10 * time.Minute //the spec has clients ignore requests older than this too
+	verificationKeepFinished   = 10 * time.Minute //how long a finished verification is still listed with its outcome
+	maxPendingRequests         = 3                //unanswered requests kept per user, the rest are rejected
+)
+
+// SASEmoji is one of the emojis shown when comparing the short authentication string
+type SASEmoji struct {
+	Emoji       string `json:"emoji"`
+	Description string `json:"description"`
 }
 
-func NewVerificationContainer(device *id.Device, timeout time.Duration) *VerificationContainer {
-	vc := &VerificationContainer{
-		device:      device,
-		done:        false,
-		confirmChan: make(chan bool),
-	}
+// Verification describes an ongoing SAS verification with another device, including the data the user has to compare
+type Verification struct {
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transaction_id"`
+	RoomID        id.RoomID `json:"room_id,omitempty"`
+	Incoming      bool      `json:"incoming"` //requested by the other device
 
-	vc.emojiText = &EmojiView{}
+	UserID   id.UserID   `json:"user_id"`
+	DeviceID id.DeviceID `json:"device_id,omitempty"`
 
-	return vc
+	State   VerificationState `json:"state"`
+	Reason  string            `json:"reason,omitempty"`
+	Started time.Time         `json:"started"`
+
+	SASType  event.SASMethod `json:"sas_type,omitempty"`
+	Emojis   []SASEmoji      `json:"emojis,omitempty"`
+	Decimals []uint          `json:"decimals,omitempty"`
+
+	decision chan bool
+	timeout  time.Duration
 }
 
-func (vc *VerificationContainer) VerificationMethods() []crypto.VerificationMethod {
-	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
+// Confirmer decides whether the SAS shown on both devices match, blocking until it does
+type Confirmer interface {
+	Confirm(v *Verification) bool
 }
 
-func (vc *VerificationContainer) VerifySASMatch(otherDevice *id.Device, data crypto.SASData) bool {
-	vc.device = otherDevice
+// StdinConfirmer prints the SAS to the console and waits for the user to type "yes"
+type StdinConfirmer struct{}
+
+func (StdinConfirmer) Confirm(v *Verification) bool {
 	var typeName string
-	if data.Type() == event.SASDecimal {
+	if v.SASType == event.SASDecimal {
 		typeName = "numbers"
-	} else if data.Type() == event.SASEmoji {
-		typeName = "emojis"
 	} else {
-		return false
+		typeName = "emojis"
 	}
 
 	fmt.Printf(
@@ -54,19 +88,220 @@ func (vc *VerificationContainer) VerifySASMatch(otherDevice *id.Device, data cry
 			"same %s as below, then type \"yes\" to\n"+
 			"accept, or \"no\" to reject", typeName)
 
-	vc.emojiText.Data = data
-
 	//Print emoji to console, wait for user input (Yes/No)
-	vc.emojiText.Draw()
-	go vc.awaitConfirm()
+	(&EmojiView{Verification: v}).Draw()
+
+	reader := bufio.NewReader(os.Stdin)
+	line, _ := reader.ReadString('\n')
+	line = strings.Replace(line, "\n", "", -1)
+	//for windows: line = strings.Replace(line, "\r\n", "", -1)
+	return strings.Compare(line, "yes") == 0
+}
 
-	confirm := <-vc.confirmChan
-	vc.emojiText.Data = nil
+// AutoAcceptConfirmer accepts the verifications with pre-approved users right away, passing the rest on to Next
+type AutoAcceptConfirmer struct {
+	Users []id.UserID
+	Next  Confirmer
+}
 
-	fmt.Printf("Waiting for %s\nto confirm", vc.device.UserID)
+func (ac *AutoAcceptConfirmer) Confirm(v *Verification) bool {
+	if slices.Contains(ac.Users, v.UserID) {
+		return true
+	} else if ac.Next == nil {
+		return false
+	}
+	return ac.Next.Confirm(v)
+}
 
-	return confirm
+// VerificationRegistry keeps track of every verification of this client. It is also a Confirmer that
+// waits for another component (e.g. the control API) to resolve the verification, or rejects it on timeout.
+type VerificationRegistry struct {
+	lock   sync.Mutex
+	nextID int
+	byID   map[string]*Verification
+
+	requests map[string]*verificationRequest //incoming requests, by transaction ID
+	events   map[string]*event.Event         //request and start events, by transaction ID
+}
+
+// An incoming request, held back until the user answers it
+type verificationRequest struct {
+	vc       *VerificationContainer
+	accepted bool
+}
 
+func NewVerificationRegistry() *VerificationRegistry {
+	return &VerificationRegistry{
+		byID:     make(map[string]*Verification),
+		requests: make(map[string]*verificationRequest),
+		events:   make(map[string]*event.Event),
+	}
+}
+
+// must be called with the lock held
+func (vr *VerificationRegistry) add(v *Verification) {
+	vr.nextID++
+	v.ID = strconv.Itoa(vr.nextID)
+	vr.byID[v.ID] = v
+}
+
+// Marks the verification as over and forgets its request and events, keeping it listed for a while so its
+// outcome can still be checked. Must be called with the lock held
+func (vr *VerificationRegistry) finish(v *Verification, state VerificationState, reason string) {
+	v.State = state
+	if len(reason) > 0 {
+		v.Reason = reason
+	}
+	if len(v.TransactionID) > 0 {
+		delete(vr.requests, v.TransactionID)
+		delete(vr.events, v.TransactionID)
+	}
+	time.AfterFunc(verificationKeepFinished, func() {
+		vr.lock.Lock()
+		defer vr.lock.Unlock()
+		delete(vr.byID, v.ID)
+	})
+}
+
+// How many requests of the given user are waiting for an answer. Must be called with the lock held
+func (vr *VerificationRegistry) pending(user id.UserID) (count int) {
+	for _, req := range vr.requests {
+		v := req.vc.verification
+		if v.UserID == user && v.State == VerificationRequested {
+			count++
+		}
+	}
+	return
+}
+
+func (vr *VerificationRegistry) update(fn func()) {
+	vr.lock.Lock()
+	defer vr.lock.Unlock()
+	fn()
+}
+
+// List returns a copy of every ongoing verification, and of the ones that finished in the last few minutes
+func (vr *VerificationRegistry) List() []Verification {
+	vr.lock.Lock()
+	defer vr.lock.Unlock()
+	list := make([]Verification, 0, len(vr.byID))
+	for _, v := range vr.byID {
+		list = append(list, *v)
+	}
+	slices.SortFunc(list, func(a, b Verification) bool {
+		return a.Started.Before(b.Started)
+	})
+	return list
+}
+
+// Resolve confirms or rejects the verification with the given ID, which must be awaiting confirmation
+func (vr *VerificationRegistry) Resolve(verificationID string, accept bool) error {
+	vr.lock.Lock()
+	defer vr.lock.Unlock()
+	v, ok := vr.byID[verificationID]
+	if !ok {
+		return fmt.Errorf("unknown verification %s", verificationID)
+	} else if v.State != VerificationAwaitingConfirm {
+		return fmt.Errorf("verification %s is not awaiting confirmation (%s)", verificationID, v.State)
+	}
+	select {
+	case v.decision <- accept:
+		return nil
+	default:
+		return fmt.Errorf("verification %s was already resolved", verificationID)
+	}
+}
+
+func (vr *VerificationRegistry) Confirm(v *Verification) bool {
+	select {
+	case accept := <-v.decision:
+		return accept
+	case <-time.After(v.timeout):
+		return false
+	}
+}
+
+// Struct to pass as the VerificationHook for the verification process
+type VerificationContainer struct {
+	device *id.Device
+
+	verification *Verification
+	registry     *VerificationRegistry
+	confirmer    Confirmer
+}
+
+func NewVerificationContainer(device *id.Device, timeout time.Duration, registry *VerificationRegistry, confirmer Confirmer) *VerificationContainer {
+	vc := &VerificationContainer{
+		device:       device,
+		registry:     registry,
+		confirmer:    confirmer,
+		verification: newVerification(device, timeout),
+	}
+	registry.lock.Lock()
+	registry.add(vc.verification)
+	registry.lock.Unlock()
+	return vc
+}
+
+func newVerification(device *id.Device, timeout time.Duration) *Verification {
+	return &Verification{
+		UserID:   device.UserID,
+		DeviceID: device.DeviceID,
+		State:    VerificationStarted,
+		Started:  time.Now(),
+		decision: make(chan bool, 1),
+		timeout:  timeout,
+	}
+}
+
+// Verification returns the registry entry of this verification
+func (vc *VerificationContainer) Verification() *Verification {
+	return vc.verification
+}
+
+func (vc *VerificationContainer) VerificationMethods() []crypto.VerificationMethod {
+	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
+}
+
+func (vc *VerificationContainer) VerifySASMatch(otherDevice *id.Device, data crypto.SASData) bool {
+	vc.device = otherDevice
+	v := vc.verification
+
+	var emojis []SASEmoji
+	var decimals []uint
+	switch sas := data.(type) {
+	case crypto.EmojiSASData:
+		for _, emoji := range sas {
+			emojis = append(emojis, SASEmoji{Emoji: string(emoji.Emoji), Description: emoji.Description})
+		}
+	case crypto.DecimalSASData:
+		decimals = sas[:]
+	default:
+		return false
+	}
+
+	vc.registry.update(func() {
+		v.DeviceID = otherDevice.DeviceID
+		v.SASType = data.Type()
+		v.Emojis = emojis
+		v.Decimals = decimals
+		v.State = VerificationAwaitingConfirm
+	})
+
+	confirm := vc.confirmer.Confirm(v)
+
+	vc.registry.update(func() {
+		if confirm {
+			v.State = VerificationConfirmed
+		} else {
+			vc.registry.finish(v, VerificationRejected, "")
+		}
+	})
+
+	if confirm {
+		fmt.Printf("Waiting for %s\nto confirm", vc.device.UserID)
+	}
+	return confirm
 }
 
 func (vc *VerificationContainer) OnCancel(cancelledByUs bool, reason string, _ event.VerificationCancelCode) {
@@ -76,53 +311,205 @@ func (vc *VerificationContainer) OnCancel(cancelledByUs bool, reason string, _ e
 		fmt.Printf("Verification cancelled by %s: %s", vc.device.UserID, reason)
 	}
 
-	//vm.inputBar.SetPlaceholder("Press enter to close the dialog")
-	//vc.stopWaiting <- struct{}{}
-	vc.done = true
+	vc.registry.update(func() {
+		vc.registry.finish(vc.verification, VerificationCancelled, reason)
+	})
 }
 
 func (vc *VerificationContainer) OnSuccess() {
 	fmt.Printf("Successfully verified %s (%s) of %s", vc.device.Name, vc.device.DeviceID, vc.device.UserID)
-	vc.done = true
-}
-
-func (vc *VerificationContainer) awaitConfirm() {
-	reader := bufio.NewReader(os.Stdin)
-	line, _ := reader.ReadString('\n')
-	line = strings.Replace(line, "\n", "", -1)
-	//for windows: line = strings.Replace(line, "\r\n", "", -1)
-	if strings.Compare(line, "yes") == 0 {
-		//send signal to parent thread
-		vc.confirmChan <- true
-	} else {
-		vc.confirmChan <- false
-	}
+	vc.registry.update(func() {
+		vc.registry.finish(vc.verification, VerificationSucceeded, "")
+	})
 }
 
 type EmojiView struct {
-	Data crypto.SASData
+	Verification *Verification
 }
 
 func (e *EmojiView) Draw() {
-	if e.Data == nil {
+	if e.Verification == nil {
 		return
 	}
 
-	switch e.Data.Type() {
+	switch e.Verification.SASType {
 	case event.SASEmoji:
-		for _, emoji := range e.Data.(crypto.EmojiSASData) {
+		for _, emoji := range e.Verification.Emojis {
 			fmt.Print(emoji.Emoji)
 
 		}
 		fmt.Println() //Hacky way to have the description of each emoji below the respective emoji
-		for _, emoji := range e.Data.(crypto.EmojiSASData) {
+		for _, emoji := range e.Verification.Emojis {
 			fmt.Print(emoji.Description)
 
 		}
 	case event.SASDecimal:
-		for _, number := range e.Data.(crypto.DecimalSASData) {
+		for _, number := range e.Verification.Decimals {
 			fmt.Print(strconv.FormatUint(uint64(number), 10))
 		}
 	}
 
 }
+
+// SetConfirmer changes how the SAS of new verifications are confirmed, e.g. through the control API when running
+// headless. Users listed in the auto_verify_users config are always accepted without asking.
+func (c *ClientWrapper) SetConfirmer(confirmer Confirmer) {
+	c.confirmer = confirmer
+}
+
+// Verifications returns the registry of the verifications of this client
+func (c *ClientWrapper) Verifications() *VerificationRegistry {
+	return c.verifications
+}
+
+// Starts an in-room SAS verification with the given user, returning its registry entry
+func (c *ClientWrapper) StartVerification(roomID id.RoomID, user id.UserID) (*Verification, error) {
+	confirmer := &AutoAcceptConfirmer{Users: c.config.AutoVerifyUsers, Next: c.confirmer}
+	vc := NewVerificationContainer(&id.Device{UserID: user}, c.crypto.DefaultSASTimeout, c.verifications, confirmer)
+	txnID, err := c.crypto.NewInRoomSASVerificationWith(roomID, user, vc, 120*time.Second)
+	if err != nil {
+		c.verifications.update(func() {
+			c.verifications.finish(vc.verification, VerificationCancelled, err.Error())
+		})
+		return nil, err
+	}
+
+	v := vc.Verification()
+	c.verifications.update(func() {
+		v.TransactionID = txnID
+		v.RoomID = roomID
+	})
+	return v, nil
+}
+
+// Keeps the event that carried a verification request or start, so that it can be processed again once accepted
+func (c *ClientWrapper) recordVerificationEvent(evt *event.Event) {
+	var txnID string
+	switch content := evt.Content.Parsed.(type) {
+	case *event.MessageEventContent: //in-room request
+		txnID = evt.ID.String()
+	case *event.VerificationRequestEventContent:
+		txnID = content.TransactionID
+	case *event.VerificationStartEventContent:
+		if content.RelatesTo != nil {
+			txnID = content.RelatesTo.EventID.String()
+		} else {
+			txnID = content.TransactionID
+		}
+	}
+	if len(txnID) == 0 {
+		return
+	}
+	vr := c.verifications
+	vr.update(func() {
+		vr.events[txnID] = evt
+	})
+	//events of requests that are never answered or accepted would otherwise be kept forever
+	time.AfterFunc(verificationRequestTimeout, func() {
+		vr.update(func() {
+			if vr.events[txnID] == evt {
+				delete(vr.events, txnID)
+			}
+		})
+	})
+}
+
+// HandleVerificationEvent records the to-device verification requests, which the crypto machine processes itself
+func (c *ClientWrapper) HandleVerificationEvent(_ mautrix.EventSource, evt *event.Event) {
+	c.recordVerificationEvent(evt)
+}
+
+// Hook called by the crypto machine for every incoming verification request. Requests are only accepted
+// right away from the users listed in auto_verify_users, the others wait for the user to answer them.
+func (c *ClientWrapper) acceptVerificationFrom(txnID string, device *id.Device, roomID id.RoomID) (crypto.VerificationRequestResponse, crypto.VerificationHooks) {
+	vr := c.verifications
+	vr.lock.Lock()
+	defer vr.lock.Unlock()
+
+	if req, ok := vr.requests[txnID]; ok {
+		if req.accepted {
+			return crypto.AcceptRequest, req.vc
+		}
+		return crypto.IgnoreRequest, nil
+	}
+
+	autoAccept := slices.Contains(c.config.AutoVerifyUsers, device.UserID)
+	if !autoAccept && vr.pending(device.UserID) >= maxPendingRequests {
+		debug.Printf("Rejecting verification request %s from %s, who already has %d requests waiting", txnID, device.UserID, maxPendingRequests)
+		delete(vr.events, txnID)
+		return crypto.RejectRequest, nil
+	}
+
+	v := newVerification(device, c.crypto.DefaultSASTimeout)
+	v.TransactionID, v.RoomID, v.Incoming = txnID, roomID, true
+	v.State = VerificationRequested
+	vr.add(v)
+	vc := &VerificationContainer{
+		device:       device,
+		registry:     vr,
+		confirmer:    &AutoAcceptConfirmer{Users: c.config.AutoVerifyUsers, Next: c.confirmer},
+		verification: v,
+	}
+
+	req := &verificationRequest{vc: vc, accepted: autoAccept}
+	vr.requests[txnID] = req
+	if req.accepted {
+		v.State = VerificationStarted
+		return crypto.AcceptRequest, vc
+	}
+	time.AfterFunc(verificationRequestTimeout, func() {
+		vr.update(func() {
+			if v.State == VerificationRequested {
+				vr.finish(v, VerificationCancelled, "timed out")
+			}
+		})
+	})
+
+	fmt.Printf("Verification request %s from %s (%s), answer it with \"thesgo user verifications\"\n", v.ID, device.UserID, device.DeviceID)
+	debug.Printf("Verification request %s from %s (%s)", txnID, device.UserID, device.DeviceID)
+	return crypto.IgnoreRequest, nil
+}
+
+// ConfirmVerification answers the verification with the given ID: an incoming request is accepted or declined,
+// while a verification showing its SAS is confirmed or rejected
+func (c *ClientWrapper) ConfirmVerification(verificationID string, accept bool) error {
+	vr := c.verifications
+	vr.lock.Lock()
+	v, ok := vr.byID[verificationID]
+	if !ok || v.State != VerificationRequested {
+		vr.lock.Unlock()
+		return vr.Resolve(verificationID, accept)
+	}
+	req := vr.requests[v.TransactionID]
+	evt := vr.events[v.TransactionID]
+	delete(vr.events, v.TransactionID)
+	if accept {
+		req.accepted = true
+		v.State = VerificationStarted
+	} else {
+		vr.finish(v, VerificationDeclined, "")
+	}
+	vr.lock.Unlock()
+
+	if !accept {
+		if len(v.RoomID) > 0 {
+			return c.crypto.SendInRoomSASVerificationCancel(v.RoomID, v.UserID, v.TransactionID, "Not accepted by user", event.VerificationCancelByUser)
+		}
+		return c.crypto.SendSASVerificationCancel(v.UserID, v.DeviceID, v.TransactionID, "Not accepted by user", event.VerificationCancelByUser)
+	} else if evt == nil {
+		return fmt.Errorf("the request of verification %s is no longer available", verificationID)
+	}
+
+	//processing the request again makes the crypto machine ask acceptVerificationFrom, which now accepts it
+	if len(v.RoomID) > 0 {
+		return c.crypto.ProcessInRoomVerification(evt)
+	}
+	c.crypto.HandleToDeviceEvent(evt)
+	return nil
+}
+
+// Whether the event is an in-room verification request, which is sent as a regular message
+func isVerificationRequest(evt *event.Event) bool {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && evt.Type == event.EventMessage && content.MsgType == event.MsgVerificationRequest
+}
@@ -0,0 +1,36 @@
+package offline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// LoadIdentity reads the libp2p private key stored at the given path, generating and saving a new
+// Ed25519 key the first time, so that the peer ID of this host stays the same between runs
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		return nil, err
+	}
+	data, err = crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
@@ -0,0 +1,2 @@
+// Package with the framing used on the /matrix-offline streams between peers
+package wire
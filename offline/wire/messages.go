@@ -0,0 +1,73 @@
+package wire
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Ack confirms that a user's device received and stored an event
+type Ack struct {
+	EventID  id.EventID  `json:"event_id"`
+	UserID   id.UserID   `json:"user_id"`
+	DeviceID id.DeviceID `json:"device_id"`
+}
+
+// Nack reports that an event was received, but could not be handled
+type Nack struct {
+	EventID id.EventID `json:"event_id"`
+	Reason  string     `json:"reason"`
+}
+
+// Relay hands an event over to a peer that carries it to the users who missed it. The event stays megolm
+// encrypted, so only a relay that is itself a member of the room can read it.
+type Relay struct {
+	Event    *event.Event                `json:"event"`
+	Users    []id.UserID                 `json:"users"`   //the users that did not receive the event yet
+	Devices  map[id.UserID][]id.DeviceID `json:"devices"` //the known devices of each of those users
+	Expires  int64                       `json:"expires"` //unix milliseconds after which the event is dropped
+	HopsLeft int                         `json:"hops_left"`
+}
+
+// Challenge carries a nonce that the other peer must sign to prove it owns the device it claims to be
+type Challenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// Proof is the Ed25519 device key signature over a challenge, see ProofMessage
+type Proof struct {
+	Signature string `json:"signature"`
+}
+
+// Error codes sent in error frames
+const (
+	ErrCodeUnknownDevice   = "unknown_device"
+	ErrCodeUnknownPeer     = "unknown_peer"
+	ErrCodeUntrustedDevice = "untrusted_device"
+	ErrCodeInvalidProof    = "invalid_proof"
+)
+
+// Error is sent before a peer aborts the exchange
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return "peer aborted the exchange: " + e.Code + ": " + e.Message
+}
+
+// ProofMessage builds the message signed when answering a challenge. Binding the nonce to the libp2p
+// peer IDs of both ends prevents a proof from being replayed on a different connection.
+func ProofMessage(nonce []byte, signerPeer, verifierPeer string, user id.UserID, device id.DeviceID) string {
+	return strings.Join([]string{
+		"thesgo.offline.handshake.v1",
+		base64.RawStdEncoding.EncodeToString(nonce),
+		signerPeer,
+		verifierPeer,
+		user.String(),
+		device.String(),
+	}, "|")
+}
@@ -0,0 +1,192 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version of the framing, sent in the header of every frame
+const Version uint8 = 1
+
+// MaxFrameSize is the largest payload a peer is allowed to send in a single frame
+const MaxFrameSize = 1 << 20
+
+// version (1 byte) + message type (1 byte) + payload length (4 bytes, big endian)
+const headerSize = 6
+
+type Type uint8
+
+const (
+	TypeCredentials    Type = iota + 1 //the matrix device of the peer
+	TypeEncryptedEvent                 //a megolm encrypted event the other peer missed
+	TypeKeyRequest                     //a request for the megolm session of an event that could not be decrypted
+	TypeForwardedKey                   //an olm encrypted forwarded room key, answering a key request
+	TypeAck                            //the event was received and decrypted
+	TypeNack                           //the event was received, but could not be handled
+	TypeError                          //the exchange was aborted by the other peer
+	TypeChallenge                      //a fresh nonce the other peer has to sign with its device key
+	TypeProof                          //the signature answering a challenge
+	TypeWithheld                       //an m.room_key.withheld notice, answering a key request the peer may not get
+	TypeRelay                          //a megolm encrypted event the peer should carry to other users
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeCredentials:
+		return "credentials"
+	case TypeEncryptedEvent:
+		return "encrypted event"
+	case TypeKeyRequest:
+		return "key request"
+	case TypeForwardedKey:
+		return "forwarded key"
+	case TypeAck:
+		return "ack"
+	case TypeNack:
+		return "nack"
+	case TypeError:
+		return "error"
+	case TypeChallenge:
+		return "challenge"
+	case TypeProof:
+		return "proof"
+	case TypeWithheld:
+		return "withheld"
+	case TypeRelay:
+		return "relay"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(t))
+	}
+}
+
+func (t Type) valid() bool {
+	return t >= TypeCredentials && t <= TypeRelay
+}
+
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds the maximum frame size")
+	ErrUnsupportedVersion = errors.New("unsupported frame version")
+	ErrUnknownType        = errors.New("unknown frame type")
+	ErrUnexpectedFrame    = errors.New("unexpected frame type")
+)
+
+// Frame is a single message exchanged on an offline stream
+type Frame struct {
+	Type    Type
+	Payload []byte
+}
+
+// Decode unmarshals the JSON payload of the frame into v
+func (f *Frame) Decode(v interface{}) error {
+	return json.Unmarshal(f.Payload, v)
+}
+
+type Encoder struct {
+	w *bufio.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// WriteFrame writes a single frame with the given payload and flushes it to the underlying writer
+func (e *Encoder) WriteFrame(t Type, payload []byte) error {
+	if !t.valid() {
+		return ErrUnknownType
+	} else if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	var header [headerSize]byte
+	header[0] = Version
+	header[1] = byte(t)
+	binary.BigEndian.PutUint32(header[2:], uint32(len(payload)))
+	if _, err := e.w.Write(header[:]); err != nil {
+		return err
+	} else if _, err = e.w.Write(payload); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// Encode writes a frame whose payload is the JSON encoding of v
+func (e *Encoder) Encode(t Type, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.WriteFrame(t, payload)
+}
+
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// ReadFrame blocks until a whole frame is read. A clean end of stream between frames is reported as io.EOF.
+func (d *Decoder) ReadFrame() (*Frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
+	}
+	t := Type(header[1])
+	if !t.valid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, header[1])
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &Frame{Type: t, Payload: payload}, nil
+}
+
+// Expect reads the next frame, failing if it is not of the given type.
+// Error frames sent by the other peer are returned as *Error.
+func (d *Decoder) Expect(t Type) (*Frame, error) {
+	frame, err := d.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type == t {
+		return frame, nil
+	} else if frame.Type == TypeError {
+		remote := &Error{}
+		if err = frame.Decode(remote); err != nil {
+			return nil, err
+		}
+		return nil, remote
+	}
+	return nil, fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedFrame, t, frame.Type)
+}
+
+// Conn pairs an encoder and a decoder over the same stream
+type Conn struct {
+	*Encoder
+	*Decoder
+}
+
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{
+		Encoder: NewEncoder(rw),
+		Decoder: NewDecoder(rw),
+	}
+}
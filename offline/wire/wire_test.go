@@ -0,0 +1,197 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Connects two peers through an in-memory pipe
+func pipe(t *testing.T) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return NewConn(a), NewConn(b)
+}
+
+// Writes raw bytes to the pipe without blocking the test, as net.Pipe has no buffer
+func writeRaw(t *testing.T, data []byte) *Conn {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	go func() {
+		_, _ = a.Write(data)
+	}()
+	return NewConn(b)
+}
+
+func header(version uint8, t Type, length uint32) []byte {
+	data := make([]byte, headerSize)
+	data[0] = version
+	data[1] = byte(t)
+	binary.BigEndian.PutUint32(data[2:], length)
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	roomKey := event.RequestedKeyInfo{
+		Algorithm: id.AlgorithmMegolmV1,
+		RoomID:    "!room:example.org",
+		SenderKey: "senderkey",
+		SessionID: "session",
+	}
+	encrypted := &event.Event{
+		ID:     "$event",
+		Sender: "@alice:example.org",
+		RoomID: "!room:example.org",
+		Type:   event.EventEncrypted,
+	}
+	tests := []struct {
+		t     Type
+		value interface{}
+	}{
+		{TypeCredentials, &id.Device{UserID: "@alice:example.org", DeviceID: "ALICE", IdentityKey: "idkey", SigningKey: "edkey"}},
+		{TypeEncryptedEvent, encrypted},
+		{TypeKeyRequest, &event.RoomKeyRequestEventContent{Body: roomKey, Action: event.KeyRequestActionRequest, RequestID: "req", RequestingDeviceID: "BOB"}},
+		{TypeForwardedKey, &event.Event{Sender: "@alice:example.org", Type: event.ToDeviceEncrypted}},
+		{TypeAck, &Ack{EventID: "$event", UserID: "@bob:example.org", DeviceID: "BOB"}},
+		{TypeNack, &Nack{EventID: "$event", Reason: "could not decrypt"}},
+		{TypeError, &Error{Code: ErrCodeUnknownDevice, Message: "who are you"}},
+		{TypeChallenge, &Challenge{Nonce: []byte{1, 2, 3, 4}}},
+		{TypeProof, &Proof{Signature: "signature"}},
+		{TypeWithheld, &event.RoomKeyWithheldEventContent{RoomID: roomKey.RoomID, Algorithm: roomKey.Algorithm, SessionID: roomKey.SessionID, SenderKey: roomKey.SenderKey, Code: event.RoomKeyWithheldUnverified, Reason: "unverified"}},
+		{TypeRelay, &Relay{Event: encrypted, Users: []id.UserID{"@bob:example.org"}, Devices: map[id.UserID][]id.DeviceID{"@bob:example.org": {"BOB"}}, Expires: 1700000000000, HopsLeft: 2}},
+	}
+	if len(tests) != int(TypeRelay) {
+		t.Fatalf("%d message types tested, %d defined", len(tests), TypeRelay)
+	}
+
+	sender, receiver := pipe(t)
+	for _, test := range tests {
+		errs := make(chan error, 1)
+		go func(t Type, v interface{}) {
+			errs <- sender.Encode(t, v)
+		}(test.t, test.value)
+
+		frame, err := receiver.Expect(test.t)
+		if err != nil {
+			t.Fatalf("%s: %v", test.t, err)
+		}
+		if err = <-errs; err != nil {
+			t.Fatalf("%s: encode: %v", test.t, err)
+		}
+
+		decoded := reflect.New(reflect.TypeOf(test.value).Elem()).Interface()
+		if err = frame.Decode(decoded); err != nil {
+			t.Fatalf("%s: decode: %v", test.t, err)
+		}
+		//events keep their raw content once parsed, so the values are compared through their encoding
+		got, _ := json.Marshal(decoded)
+		want, _ := json.Marshal(test.value)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %s, want %s", test.t, got, want)
+		}
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	sender, _ := pipe(t)
+	if err := sender.WriteFrame(TypeAck, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	receiver := writeRaw(t, header(Version, TypeAck, MaxFrameSize+1))
+	if _, err := receiver.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestReadFrameMaxSize(t *testing.T) {
+	sender, receiver := pipe(t)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sender.WriteFrame(TypeEncryptedEvent, make([]byte, MaxFrameSize))
+	}()
+	frame, err := receiver.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(frame.Payload) != MaxFrameSize {
+		t.Fatalf("got %d bytes, want %d", len(frame.Payload), MaxFrameSize)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	for _, version := range []uint8{0, Version + 1, 0xff} {
+		receiver := writeRaw(t, header(version, TypeAck, 0))
+		if _, err := receiver.ReadFrame(); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("version %d: got %v, want %v", version, err, ErrUnsupportedVersion)
+		}
+	}
+}
+
+func TestUnknownType(t *testing.T) {
+	for _, unknown := range []Type{0, TypeRelay + 1, 0xff} {
+		receiver := writeRaw(t, header(Version, unknown, 0))
+		if _, err := receiver.ReadFrame(); !errors.Is(err, ErrUnknownType) {
+			t.Errorf("type %d: got %v, want %v", unknown, err, ErrUnknownType)
+		}
+
+		sender, _ := pipe(t)
+		if err := sender.WriteFrame(unknown, nil); !errors.Is(err, ErrUnknownType) {
+			t.Errorf("writing type %d: got %v, want %v", unknown, err, ErrUnknownType)
+		}
+	}
+}
+
+func TestTruncatedPayload(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		_, _ = a.Write(append(header(Version, TypeAck, 10), '{'))
+		_ = a.Close()
+	}()
+	if _, err := NewDecoder(b).ReadFrame(); err == nil {
+		t.Fatal("truncated frame was accepted")
+	}
+}
+
+func TestExpectUnexpectedFrame(t *testing.T) {
+	sender, receiver := pipe(t)
+	go func() {
+		_ = sender.Encode(TypeNack, &Nack{EventID: "$event", Reason: "nope"})
+	}()
+	if _, err := receiver.Expect(TypeAck); !errors.Is(err, ErrUnexpectedFrame) {
+		t.Fatalf("got %v, want %v", err, ErrUnexpectedFrame)
+	}
+}
+
+func TestExpectErrorFrame(t *testing.T) {
+	sender, receiver := pipe(t)
+	sent := &Error{Code: ErrCodeUntrustedDevice, Message: "device is not verified"}
+	go func() {
+		_ = sender.Encode(TypeError, sent)
+	}()
+	_, err := receiver.Expect(TypeProof)
+	var remote *Error
+	if !errors.As(err, &remote) {
+		t.Fatalf("got %v, want *Error", err)
+	} else if *remote != *sent {
+		t.Fatalf("got %+v, want %+v", remote, sent)
+	}
+}
@@ -22,6 +22,8 @@ type Thesgo struct {
 	matrix *matrix.ClientWrapper
 	config *config.Config
 	stop   chan bool
+
+	onStop []func() //run by internalStop before exiting, e.g. to remove the control socket
 }
 
 func NewThesgo(configDir, dataDir, cacheDir string) *Thesgo {
@@ -66,6 +68,11 @@ func (thgo *Thesgo) StartAutosave() {
 	}
 }
 
+// OnStop registers a function that is called when the process is stopped through Stop
+func (thgo *Thesgo) OnStop(fn func()) {
+	thgo.onStop = append(thgo.onStop, fn)
+}
+
 // Stop stops the Matrix syncer and the autosave goroutine,
 // then saves everything and calls os.Exit(0).
 func (thgo *Thesgo) Stop(save bool) {
@@ -79,6 +86,9 @@ func (thgo *Thesgo) internalStop(save bool) {
 	if save {
 		thgo.Save()
 	}
+	for _, fn := range thgo.onStop {
+		fn()
+	}
 	debug.Print("Exiting process")
 	os.Exit(0)
 }